@@ -6,6 +6,7 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"github.com/open-policy-agent/opa-envoy-plugin/plugin"
 	"github.com/open-policy-agent/opa/cmd"
@@ -16,6 +17,16 @@ func main() {
 	runtime.RegisterPlugin("envoy.ext_authz.grpc", plugin.Factory{}) // for backwards compatibility
 	runtime.RegisterPlugin(plugin.PluginName, plugin.Factory{})
 
+	// Additional instances, e.g. OPA_ENVOY_PLUGIN_INSTANCES=ingress,egress, are
+	// configured as envoy_ext_authz_grpc_ingress and envoy_ext_authz_grpc_egress.
+	for _, instance := range strings.Split(os.Getenv("OPA_ENVOY_PLUGIN_INSTANCES"), ",") {
+		if instance = strings.TrimSpace(instance); instance != "" {
+			runtime.RegisterPlugin(plugin.InstanceName(instance), plugin.Factory{Instance: instance})
+		}
+	}
+
+	cmd.RootCommand.AddCommand(newReplayCommand())
+
 	if err := cmd.RootCommand.Execute(); err != nil {
 		os.Exit(1)
 	}
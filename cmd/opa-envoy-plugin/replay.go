@@ -0,0 +1,107 @@
+// Copyright 2018 The OPA Authors. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+)
+
+type replayParams struct {
+	bundlePath string
+	path       string
+}
+
+func newReplayCommand() *cobra.Command {
+	params := replayParams{}
+
+	cmd := &cobra.Command{
+		Use:   "replay <request> [<request>...]",
+		Short: "Evaluate recorded CheckRequests against a bundle",
+		Long: `Evaluate recorded CheckRequests against a bundle.
+
+Each request file holds an envoy.service.auth.v3.CheckRequest, encoded either
+as JSON or as binary protobuf. The input is built like the Envoy plugin does and
+the decision and the input are printed as one JSON object per request.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return replay(cmd.Context(), params, args)
+		},
+	}
+
+	cmd.Flags().StringVarP(&params.bundlePath, "bundle", "b", "", "bundle directory or tarball")
+	cmd.Flags().StringVar(&params.path, "path", "envoy/authz/allow", "path of the policy decision")
+	_ = cmd.MarkFlagRequired("bundle")
+
+	return cmd
+}
+
+func replay(ctx context.Context, params replayParams, files []string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	b, err := loader.NewFileLoader().AsBundle(params.bundlePath)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	for _, file := range files {
+		req, err := readCheckRequest(file)
+		if err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+
+		input, result, err := envoyauth.Evaluate(ctx, b, params.path, req, nil)
+		if err != nil && !errors.Is(err, envoyauth.ErrUndefinedDecision) {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+
+		out := map[string]interface{}{
+			"request": file,
+			"input":   input,
+		}
+		if result.Undefined {
+			out["undefined"] = true
+		} else {
+			out["decision"] = result.Decision
+		}
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readCheckRequest(file string) (*ext_authz_v3.CheckRequest, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var req ext_authz_v3.CheckRequest
+	if json.Valid(bs) {
+		err = protojson.Unmarshal(bs, &req)
+	} else {
+		err = proto.Unmarshal(bs, &req)
+	}
+	return &req, err
+}
@@ -0,0 +1,97 @@
+package envoyauth
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+// setNormalizedAddresses exposes the socket addresses of the source and the
+// destination as {"address", "port"} at attributes.<peer>.address.normalized,
+// next to the socketAddress sent by Envoy.
+func setNormalizedAddresses(attributes map[string]interface{}, source, destination socketAddress) {
+	for key, addr := range map[string]socketAddress{"source": source, "destination": destination} {
+		normalized, ok := normalizeSocketAddress(addr)
+		if !ok {
+			continue
+		}
+		peer, ok := attributes[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		address, ok := peer["address"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		address["normalized"] = normalized
+	}
+}
+
+// normalizeSocketAddress splits a port off the address, e.g. "[::1]:443",
+// strips the brackets of IPv6 addresses and formats IP addresses in their
+// canonical form, with IPv4-mapped IPv6 addresses as IPv4. Other addresses,
+// e.g. pipes, are kept as is. The port is 0 if there is none.
+func normalizeSocketAddress(addr socketAddress) (map[string]interface{}, bool) {
+	host := addr.GetAddress()
+	if host == "" {
+		return nil, false
+	}
+	port := int(addr.GetPortValue())
+
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if port == 0 {
+			port, _ = strconv.Atoi(p)
+		}
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.Unmap().String()
+	}
+
+	return map[string]interface{}{
+		"address": host,
+		"port":    port,
+	}, true
+}
+
+// setDestination exposes the destination of the request, e.g. the upstream of
+// an egress check, alike for v2 and v3: attributes.destination always has a
+// principal, the SPIFFE ID normalized like the source's or "" if unknown, and
+// the socket address in the v3 (protojson) layout, which the v2
+// (encoding/json) input lacks.
+func setDestination(logger logging.Logger, attributes map[string]interface{}, addr socketAddress) {
+	destination, ok := attributes["destination"].(map[string]interface{})
+	if !ok {
+		destination = map[string]interface{}{}
+		attributes["destination"] = destination
+	}
+
+	principal, _ := destination["principal"].(string)
+	certificate, _ := destination["certificate"].(string)
+	if id, ok := getSPIFFEID(logger, principal, certificate); ok {
+		principal = id
+	}
+	destination["principal"] = principal
+
+	if addr.GetAddress() == "" {
+		return
+	}
+	address, ok := destination["address"].(map[string]interface{})
+	if !ok {
+		address = map[string]interface{}{}
+		destination["address"] = address
+	}
+	if _, ok := address["socketAddress"]; !ok {
+		address["socketAddress"] = map[string]interface{}{
+			"address":   addr.GetAddress(),
+			"portValue": json.Number(strconv.Itoa(int(addr.GetPortValue()))),
+		}
+	}
+}
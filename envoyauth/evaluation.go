@@ -2,6 +2,7 @@ package envoyauth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -12,12 +13,21 @@ import (
 	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/topdown/builtins"
 	iCache "github.com/open-policy-agent/opa/topdown/cache"
 	"github.com/open-policy-agent/opa/topdown/print"
 	"github.com/open-policy-agent/opa/tracing"
 )
 
+// ErrUndefinedDecision is returned by Eval when the query does not produce a
+// result.
+var ErrUndefinedDecision = errors.New("undefined decision")
+
+// ExpressionsEvaluatedCounter is the metric counting the expressions evaluated
+// by Eval for results with CountExpressions set.
+const ExpressionsEvaluatedCounter = "rego_expressions_evaluated"
+
 // EvalContext - This is an SPI that has to be provided if the envoy external authorization
 // is used from outside the plugin, i.e. as a Go module
 type EvalContext interface {
@@ -76,22 +86,30 @@ func Eval(ctx context.Context, evalContext EvalContext, input ast.Value, result
 		ndbCache = builtins.NDBCache{}
 	}
 
-	var rs rego.ResultSet
-	rs, err = evalContext.PreparedQuery().Eval(
-		ctx,
+	evalOpts := []rego.EvalOption{
 		rego.EvalParsedInput(input),
 		rego.EvalTransaction(result.Txn),
 		rego.EvalMetrics(result.Metrics),
 		rego.EvalInterQueryBuiltinCache(evalContext.InterQueryBuiltinCache()),
 		rego.EvalPrintHook(&ph),
 		rego.EvalNDBuiltinCache(ndbCache),
-	)
+	}
+	if result.CountExpressions {
+		evalOpts = append(evalOpts, rego.EvalQueryTracer(exprCounter{result.Metrics.Counter(ExpressionsEvaluatedCounter)}))
+	}
+	if result.Tracer != nil {
+		evalOpts = append(evalOpts, rego.EvalQueryTracer(result.Tracer))
+	}
+
+	var rs rego.ResultSet
+	rs, err = evalContext.PreparedQuery().Eval(ctx, evalOpts...)
 
 	switch {
 	case err != nil:
 		return err
 	case len(rs) == 0:
-		return fmt.Errorf("undefined decision")
+		result.Undefined = true
+		return ErrUndefinedDecision
 	case len(rs) > 1:
 		return fmt.Errorf("multiple evaluation results")
 	}
@@ -150,6 +168,25 @@ func getRevision(ctx context.Context, store storage.Store, txn storage.Transacti
 	return nil
 }
 
+// exprCounter is a query tracer counting the expressions evaluated.
+type exprCounter struct {
+	counter metrics.Counter
+}
+
+func (exprCounter) Enabled() bool {
+	return true
+}
+
+func (c exprCounter) TraceEvent(evt topdown.Event) {
+	if evt.Op == topdown.EvalOp {
+		c.counter.Incr()
+	}
+}
+
+func (exprCounter) Config() topdown.TraceConfig {
+	return topdown.TraceConfig{}
+}
+
 type hook struct {
 	logger logging.Logger
 }
@@ -0,0 +1,86 @@
+package envoyauth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// ErrHeaderLimitExceeded is returned by RequestToInput when the headers of the
+// request exceed InputOptions.MaxHeaders or InputOptions.MaxHeaderBytes and
+// InputOptions.TruncateHeaders is not set.
+var ErrHeaderLimitExceeded = errors.New("request headers exceed the configured limit")
+
+// requestHeaders returns the HTTP headers of a v2 or v3 CheckRequest.
+func requestHeaders(req interface{}) map[string]string {
+	switch req := req.(type) {
+	case *ext_authz_v3.CheckRequest:
+		return req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	case *ext_authz_v2.CheckRequest:
+		return req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	}
+	return nil
+}
+
+// limitHeaders checks headers against the MaxHeaders and MaxHeaderBytes of
+// options, where the size of a header is the length of its name and value. It
+// returns headers and false if they are within the limits. Otherwise, it
+// returns ErrHeaderLimitExceeded or, with TruncateHeaders, the headers kept in
+// the order of their names until a limit is reached, and true.
+func limitHeaders(headers map[string]string, options InputOptions) (map[string]string, bool, error) {
+	if options.MaxHeaders <= 0 && options.MaxHeaderBytes <= 0 {
+		return headers, false, nil
+	}
+
+	var size int
+	for k, v := range headers {
+		size += len(k) + len(v)
+	}
+	countExceeded := options.MaxHeaders > 0 && len(headers) > options.MaxHeaders
+	sizeExceeded := options.MaxHeaderBytes > 0 && size > options.MaxHeaderBytes
+	if !countExceeded && !sizeExceeded {
+		return headers, false, nil
+	}
+	if !options.TruncateHeaders {
+		return nil, false, fmt.Errorf("%w: %d headers of %d bytes", ErrHeaderLimitExceeded, len(headers), size)
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	kept := map[string]string{}
+	size = 0
+	for _, k := range names {
+		v := headers[k]
+		if options.MaxHeaders > 0 && len(kept) == options.MaxHeaders {
+			break
+		}
+		if options.MaxHeaderBytes > 0 && size+len(k)+len(v) > options.MaxHeaderBytes {
+			break
+		}
+		kept[k] = v
+		size += len(k) + len(v)
+	}
+	return kept, true, nil
+}
+
+// setRequestHeaders replaces the headers at input.attributes.request.http.
+func setRequestHeaders(input map[string]interface{}, headers map[string]string) {
+	attributes, _ := input["attributes"].(map[string]interface{})
+	request, _ := attributes["request"].(map[string]interface{})
+	http, ok := request["http"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	h := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		h[k] = v
+	}
+	http["headers"] = h
+}
@@ -0,0 +1,54 @@
+package envoyauth
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+// JWTFromHeader returns the token of a header value, without the "Bearer "
+// scheme of Authorization headers.
+func JWTFromHeader(value string) string {
+	if len(value) > len("bearer ") && strings.EqualFold(value[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(value[len("bearer "):])
+	}
+	return strings.TrimSpace(value)
+}
+
+// getParsedJWT decodes the JWT of the (lowercase) header, without verifying
+// its signature, into its "header" and "payload". Headers that do not carry a
+// JWT, e.g. opaque bearer tokens, are ignored.
+func getParsedJWT(headers map[string]string, header string) map[string]interface{} {
+	value, ok := headers[header]
+	if !ok {
+		return nil
+	}
+
+	parts := strings.Split(JWTFromHeader(value), ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	h, ok := decodeJWTSegment(parts[0])
+	if !ok {
+		return nil
+	}
+	payload, ok := decodeJWTSegment(parts[1])
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{"header": h, "payload": payload}
+}
+
+func decodeJWTSegment(segment string) (map[string]interface{}, bool) {
+	bs, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return nil, false
+	}
+	var object map[string]interface{}
+	if err := util.UnmarshalJSON(bs, &object); err != nil || object == nil {
+		return nil, false
+	}
+	return object, true
+}
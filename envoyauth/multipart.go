@@ -0,0 +1,88 @@
+package envoyauth
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+// maxMultipartParts bounds the parts listed at input.parsed_multipart. A body
+// with more parts is reported as a body parse error rather than listed in
+// part, so that a policy never misses a part.
+const maxMultipartParts = 1000
+
+// isMultipartFormData reports whether the request body is multipart/form-data.
+func isMultipartFormData(headers map[string]string) bool {
+	return strings.Contains(headers["content-type"], "multipart/form-data")
+}
+
+// getMultipartMetadata returns the name, file name, content type and size of
+// each part of a multipart/form-data body, without keeping their content. It
+// returns nil for an empty body or a body without boundary, and true if the
+// body was truncated by Envoy.
+func getMultipartMetadata(logger logging.Logger, headers map[string]string, body string, rawBody []byte) ([]interface{}, bool, error) {
+	if encoding, ok := headers["content-encoding"]; ok {
+		var truncated bool
+		var err error
+		headers, body, rawBody, truncated, err = decompressBody(logger, headers, encoding, body, rawBody)
+		if err != nil || truncated {
+			return nil, truncated, err
+		}
+	}
+
+	payload := body
+	if payload == "" {
+		payload = string(rawBody)
+	}
+	if payload == "" {
+		return nil, false, nil
+	}
+
+	if val, ok := headers["content-length"]; ok {
+		truncated, err := checkIfHTTPBodyTruncated(val, int64(len(payload)))
+		if err != nil || truncated {
+			return nil, truncated, err
+		}
+	}
+
+	_, params, err := mime.ParseMediaType(headers["content-type"])
+	if err != nil {
+		return nil, false, &bodyParseError{err: err}
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, false, nil
+	}
+
+	parts := []interface{}{}
+	mr := multipart.NewReader(strings.NewReader(payload), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, &bodyParseError{err: err}
+		}
+		if len(parts) == maxMultipartParts {
+			return nil, false, &bodyParseError{err: errTooManyParts}
+		}
+
+		size, err := io.Copy(io.Discard, p)
+		if err != nil {
+			return nil, false, &bodyParseError{err: err}
+		}
+
+		parts = append(parts, map[string]interface{}{
+			"name":         p.FormName(),
+			"filename":     p.FileName(),
+			"content_type": p.Header.Get("Content-Type"),
+			"size":         size,
+		})
+	}
+
+	return parts, false, nil
+}
@@ -0,0 +1,161 @@
+package envoyauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/config"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	iCache "github.com/open-policy-agent/opa/topdown/cache"
+	"github.com/open-policy-agent/opa/tracing"
+)
+
+// Evaluate - Builds the input for a CheckRequest in either protobuf 2 or 3 like the
+// plugin does and evaluates the policy decision at path (e.g. "envoy/authz/allow")
+// against the policies and data of a bundle. It needs neither Envoy nor a running
+// plugin and is meant for testing policies against recorded requests.
+func Evaluate(ctx context.Context, b *bundle.Bundle, path string, req interface{}, logger logging.Logger, opts ...func(*InputOptions)) (map[string]interface{}, *EvalResult, error) {
+	if logger == nil {
+		logger = logging.NewNoOpLogger()
+	}
+
+	evalContext, err := newBundleEvalContext(ctx, b, path, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	input, err := RequestToInput(req, logger, nil, false, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inputValue, err := ast.InterfaceToValue(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, stop, err := NewEvalResult()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stop()
+
+	err = Eval(ctx, evalContext, inputValue, result)
+	return input, result, err
+}
+
+// bundleEvalContext is the EvalContext of Evaluate. It serves a single bundle
+// from an in-memory store.
+type bundleEvalContext struct {
+	parsedQuery         ast.Body
+	store               storage.Store
+	compiler            *ast.Compiler
+	config              *config.Config
+	logger              logging.Logger
+	preparedQuery       *rego.PreparedEvalQuery
+	preparedQueryDoOnce *sync.Once
+}
+
+func newBundleEvalContext(ctx context.Context, b *bundle.Bundle, path string, logger logging.Logger) (*bundleEvalContext, error) {
+	query := ast.Ref{ast.DefaultRootDocument}
+	for _, x := range strings.Split(strings.Trim(path, "/"), "/") {
+		if x != "" {
+			query = append(query, ast.StringTerm(x))
+		}
+	}
+	if len(query) == 1 {
+		return nil, fmt.Errorf("path must not be empty")
+	}
+
+	data := b.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	store := inmem.NewFromObject(data)
+
+	modules := make(map[string]*ast.Module, len(b.Modules))
+	err := storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		for _, m := range b.Modules {
+			parsed := m.Parsed
+			if parsed == nil {
+				var err error
+				if parsed, err = ast.ParseModule(m.Path, string(m.Raw)); err != nil {
+					return err
+				}
+			}
+			modules[m.Path] = parsed
+			if err := store.UpsertPolicy(ctx, txn, m.Path, m.Raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := ast.NewCompiler().WithEnablePrintStatements(true)
+	if compiler.Compile(modules); compiler.Failed() {
+		return nil, compiler.Errors
+	}
+
+	return &bundleEvalContext{
+		parsedQuery:         ast.NewBody(ast.NewExpr(ast.NewTerm(query))),
+		store:               store,
+		compiler:            compiler,
+		config:              &config.Config{},
+		logger:              logger,
+		preparedQueryDoOnce: new(sync.Once),
+	}, nil
+}
+
+func (e *bundleEvalContext) ParsedQuery() ast.Body {
+	return e.parsedQuery
+}
+
+func (e *bundleEvalContext) Store() storage.Store {
+	return e.store
+}
+
+func (e *bundleEvalContext) Compiler() *ast.Compiler {
+	return e.compiler
+}
+
+func (*bundleEvalContext) Runtime() *ast.Term {
+	return nil
+}
+
+func (e *bundleEvalContext) PreparedQueryDoOnce() *sync.Once {
+	return e.preparedQueryDoOnce
+}
+
+func (*bundleEvalContext) InterQueryBuiltinCache() iCache.InterQueryCache {
+	return nil
+}
+
+func (e *bundleEvalContext) PreparedQuery() *rego.PreparedEvalQuery {
+	return e.preparedQuery
+}
+
+func (e *bundleEvalContext) SetPreparedQuery(pq *rego.PreparedEvalQuery) {
+	e.preparedQuery = pq
+}
+
+func (e *bundleEvalContext) Logger() logging.Logger {
+	return e.logger
+}
+
+func (e *bundleEvalContext) Config() *config.Config {
+	return e.config
+}
+
+func (*bundleEvalContext) DistributedTracing() tracing.Options {
+	return nil
+}
@@ -0,0 +1,96 @@
+package envoyauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestEvaluate(t *testing.T) {
+	module := `
+		package envoy.authz
+
+		default allow = false
+
+		allow {
+			input.attributes.request.http.method == "GET"
+			input.attributes.request.http.path == data.paths[_]
+		}`
+
+	b := &bundle.Bundle{
+		Data: map[string]interface{}{
+			"paths": []interface{}{"/people"},
+		},
+		Modules: []bundle.ModuleFile{
+			{Path: "example.rego", Raw: []byte(module)},
+		},
+	}
+
+	tests := map[string]struct {
+		request  string
+		path     string
+		expected interface{}
+		err      error
+	}{
+		"allowed": {
+			request:  `{"attributes": {"request": {"http": {"method": "GET", "path": "/people"}}}}`,
+			path:     "envoy/authz/allow",
+			expected: true,
+		},
+		"denied": {
+			request:  `{"attributes": {"request": {"http": {"method": "POST", "path": "/people"}}}}`,
+			path:     "envoy/authz/allow",
+			expected: false,
+		},
+		"undefined": {
+			request: `{"attributes": {"request": {"http": {"method": "GET", "path": "/people"}}}}`,
+			path:    "envoy/authz/missing",
+			err:     ErrUndefinedDecision,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req ext_authz_v3.CheckRequest
+			if err := util.Unmarshal([]byte(tc.request), &req); err != nil {
+				t.Fatal(err)
+			}
+
+			input, result, err := Evaluate(context.Background(), b, tc.path, &req, nil)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("Expected error %v but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Decision != tc.expected {
+				t.Fatalf("Expected decision %v but got %v", tc.expected, result.Decision)
+			}
+			if _, ok := input["parsed_path"]; !ok {
+				t.Fatalf("Expected built input but got %v", input)
+			}
+		})
+	}
+}
+
+func TestEvaluateCompileError(t *testing.T) {
+	b := &bundle.Bundle{
+		Modules: []bundle.ModuleFile{
+			{Path: "example.rego", Raw: []byte(`package envoy.authz
+
+allow { x }`)},
+		},
+	}
+
+	if _, _, err := Evaluate(context.Background(), b, "envoy/authz/allow", &ext_authz_v3.CheckRequest{}, nil); err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+}
@@ -1,39 +1,212 @@
 package envoyauth
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
+	"net/netip"
+	"net/textproto"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	"github.com/open-policy-agent/opa/logging"
 	"github.com/open-policy-agent/opa/util"
 )
 
+// maxPooledBufferSize bounds the size of the buffers kept in marshalBufferPool, so
+// that a single large request does not pin its buffer in memory.
+const maxPooledBufferSize = 64 * 1024
+
+// marshalBufferPool holds the buffers the CheckRequest is serialized into before it
+// is decoded into the input map. Decoding copies all values, so neither the input
+// map nor the ast.Value built from it reference a pooled buffer.
+var marshalBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
 var v2Info = map[string]string{"ext_authz": "v2", "encoding": "encoding/json"}
 var v3Info = map[string]string{"ext_authz": "v3", "encoding": "protojson"}
 
+const (
+	// InputProfileFull builds the input from the complete CheckRequest. This is the default.
+	InputProfileFull = "full"
+
+	// InputProfileMinimal only includes the request method, path, source address and a
+	// selected set of headers in the input. The request body is never parsed.
+	InputProfileMinimal = "minimal"
+)
+
+const (
+	// HeaderNormalizationNone keeps the header keys as sent by Envoy. This is the default.
+	HeaderNormalizationNone = "none"
+
+	// HeaderNormalizationLowercase lowercases the header keys.
+	HeaderNormalizationLowercase = "lowercase"
+
+	// HeaderNormalizationCanonical converts the header keys to their canonical
+	// MIME form, e.g. "content-type" becomes "Content-Type".
+	HeaderNormalizationCanonical = "canonical"
+)
+
+// InputOptions - Controls how a CheckRequest is converted to an input map
+type InputOptions struct {
+	// Profile is either InputProfileFull or InputProfileMinimal. An empty value means InputProfileFull.
+	Profile string
+	// ProfileHeaders are the (lowercase) headers included with InputProfileMinimal.
+	ProfileHeaders []string
+	// NodeHeader is the (lowercase) request header identifying the Envoy node that
+	// sent the request. Its value is exposed at input.attributes.node.
+	NodeHeader string
+	// HeaderNormalization is one of the HeaderNormalization constants. An empty value
+	// means HeaderNormalizationNone.
+	HeaderNormalization string
+	// PreserveOriginalHeaders keeps the headers as sent by Envoy at
+	// input.attributes.request.http.headers_original when they are normalized.
+	PreserveOriginalHeaders bool
+	// XFFNumTrustedHops is the number of trusted proxies in front of Envoy,
+	// used to find the address of the client in the x-forwarded-for header.
+	// See TrustedProxies.
+	XFFNumTrustedHops int
+	// TrustedProxies are the addresses of the trusted proxies in front of
+	// Envoy. With TrustedProxies or XFFNumTrustedHops, the address of the
+	// client is exposed at input.attributes.source.address.trusted.
+	TrustedProxies []netip.Prefix
+	// IncludeRawRequest adds the whole CheckRequest, converted to JSON with
+	// protojson, at input.raw. It roughly doubles the cost of building the input.
+	IncludeRawRequest bool
+	// JWTHeader is the (lowercase) request header whose JWT is decoded,
+	// without verifying its signature, at input.parsed_jwt.
+	JWTHeader string
+	// StripPathPrefix is removed from the request path, e.g. "/api" turns
+	// "/api/v1/products" into "/v1/products", before it is exposed at
+	// input.attributes.request.http.path and input.parsed_path. The path as
+	// sent by Envoy is kept at input.attributes.request.http.original_path.
+	StripPathPrefix string
+	// MultipartMetadata lists the name, file name, content type and size of
+	// the parts of multipart/form-data bodies at input.parsed_multipart,
+	// instead of parsing their content at input.parsed_body.
+	MultipartMetadata bool
+	// SourceWorkload exposes the name, namespace and version of the workload
+	// that sent the request, e.g. in an Istio mesh, at input.source_workload.
+	SourceWorkload bool
+	// SourceWorkloadFields maps the fields of input.source_workload, "name",
+	// "namespace" and "version", to a path in the filter metadata of the
+	// request's metadata_context, "<filter>/<key>[/<key>...]". Fields without
+	// a path are read from the Istio proxy metadata keys, e.g. WORKLOAD_NAME.
+	SourceWorkloadFields map[string]string
+	// DefaultBodyContentType is the content type the request body is parsed
+	// as when the request has no (or an empty) content-type header, e.g.
+	// "application/json". The content-type of the request always wins. An
+	// empty value leaves such bodies unparsed.
+	DefaultBodyContentType string
+	// MaxHeaders and MaxHeaderBytes limit the number and the size (names and
+	// values) of the request headers copied into the input. Zero means no
+	// limit. Requests over a limit are rejected with ErrHeaderLimitExceeded,
+	// or with TruncateHeaders, have their headers truncated, see
+	// input.truncated_headers.
+	MaxHeaders     int
+	MaxHeaderBytes int
+	// TruncateHeaders truncates the headers of requests over MaxHeaders or
+	// MaxHeaderBytes instead of rejecting them. input.raw keeps all of them.
+	TruncateHeaders bool
+}
+
 // RequestToInput - Converts a CheckRequest in either protobuf 2 or 3 to an input map
-func RequestToInput(req interface{}, logger logging.Logger, protoSet *protoregistry.Files, skipRequestBodyParse bool) (map[string]interface{}, error) {
+func RequestToInput(req interface{}, logger logging.Logger, protoSet *protoregistry.Files, skipRequestBodyParse bool, opts ...func(*InputOptions)) (map[string]interface{}, error) {
+	options := InputOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	input, err := requestToInput(req, logger, protoSet, skipRequestBodyParse, options)
+	if err != nil || !options.IncludeRawRequest {
+		return input, err
+	}
+
+	raw, err := rawRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	input["raw"] = raw
+	return input, nil
+}
+
+// rawRequest converts the whole CheckRequest to JSON, independently of the
+// input profile and the header normalization.
+func rawRequest(req interface{}) (map[string]interface{}, error) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("unsupported check request type %T", req)
+	}
+
+	bs, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := util.UnmarshalJSON(bs, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func requestToInput(req interface{}, logger logging.Logger, protoSet *protoregistry.Files, skipRequestBodyParse bool, options InputOptions) (map[string]interface{}, error) {
 	var err error
 	var input map[string]interface{}
 
 	var bs, rawBody []byte
-	var path, body string
+	var path, body, sni string
 	var headers, version map[string]string
+	var conn map[string]interface{}
+	var peer, destination socketAddress
+	var filterMetadata map[string]*structpb.Struct
+
+	buf := marshalBufferPool.Get().(*[]byte)
+	defer func() {
+		if cap(bs) > maxPooledBufferSize {
+			return
+		}
+		if bs != nil {
+			*buf = bs[:0]
+		}
+		marshalBufferPool.Put(buf)
+	}()
+
+	// Checked before the request is marshaled, so that the cost of a request
+	// with too many headers is not paid.
+	limitedHeaders, truncatedHeaders, err := limitHeaders(requestHeaders(req), options)
+	if err != nil {
+		return nil, err
+	}
 
 	// NOTE: The path/body/headers blocks look silly, but they allow us to retrieve
 	//       the parts of the incoming request we care about, without having to convert
@@ -41,7 +214,10 @@ func RequestToInput(req interface{}, logger logging.Logger, protoSet *protoregis
 	//       etc -- we only care for its JSON representation as fed into evaluation later.
 	switch req := req.(type) {
 	case *ext_authz_v3.CheckRequest:
-		bs, err = protojson.Marshal(req)
+		if options.Profile == InputProfileMinimal {
+			return minimalInput(req.GetAttributes().GetRequest().GetHttp(), req.GetAttributes().GetSource().GetAddress().GetSocketAddress(), v3Info, options)
+		}
+		bs, err = protojson.MarshalOptions{}.MarshalAppend((*buf)[:0], req)
 		if err != nil {
 			return nil, err
 		}
@@ -49,16 +225,41 @@ func RequestToInput(req interface{}, logger logging.Logger, protoSet *protoregis
 		body = req.GetAttributes().GetRequest().GetHttp().GetBody()
 		headers = req.GetAttributes().GetRequest().GetHttp().GetHeaders()
 		rawBody = req.GetAttributes().GetRequest().GetHttp().GetRawBody()
+		sni = req.GetAttributes().GetTlsSession().GetSni()
+		peer = req.GetAttributes().GetSource().GetAddress().GetSocketAddress()
+		destination = req.GetAttributes().GetDestination().GetAddress().GetSocketAddress()
+		filterMetadata = req.GetAttributes().GetMetadataContext().GetFilterMetadata()
 		version = v3Info
+		if req.GetAttributes().GetRequest().GetHttp() == nil {
+			conn = getConnectionAttributes(
+				req.GetAttributes().GetSource().GetAddress().GetSocketAddress(),
+				req.GetAttributes().GetDestination().GetAddress().GetSocketAddress(),
+				sni,
+			)
+		}
 	case *ext_authz_v2.CheckRequest:
-		bs, err = json.Marshal(req)
-		if err != nil {
+		if options.Profile == InputProfileMinimal {
+			return minimalInput(req.GetAttributes().GetRequest().GetHttp(), req.GetAttributes().GetSource().GetAddress().GetSocketAddress(), v2Info, options)
+		}
+		w := bytes.NewBuffer((*buf)[:0])
+		if err = json.NewEncoder(w).Encode(req); err != nil {
 			return nil, err
 		}
+		bs = w.Bytes()
 		path = req.GetAttributes().GetRequest().GetHttp().GetPath()
 		body = req.GetAttributes().GetRequest().GetHttp().GetBody()
 		headers = req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+		peer = req.GetAttributes().GetSource().GetAddress().GetSocketAddress()
+		destination = req.GetAttributes().GetDestination().GetAddress().GetSocketAddress()
+		filterMetadata = req.GetAttributes().GetMetadataContext().GetFilterMetadata()
 		version = v2Info
+		if req.GetAttributes().GetRequest().GetHttp() == nil {
+			conn = getConnectionAttributes(
+				req.GetAttributes().GetSource().GetAddress().GetSocketAddress(),
+				req.GetAttributes().GetDestination().GetAddress().GetSocketAddress(),
+				sni,
+			)
+		}
 	}
 
 	err = util.UnmarshalJSON(bs, &input)
@@ -67,6 +268,26 @@ func RequestToInput(req interface{}, logger logging.Logger, protoSet *protoregis
 	}
 	input["version"] = version
 
+	if attributes, ok := input["attributes"].(map[string]interface{}); ok {
+		setNormalizedAddresses(attributes, peer, destination)
+		setDestination(logger, attributes, destination)
+	}
+
+	if options.MaxHeaders > 0 || options.MaxHeaderBytes > 0 {
+		if truncatedHeaders {
+			headers = limitedHeaders
+			setRequestHeaders(input, headers)
+		}
+		input["truncated_headers"] = truncatedHeaders
+	}
+
+	// Network (L4) checks carry no HTTP request, so there is no path or body to
+	// parse. The connection attributes are exposed under "connection" instead.
+	if conn != nil {
+		input["connection"] = conn
+		return input, nil
+	}
+
 	parsedPath, parsedQuery, err := getParsedPathAndQuery(path)
 	if err != nil {
 		return nil, err
@@ -75,19 +296,384 @@ func RequestToInput(req interface{}, logger logging.Logger, protoSet *protoregis
 	input["parsed_path"] = parsedPath
 	input["parsed_query"] = parsedQuery
 
-	if !skipRequestBodyParse {
-		parsedBody, isBodyTruncated, err := getParsedBody(logger, headers, body, rawBody, parsedPath, protoSet)
-		if err != nil {
+	if attributes, ok := input["attributes"].(map[string]interface{}); ok {
+		if request, ok := attributes["request"].(map[string]interface{}); ok {
+			if http, ok := request["http"].(map[string]interface{}); ok {
+				if err := stripPathPrefix(input, http, path, options.StripPathPrefix); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if traceContext := getTraceContext(headers); traceContext != nil {
+		input["trace"] = traceContext
+	}
+
+	if members := getBaggage(headers); members != nil {
+		input["baggage"] = members
+	}
+
+	if options.JWTHeader != "" {
+		if jwt := getParsedJWT(headers, options.JWTHeader); jwt != nil {
+			input["parsed_jwt"] = jwt
+		}
+	}
+
+	if attributes, ok := input["attributes"].(map[string]interface{}); ok {
+		source, ok := attributes["source"].(map[string]interface{})
+		if !ok {
+			source = map[string]interface{}{}
+			attributes["source"] = source
+		}
+		principal, _ := source["principal"].(string)
+		certificate, _ := source["certificate"].(string)
+		if id, ok := getSPIFFEID(logger, principal, certificate); ok {
+			source["principal"] = id
+			principal = id
+		}
+		if options.SourceWorkload {
+			input["source_workload"] = getSourceWorkload(filterMetadata, principal, options.SourceWorkloadFields)
+		}
+		// The v3 TLS session info is at attributes.tlsSession, and v2 has none.
+		// Expose the SNI with the other client attributes for both, empty if
+		// unknown, like input.connection.sni for network checks.
+		source["tls_session"] = map[string]interface{}{"sni": sni}
+		if client, ok := trustedClientAddress(peer.GetAddress(), headers["x-forwarded-for"], options); ok {
+			address, ok := source["address"].(map[string]interface{})
+			if !ok {
+				address = map[string]interface{}{}
+				source["address"] = address
+			}
+			address["trusted"] = client
+		}
+		setNodeAttribute(attributes, headers, options.NodeHeader)
+		if request, ok := attributes["request"].(map[string]interface{}); ok {
+			if http, ok := request["http"].(map[string]interface{}); ok {
+				normalizeHeaders(http, options)
+			}
+		}
+	}
+
+	bodyHeaders := withDefaultContentType(headers, options.DefaultBodyContentType)
+	multipartMetadata := options.MultipartMetadata && isMultipartFormData(bodyHeaders)
+
+	if multipartMetadata {
+		parts, isBodyTruncated, err := getMultipartMetadata(logger, bodyHeaders, body, rawBody)
+		var parseErr *bodyParseError
+		switch {
+		case errors.As(err, &parseErr):
+			logger.Debug("Unable to parse multipart request body: %v", parseErr)
+			input["body_parse_error"] = true
+		case err != nil:
 			return nil, err
+		case parts != nil:
+			input["parsed_multipart"] = parts
 		}
+		input["truncated_body"] = isBodyTruncated
+	}
 
-		input["parsed_body"] = parsedBody
+	if !skipRequestBodyParse && !multipartMetadata {
+		parsedBody, isBodyTruncated, err := getParsedBody(logger, bodyHeaders, body, rawBody, parsedPath, protoSet)
+		var parseErr *bodyParseError
+		switch {
+		case errors.As(err, &parseErr):
+			// The body is sent by the client: leave it to the policy to
+			// decide, the raw body is still in the input.
+			logger.Debug("Unable to parse request body: %v", parseErr)
+			input["body_parse_error"] = true
+		case err != nil:
+			return nil, err
+		default:
+			input["parsed_body"] = parsedBody
+		}
 		input["truncated_body"] = isBodyTruncated
 	}
 
 	return input, nil
 }
 
+// withDefaultContentType returns headers with a content-type of contentType if
+// they have none. The headers of the request are left untouched, so the policy
+// still sees the request without a content-type.
+func withDefaultContentType(headers map[string]string, contentType string) map[string]string {
+	if contentType == "" || headers["content-type"] != "" {
+		return headers
+	}
+
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h["content-type"] = contentType
+	return h
+}
+
+// bodyParseError is the error of a request body that is not valid JSON, or
+// not valid multipart/form-data. It does not fail the conversion of the
+// request: parsed_body (or parsed_multipart) is left out of the input and
+// body_parse_error is set instead.
+type bodyParseError struct {
+	err error
+}
+
+func (e *bodyParseError) Error() string {
+	return "invalid request body: " + e.err.Error()
+}
+
+func (e *bodyParseError) Unwrap() error {
+	return e.err
+}
+
+// httpRequest is implemented by both the v2 and v3 envoy HTTP request attributes.
+type httpRequest interface {
+	GetMethod() string
+	GetPath() string
+	GetHeaders() map[string]string
+}
+
+// minimalInput builds the input for InputProfileMinimal. The attributes keep the
+// same layout as the v3 (protojson) input so policies work with either profile.
+func minimalInput(req httpRequest, source socketAddress, version map[string]string, options InputOptions) (map[string]interface{}, error) {
+	parsedPath, parsedQuery, err := getParsedPathAndQuery(req.GetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	all := req.GetHeaders()
+	headers := make(map[string]interface{}, len(options.ProfileHeaders))
+	for _, name := range options.ProfileHeaders {
+		if v, ok := all[name]; ok {
+			headers[name] = v
+		}
+	}
+
+	http := map[string]interface{}{
+		"method":  req.GetMethod(),
+		"path":    req.GetPath(),
+		"headers": headers,
+	}
+	normalizeHeaders(http, options)
+
+	input := map[string]interface{}{
+		"version":      version,
+		"parsed_path":  parsedPath,
+		"parsed_query": parsedQuery,
+	}
+	if err := stripPathPrefix(input, http, req.GetPath(), options.StripPathPrefix); err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]interface{}{
+		"request": map[string]interface{}{
+			"http": http,
+		},
+		"source": map[string]interface{}{
+			"address": map[string]interface{}{
+				"socketAddress": map[string]interface{}{
+					"address": source.GetAddress(),
+				},
+			},
+		},
+	}
+	setNodeAttribute(attributes, all, options.NodeHeader)
+	input["attributes"] = attributes
+
+	return input, nil
+}
+
+// stripPathPrefix removes prefix from the path of the HTTP request attributes
+// and from input.parsed_path, keeping the path at original_path. Only whole
+// segments are removed: "/api" is stripped from "/api" and "/api/v1", but not
+// from "/apis".
+func stripPathPrefix(input, http map[string]interface{}, path, prefix string) error {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return nil
+	}
+
+	stripped := path[len(prefix):]
+	if stripped != "" && stripped[0] != '/' && stripped[0] != '?' {
+		return nil
+	}
+	if stripped == "" || stripped[0] == '?' {
+		stripped = "/" + stripped
+	}
+
+	parsedPath, _, err := getParsedPathAndQuery(stripped)
+	if err != nil {
+		return err
+	}
+
+	input["parsed_path"] = parsedPath
+	http["path"] = stripped
+	http["original_path"] = path
+	return nil
+}
+
+// normalizeHeaders rewrites the header keys of the HTTP request attributes
+// according to options.HeaderNormalization. Envoy already sends lowercase keys
+// for HTTP/2 and, by default, for HTTP/1.1 requests. Values of keys that only
+// differ in case are joined with a comma, as Envoy does for repeated headers.
+func normalizeHeaders(http map[string]interface{}, options InputOptions) {
+	var normalize func(string) string
+	switch options.HeaderNormalization {
+	case HeaderNormalizationLowercase:
+		normalize = strings.ToLower
+	case HeaderNormalizationCanonical:
+		normalize = textproto.CanonicalMIMEHeaderKey
+	default:
+		return
+	}
+
+	headers, ok := http["headers"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	normalized := make(map[string]interface{}, len(headers))
+	for _, k := range keys {
+		nk := normalize(k)
+		if prev, ok := normalized[nk].(string); ok {
+			if v, ok := headers[k].(string); ok {
+				normalized[nk] = prev + "," + v
+				continue
+			}
+		}
+		normalized[nk] = headers[k]
+	}
+
+	if options.PreserveOriginalHeaders {
+		http["headers_original"] = headers
+	}
+	http["headers"] = normalized
+}
+
+// setNodeAttribute exposes the identity of the Envoy node that sent the request.
+// The CheckRequest does not carry the node, so it is taken from a request header
+// that Envoy is configured to add, e.g. with request_headers_to_add.
+func setNodeAttribute(attributes map[string]interface{}, headers map[string]string, nodeHeader string) {
+	if nodeHeader == "" {
+		return
+	}
+	if node, ok := headers[nodeHeader]; ok {
+		attributes["node"] = node
+	}
+}
+
+// socketAddress is implemented by both the v2 and v3 envoy SocketAddress types.
+type socketAddress interface {
+	GetAddress() string
+	GetPortValue() uint32
+}
+
+func getConnectionAttributes(source, destination socketAddress, sni string) map[string]interface{} {
+	peer := func(addr socketAddress) map[string]interface{} {
+		return map[string]interface{}{
+			"address": addr.GetAddress(),
+			"port":    int(addr.GetPortValue()),
+		}
+	}
+
+	return map[string]interface{}{
+		"source":      peer(source),
+		"destination": peer(destination),
+		"sni":         sni,
+	}
+}
+
+// getSPIFFEID returns the normalized SPIFFE ID of a peer. Envoy sets the principal
+// to the URI SAN of the peer certificate when there is one; otherwise the ID is
+// looked up in the URI SANs of the (URL encoded, PEM) certificate, if Envoy sent it.
+func getSPIFFEID(logger logging.Logger, principal, certificate string) (string, bool) {
+	if id, ok := normalizeSPIFFEID(principal); ok {
+		return id, true
+	}
+
+	if certificate == "" {
+		return "", false
+	}
+
+	pemCert, err := url.QueryUnescape(certificate)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Debug("could not decode peer certificate")
+		return "", false
+	}
+
+	block, _ := pem.Decode([]byte(pemCert))
+	if block == nil {
+		logger.Debug("no PEM data found in peer certificate")
+		return "", false
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Debug("could not parse peer certificate")
+		return "", false
+	}
+
+	for _, uri := range cert.URIs {
+		if id, ok := normalizeSPIFFEID(uri.String()); ok {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// normalizeSPIFFEID lowercases the scheme and trust domain of a SPIFFE ID and
+// strips any trailing slash from its path.
+func normalizeSPIFFEID(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || !strings.EqualFold(u.Scheme, "spiffe") || u.Host == "" {
+		return "", false
+	}
+
+	return "spiffe://" + strings.ToLower(u.Host) + strings.TrimRight(u.Path, "/"), true
+}
+
+// getTraceContext returns the W3C trace context and request ID that Envoy forwarded
+// with the request, or nil if there are none.
+func getTraceContext(headers map[string]string) map[string]interface{} {
+	traceContext := map[string]interface{}{}
+
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier(headers))
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		traceContext["trace_id"] = sc.TraceID().String()
+		traceContext["span_id"] = sc.SpanID().String()
+		traceContext["sampled"] = sc.IsSampled()
+	}
+
+	if requestID, ok := headers["x-request-id"]; ok {
+		traceContext["request_id"] = requestID
+	}
+
+	if len(traceContext) == 0 {
+		return nil
+	}
+	return traceContext
+}
+
+// getBaggage returns the values of the OpenTelemetry baggage members of the
+// baggage header, without their properties. Invalid baggage is ignored.
+func getBaggage(headers map[string]string) map[string]interface{} {
+	b, err := baggage.Parse(headers["baggage"])
+	if err != nil || b.Len() == 0 {
+		return nil
+	}
+
+	members := make(map[string]interface{}, b.Len())
+	for _, m := range b.Members() {
+		members[m.Key()] = m.Value()
+	}
+	return members
+}
+
 func getParsedPathAndQuery(path string) ([]interface{}, map[string]interface{}, error) {
 	parsedURL, err := url.Parse(path)
 	if err != nil {
@@ -115,6 +701,18 @@ func getParsedPathAndQuery(path string) ([]interface{}, map[string]interface{},
 func getParsedBody(logger logging.Logger, headers map[string]string, body string, rawBody []byte, parsedPath []interface{}, protoSet *protoregistry.Files) (interface{}, bool, error) {
 	var data interface{}
 
+	if encoding, ok := headers["content-encoding"]; ok && !strings.Contains(headers["content-type"], "application/grpc") {
+		var truncated bool
+		var err error
+		headers, body, rawBody, truncated, err = decompressBody(logger, headers, encoding, body, rawBody)
+		if err != nil {
+			return nil, false, err
+		}
+		if truncated {
+			return nil, true, nil
+		}
+	}
+
 	if val, ok := headers["content-type"]; ok {
 		if strings.Contains(val, "application/json") {
 
@@ -137,7 +735,7 @@ func getParsedBody(logger logging.Logger, headers map[string]string, body string
 
 			err := util.UnmarshalJSON([]byte(body), &data)
 			if err != nil {
-				return nil, false, err
+				return nil, false, &bodyParseError{err: err}
 			}
 		} else if strings.Contains(val, "application/grpc") {
 
@@ -159,7 +757,7 @@ func getParsedBody(logger logging.Logger, headers map[string]string, body string
 				return nil, false, fmt.Errorf("invalid parsed path")
 			}
 
-			known, truncated, err := getGRPCBody(logger, rawBody, parsedPath, &data, protoSet)
+			known, truncated, err := getGRPCBody(logger, rawBody, headers["grpc-encoding"], parsedPath, &data, protoSet)
 			if err != nil {
 				return nil, false, err
 			}
@@ -253,7 +851,7 @@ func getParsedBody(logger logging.Logger, headers map[string]string, body string
 				case strings.Contains(p.Header.Get("Content-Type"), "application/json"):
 					var jsonValue interface{}
 					if err := util.UnmarshalJSON(value, &jsonValue); err != nil {
-						return nil, false, err
+						return nil, false, &bodyParseError{err: err}
 					}
 					values[name] = append(values[name], jsonValue)
 				default:
@@ -272,7 +870,49 @@ func getParsedBody(logger logging.Logger, headers map[string]string, body string
 	return data, false, nil
 }
 
-func getGRPCBody(logger logging.Logger, in []byte, parsedPath []interface{}, data interface{}, files *protoregistry.Files) (found, truncated bool, _ error) {
+// decompressBody decompresses a gzip or deflate encoded HTTP request body. The
+// content-length of a compressed body refers to the compressed payload, so
+// truncation is checked before decompressing and the returned headers no longer
+// carry a content-length. If the body cannot be decompressed it is returned
+// unchanged.
+func decompressBody(logger logging.Logger, headers map[string]string, encoding, body string, rawBody []byte) (map[string]string, string, []byte, bool, error) {
+	payload := rawBody
+	if body != "" {
+		payload = []byte(body)
+	}
+	if len(payload) == 0 {
+		return headers, body, rawBody, false, nil
+	}
+
+	if val, ok := headers["content-length"]; ok {
+		truncated, err := checkIfHTTPBodyTruncated(val, int64(len(payload)))
+		if err != nil {
+			return nil, "", nil, false, err
+		}
+		if truncated {
+			return nil, "", nil, true, nil
+		}
+	}
+
+	decompressed, err := decompress(payload, encoding)
+	if err != nil {
+		if err != errUnsupportedEncoding {
+			logger.WithFields(map[string]interface{}{"err": err, "content-encoding": encoding}).Warn("Unable to decompress request body.")
+		}
+		return headers, body, rawBody, false, nil
+	}
+
+	decompressedHeaders := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if k != "content-length" {
+			decompressedHeaders[k] = v
+		}
+	}
+
+	return decompressedHeaders, string(decompressed), nil, false, nil
+}
+
+func getGRPCBody(logger logging.Logger, in []byte, encoding string, parsedPath []interface{}, data interface{}, files *protoregistry.Files) (found, truncated bool, _ error) {
 
 	// the first 5 bytes are part of gRPC framing. We need to remove them to be able to parse
 	// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
@@ -281,13 +921,9 @@ func getGRPCBody(logger logging.Logger, in []byte, parsedPath []interface{}, dat
 		return false, false, fmt.Errorf("less than 5 bytes")
 	}
 
-	// Can be 0 or 1, 1 indicates that the payload is compressed.
-	// The method could be looked up in the request headers, and the
-	// request decompressed; but for now, let's skip it.
-	if in[0] != 0 {
-		logger.Debug("gRPC payload compression not supported")
-		return false, false, nil
-	}
+	// Can be 0 or 1, 1 indicates that the payload is compressed with the
+	// algorithm named in the grpc-encoding header.
+	compressed := in[0] != 0
 
 	// Note: we're only reading one message, this is the first message's size
 	size := binary.BigEndian.Uint32(in[1:5])
@@ -296,6 +932,18 @@ func getGRPCBody(logger logging.Logger, in []byte, parsedPath []interface{}, dat
 	}
 	in = in[5 : size+5]
 
+	if compressed {
+		var err error
+		in, err = decompress(in, encoding)
+		if err == errUnsupportedEncoding {
+			logger.WithFields(map[string]interface{}{"grpc-encoding": encoding}).Debug("gRPC payload compression not supported")
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+	}
+
 	// Note: we've already checked that len(path)>=2
 	svc, err := findService(parsedPath[0].(string), files)
 	if err != nil {
@@ -318,13 +966,52 @@ func getGRPCBody(logger logging.Logger, in []byte, parsedPath []interface{}, dat
 		return true, false, err
 	}
 
-	if err := util.Unmarshal([]byte(jsonBody), &data); err != nil {
+	// Decode the JSON directly, keeping numbers as json.Number like the JSON
+	// bodies: util.Unmarshal would go through YAML.
+	if err := util.UnmarshalJSON(jsonBody, &data); err != nil {
 		return true, false, err
 	}
 
 	return true, false, nil
 }
 
+// maxDecompressedBodySize bounds the size of a decompressed request body so
+// that a small compressed payload cannot expand into an arbitrarily large input.
+const maxDecompressedBodySize = 16 * 1024 * 1024
+
+var errUnsupportedEncoding = errors.New("unsupported encoding")
+
+var errTooManyParts = fmt.Errorf("more than %d parts", maxMultipartParts)
+
+// decompress decompresses a request body or gRPC message using one of the
+// gzip or deflate encodings supported by both HTTP and gRPC.
+func decompress(in []byte, encoding string) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(in))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(in))
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedBodySize {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxDecompressedBodySize)
+	}
+	return out, nil
+}
+
 func findService(path string, files *protoregistry.Files) (protoreflect.ServiceDescriptor, error) {
 	desc, err := files.FindDescriptorByName(protoreflect.FullName(path))
 	if err != nil {
@@ -0,0 +1,43 @@
+package envoyauth
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+func BenchmarkRequestToInput(b *testing.B) {
+	req := createCheckRequest(`{
+		"attributes": {
+		  "request": {
+			"http": {
+			  "id": "13359530607844510314",
+			  "method": "POST",
+			  "headers": {
+				":authority": "192.168.99.100:31380",
+				":method": "POST",
+				":path": "/api/v1/products",
+				"accept": "*/*",
+				"authorization": "Basic Ym9iOnBhc3N3b3Jk",
+				"content-type": "application/json",
+				"user-agent": "curl/7.54.0",
+				"x-request-id": "92a6c0f7-0250-944b-9cfc-ae10cbcedd8e"
+			  },
+			  "path": "/api/v1/products?limit=10",
+			  "host": "192.168.99.100:31380",
+			  "protocol": "HTTP/1.1",
+			  "body": "{\"firstname\": \"foo\", \"lastname\": \"bar\"}"
+			}
+		  }
+		}
+	  }`)
+	logger := logging.NewNoOpLogger()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := RequestToInput(req, logger, nil, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,15 +1,34 @@
 package envoyauth
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/netip"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	ext_authz "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	internal_util "github.com/open-policy-agent/opa-envoy-plugin/internal/util"
 	"github.com/open-policy-agent/opa/logging"
 	"github.com/open-policy-agent/opa/util"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
@@ -393,6 +412,113 @@ func TestGetParsedBody(t *testing.T) {
 	}
 }
 
+func TestRequestToInputMalformedJSONBody(t *testing.T) {
+	tests := map[string]struct {
+		contentType string
+		body        string
+	}{
+		"invalid":   {contentType: "application/json", body: `["foo" : 42}`},
+		"truncated": {contentType: "application/json", body: `{"firstname": "foo", "lastn`},
+		"multipart json part": {
+			contentType: "multipart/form-data; boundary=foo",
+			body:        "--foo\r\nContent-Disposition: form-data; name=\"bar\"\r\nContent-Type: application/json\r\n\r\n{\"name\": \r\n--foo--\r\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &ext_authz.CheckRequest{Attributes: &ext_authz.AttributeContext{
+				Request: &ext_authz.AttributeContext_Request{
+					Http: &ext_authz.AttributeContext_HttpRequest{
+						Path:    "/",
+						Headers: map[string]string{"content-type": tc.contentType},
+						Body:    tc.body,
+					},
+				},
+			}}
+
+			input, err := RequestToInput(req, logging.NewNoOpLogger(), nil, false)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+
+			if _, ok := input["parsed_body"]; ok {
+				t.Fatalf("Expected no parsed_body but got %v", input["parsed_body"])
+			}
+			if input["body_parse_error"] != true {
+				t.Fatalf("Expected body_parse_error but got %v", input["body_parse_error"])
+			}
+			body := input["attributes"].(map[string]interface{})["request"].(map[string]interface{})["http"].(map[string]interface{})["body"]
+			if body != tc.body {
+				t.Fatalf("Expected raw body %q but got %v", tc.body, body)
+			}
+		})
+	}
+}
+
+func TestGetParsedBodyCompressed(t *testing.T) {
+	payload := []byte(`{"firstname": "foo", "lastname": "bar"}`)
+
+	var gzipped, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(payload)
+	gw.Close()
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(payload)
+	zw.Close()
+
+	expected := map[string]interface{}{"firstname": "foo", "lastname": "bar"}
+
+	tests := map[string]struct {
+		headers   map[string]string
+		body      string
+		rawBody   []byte
+		want      interface{}
+		truncated bool
+	}{
+		"gzip raw body": {
+			headers: map[string]string{"content-type": "application/json", "content-encoding": "gzip", "content-length": strconv.Itoa(gzipped.Len())},
+			rawBody: gzipped.Bytes(),
+			want:    expected,
+		},
+		"deflate body": {
+			headers: map[string]string{"content-type": "application/json", "content-encoding": "deflate"},
+			body:    deflated.String(),
+			want:    expected,
+		},
+		"truncated compressed body": {
+			headers:   map[string]string{"content-type": "application/json", "content-encoding": "gzip", "content-length": strconv.Itoa(gzipped.Len() + 10)},
+			rawBody:   gzipped.Bytes(),
+			truncated: true,
+		},
+		"invalid compressed body": {
+			headers: map[string]string{"content-type": "application/json", "content-encoding": "gzip"},
+			body:    string(payload),
+			want:    expected,
+		},
+		"unsupported encoding": {
+			headers: map[string]string{"content-type": "application/json", "content-encoding": "identity"},
+			body:    string(payload),
+			want:    expected,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, truncated, err := getParsedBody(logging.NewNoOpLogger(), tc.headers, tc.body, tc.rawBody, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if truncated != tc.truncated {
+				t.Fatalf("expected truncated: %v, got: %v", tc.truncated, truncated)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected result: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
 func TestGetParsedBodygRPC(t *testing.T) {
 
 	requestValidExample := `{
@@ -550,6 +676,60 @@ func TestGetParsedBodygRPC(t *testing.T) {
     }
   }
 }
+`
+
+	requestGzipPayload := `{
+  "attributes": {
+    "request": {
+      "http": {
+        "headers": {
+          "content-type": "application/grpc",
+          "grpc-encoding": "gzip"
+        },
+        "method": "POST",
+        "path": "/com.book.BookService/GetBooksViaAuthor",
+        "protocol": "HTTP/2",
+        "raw_body": "AQAAABofiwgAAAAAAAID42Lxys/IAwCxvdVVBgAAAA=="
+      }
+    }
+  }
+}
+`
+
+	requestDeflatePayload := `{
+  "attributes": {
+    "request": {
+      "http": {
+        "headers": {
+          "content-type": "application/grpc",
+          "grpc-encoding": "deflate"
+        },
+        "method": "POST",
+        "path": "/com.book.BookService/GetBooksViaAuthor",
+        "protocol": "HTTP/2",
+        "raw_body": "AQAAAA54nONi8crPyAMABAkBng=="
+      }
+    }
+  }
+}
+`
+
+	requestUnsupportedEncodingPayload := `{
+  "attributes": {
+    "request": {
+      "http": {
+        "headers": {
+          "content-type": "application/grpc",
+          "grpc-encoding": "snappy"
+        },
+        "method": "POST",
+        "path": "/com.book.BookService/GetBooksViaAuthor",
+        "protocol": "HTTP/2",
+        "raw_body": "AQAAAA54nONi8crPyAMABAkBng=="
+      }
+    }
+  }
+}
 `
 
 	expectedObject := map[string]interface{}{
@@ -584,6 +764,9 @@ func TestGetParsedBodygRPC(t *testing.T) {
 		"empty_request":        {input: createCheckRequest(requestEmpty), want: map[string]interface{}{}, isBodyTruncated: false, err: nil},
 		"compressed_payload":   {input: createCheckRequest(requestCompressedPayload), want: nil, isBodyTruncated: false, err: nil},
 		"truncated_payload":    {input: createCheckRequest(requestTruncatedPayload), want: nil, isBodyTruncated: true, err: nil},
+		"gzip_payload":         {input: createCheckRequest(requestGzipPayload), want: expectedObjectExampleBook, isBodyTruncated: false, err: nil},
+		"deflate_payload":      {input: createCheckRequest(requestDeflatePayload), want: expectedObjectExampleBook, isBodyTruncated: false, err: nil},
+		"unsupported_encoding": {input: createCheckRequest(requestUnsupportedEncodingPayload), want: nil, isBodyTruncated: false, err: nil},
 	}
 
 	for name, tc := range tests {
@@ -663,3 +846,1113 @@ func TestParsedPathAndQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestToInputNetworkCheck(t *testing.T) {
+	peers := `
+		  "source": {
+			"address": {
+			  "socketAddress": {
+				"address": "10.0.0.1",
+				"portValue": 54321
+			  }
+			}
+		  },
+		  "destination": {
+			"address": {
+			  "socketAddress": {
+				"address": "10.0.0.2",
+				"portValue": 5432
+			  }
+			}
+		  }`
+
+	requestV3 := `{"attributes": {` + peers + `, "tlsSession": {"sni": "db.example.com"}}}`
+	requestV2 := `{"attributes": {` + peers + `}}`
+
+	// The socket addresses are a oneof, which only protojson knows how to decode.
+	var req ext_authz.CheckRequest
+	if err := protojson.Unmarshal([]byte(requestV3), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := RequestToInput(&req, logging.NewNoOpLogger(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"source":      map[string]interface{}{"address": "10.0.0.1", "port": 54321},
+		"destination": map[string]interface{}{"address": "10.0.0.2", "port": 5432},
+		"sni":         "db.example.com",
+	}
+
+	if !reflect.DeepEqual(input["connection"], expected) {
+		t.Fatalf("expected connection: %v, got: %v", expected, input["connection"])
+	}
+
+	for _, key := range []string{"parsed_path", "parsed_query", "parsed_body", "truncated_body"} {
+		if _, ok := input[key]; ok {
+			t.Fatalf("expected no %q for a network check", key)
+		}
+	}
+
+	var reqV2 ext_authz_v2.CheckRequest
+	if err := protojson.Unmarshal([]byte(requestV2), &reqV2); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err = RequestToInput(&reqV2, logging.NewNoOpLogger(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected["sni"] = ""
+	if !reflect.DeepEqual(input["connection"], expected) {
+		t.Fatalf("expected connection: %v, got: %v", expected, input["connection"])
+	}
+}
+
+func TestRequestToInputSNI(t *testing.T) {
+	requestV3 := `{
+		"attributes": {
+		  "source": {"principal": "spiffe://example.com/client"},
+		  "request": {"http": {"method": "GET", "path": "/", "host": "api.example.com"}},
+		  "tlsSession": {"sni": "api.example.com"}
+		}
+	  }`
+	requestV2 := `{
+		"attributes": {
+		  "request": {"http": {"method": "GET", "path": "/", "host": "api.example.com"}}
+		}
+	  }`
+
+	sni := func(input map[string]interface{}) interface{} {
+		attributes, _ := input["attributes"].(map[string]interface{})
+		source, _ := attributes["source"].(map[string]interface{})
+		tlsSession, _ := source["tls_session"].(map[string]interface{})
+		return tlsSession["sni"]
+	}
+
+	var req ext_authz.CheckRequest
+	if err := protojson.Unmarshal([]byte(requestV3), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := RequestToInput(&req, logging.NewNoOpLogger(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := "api.example.com", sni(input); exp != act {
+		t.Fatalf("expected sni %v, got %v", exp, act)
+	}
+
+	var reqV2 ext_authz_v2.CheckRequest
+	if err := protojson.Unmarshal([]byte(requestV2), &reqV2); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err = RequestToInput(&reqV2, logging.NewNoOpLogger(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := "", sni(input); exp != act {
+		t.Fatalf("expected sni %q, got %v", exp, act)
+	}
+}
+
+func TestTrustedClientAddress(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	tests := map[string]struct {
+		peer     string
+		xff      string
+		options  InputOptions
+		expected string
+	}{
+		"disabled": {
+			peer: "10.0.0.1", xff: "203.0.113.1",
+		},
+		"untrusted peer": {
+			peer: "198.51.100.1", xff: "203.0.113.1", options: InputOptions{TrustedProxies: trusted},
+			expected: "198.51.100.1",
+		},
+		"trusted proxies": {
+			peer: "10.0.0.1", xff: "192.0.2.1, 203.0.113.1, 10.1.1.1", options: InputOptions{TrustedProxies: trusted},
+			expected: "203.0.113.1",
+		},
+		"all trusted": {
+			peer: "10.0.0.1", xff: "10.2.2.2,10.1.1.1", options: InputOptions{TrustedProxies: trusted},
+			expected: "10.2.2.2",
+		},
+		"trusted ipv6 proxy": {
+			peer: "2001:db8::1", xff: "2001:db9::1", options: InputOptions{TrustedProxies: trusted},
+			expected: "2001:db9::1",
+		},
+		"invalid address": {
+			peer: "10.0.0.1", xff: "unknown", options: InputOptions{TrustedProxies: trusted},
+		},
+		"trusted hops": {
+			peer: "10.0.0.1", xff: "192.0.2.1, 203.0.113.1, 10.1.1.1", options: InputOptions{XFFNumTrustedHops: 2},
+			expected: "203.0.113.1",
+		},
+		"fewer addresses than trusted hops": {
+			peer: "10.0.0.1", xff: "192.0.2.1", options: InputOptions{XFFNumTrustedHops: 2},
+			expected: "192.0.2.1",
+		},
+		"no header": {
+			peer: "10.0.0.1", options: InputOptions{XFFNumTrustedHops: 1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, ok := trustedClientAddress(tc.peer, tc.xff, tc.options)
+			if ok != (tc.expected != "") || actual != tc.expected {
+				t.Fatalf("expected %q, got %q (%v)", tc.expected, actual, ok)
+			}
+		})
+	}
+}
+
+func TestRequestToInputTrustedClientAddress(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "source": {"address": {"socketAddress": {"address": "10.0.0.1", "portValue": 40000}}},
+		  "request": {"http": {"method": "GET", "path": "/", "headers": {"x-forwarded-for": "203.0.113.1, 10.1.1.1"}}}
+		}
+	  }`
+
+	var req ext_authz.CheckRequest
+	if err := protojson.Unmarshal([]byte(request), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := RequestToInput(&req, logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+		o.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := input["attributes"].(map[string]interface{})["source"].(map[string]interface{})["address"].(map[string]interface{})
+	if exp, act := "203.0.113.1", address["trusted"]; exp != act {
+		t.Fatalf("expected trusted address %v, got %v", exp, act)
+	}
+	if _, ok := address["socketAddress"]; !ok {
+		t.Fatalf("expected socket address to be kept, got %v", address)
+	}
+}
+
+type testSocketAddress struct {
+	address string
+	port    uint32
+}
+
+func (a testSocketAddress) GetAddress() string   { return a.address }
+func (a testSocketAddress) GetPortValue() uint32 { return a.port }
+
+func TestNormalizeSocketAddress(t *testing.T) {
+	tests := map[string]struct {
+		addr     testSocketAddress
+		expected map[string]interface{}
+	}{
+		"ipv4":             {addr: testSocketAddress{"10.0.0.1", 443}, expected: map[string]interface{}{"address": "10.0.0.1", "port": 443}},
+		"ipv6":             {addr: testSocketAddress{"0:0:0:0:0:0:0:1", 443}, expected: map[string]interface{}{"address": "::1", "port": 443}},
+		"ipv6 brackets":    {addr: testSocketAddress{"[::1]", 443}, expected: map[string]interface{}{"address": "::1", "port": 443}},
+		"ipv6 with port":   {addr: testSocketAddress{"[::1]:443", 0}, expected: map[string]interface{}{"address": "::1", "port": 443}},
+		"ipv4 with port":   {addr: testSocketAddress{"10.0.0.1:8080", 0}, expected: map[string]interface{}{"address": "10.0.0.1", "port": 8080}},
+		"ipv4-mapped ipv6": {addr: testSocketAddress{"::ffff:10.0.0.1", 80}, expected: map[string]interface{}{"address": "10.0.0.1", "port": 80}},
+		"missing port":     {addr: testSocketAddress{"2001:db8::1", 0}, expected: map[string]interface{}{"address": "2001:db8::1", "port": 0}},
+		"port value wins":  {addr: testSocketAddress{"[::1]:443", 8443}, expected: map[string]interface{}{"address": "::1", "port": 8443}},
+		"not an ip":        {addr: testSocketAddress{"/var/run/envoy.sock", 0}, expected: map[string]interface{}{"address": "/var/run/envoy.sock", "port": 0}},
+		"empty":            {addr: testSocketAddress{"", 443}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, ok := normalizeSocketAddress(tc.addr)
+			if ok != (tc.expected != nil) || !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("expected %v, got %v (%v)", tc.expected, actual, ok)
+			}
+		})
+	}
+}
+
+func TestRequestToInputNormalizedAddresses(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "source": {"address": {"socketAddress": {"address": "::ffff:10.0.0.1", "portValue": 40000}}},
+		  "destination": {"address": {"socketAddress": {"address": "[0:0:0:0:0:0:0:1]:443"}}},
+		  "request": {"http": {"method": "GET", "path": "/"}}
+		}
+	  }`
+
+	var req ext_authz.CheckRequest
+	if err := protojson.Unmarshal([]byte(request), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := RequestToInput(&req, logging.NewNoOpLogger(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attributes := input["attributes"].(map[string]interface{})
+	expected := map[string]map[string]interface{}{
+		"source":      {"address": "10.0.0.1", "port": 40000},
+		"destination": {"address": "::1", "port": 443},
+	}
+	for key, exp := range expected {
+		address := attributes[key].(map[string]interface{})["address"].(map[string]interface{})
+		if !reflect.DeepEqual(address["normalized"], exp) {
+			t.Fatalf("expected normalized %s address %v, got %v", key, exp, address["normalized"])
+		}
+		if _, ok := address["socketAddress"]; !ok {
+			t.Fatalf("expected socket address to be kept, got %v", address)
+		}
+	}
+}
+
+func TestRequestToInputDestination(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "destination": {
+			"address": {"socketAddress": {"address": "10.0.0.2", "portValue": 443}},
+			"principal": "SPIFFE://cluster.local/ns/payments/sa/api"
+		  },
+		  "request": {"http": {"method": "GET", "path": "/"}}
+		}
+	  }`
+
+	var req ext_authz.CheckRequest
+	if err := protojson.Unmarshal([]byte(request), &req); err != nil {
+		t.Fatal(err)
+	}
+	var reqV2 ext_authz_v2.CheckRequest
+	if err := protojson.Unmarshal([]byte(request), &reqV2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"address": map[string]interface{}{
+			"socketAddress": map[string]interface{}{"address": "10.0.0.2", "portValue": json.Number("443")},
+			"normalized":    map[string]interface{}{"address": "10.0.0.2", "port": 443},
+		},
+		"principal": "spiffe://cluster.local/ns/payments/sa/api",
+	}
+
+	for name, req := range map[string]interface{}{"v3": &req, "v2": &reqV2} {
+		t.Run(name, func(t *testing.T) {
+			input, err := RequestToInput(req, logging.NewNoOpLogger(), nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			destination := input["attributes"].(map[string]interface{})["destination"].(map[string]interface{})
+			if !reflect.DeepEqual(destination["principal"], expected["principal"]) {
+				t.Fatalf("expected principal %v, got %v", expected["principal"], destination["principal"])
+			}
+			address := destination["address"].(map[string]interface{})
+			for key, exp := range expected["address"].(map[string]interface{}) {
+				if !reflect.DeepEqual(address[key], exp) {
+					t.Fatalf("expected %s %v, got %v", key, exp, address[key])
+				}
+			}
+		})
+	}
+
+	input, err := RequestToInput(createCheckRequest(`{"attributes": {"request": {"http": {"path": "/"}}}}`), logging.NewNoOpLogger(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := input["attributes"].(map[string]interface{})["destination"]
+	if !reflect.DeepEqual(destination, map[string]interface{}{"principal": ""}) {
+		t.Fatalf("expected empty destination principal, got %v", destination)
+	}
+}
+
+func TestRequestToInputStripPathPrefix(t *testing.T) {
+	tests := map[string]struct {
+		path         string
+		expectedPath string
+		parsedPath   []interface{}
+	}{
+		"prefix":           {path: "/api/v1/products?limit=10", expectedPath: "/v1/products?limit=10", parsedPath: []interface{}{"v1", "products"}},
+		"prefix only":      {path: "/api", expectedPath: "/", parsedPath: []interface{}{""}},
+		"prefix and query": {path: "/api?limit=10", expectedPath: "/?limit=10", parsedPath: []interface{}{""}},
+		"partial segment":  {path: "/apis/v1", parsedPath: []interface{}{"apis", "v1"}},
+		"other prefix":     {path: "/v1/products", parsedPath: []interface{}{"v1", "products"}},
+	}
+
+	for name, tc := range tests {
+		for _, profile := range []string{InputProfileFull, InputProfileMinimal} {
+			t.Run(name+" "+profile, func(t *testing.T) {
+				request := fmt.Sprintf(`{"attributes": {"request": {"http": {"method": "GET", "path": %q}}}}`, tc.path)
+				input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+					o.Profile = profile
+					o.StripPathPrefix = "/api"
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				http := input["attributes"].(map[string]interface{})["request"].(map[string]interface{})["http"].(map[string]interface{})
+				if tc.expectedPath == "" {
+					if http["path"] != tc.path {
+						t.Fatalf("expected path %q, got %v", tc.path, http["path"])
+					}
+					if _, ok := http["original_path"]; ok {
+						t.Fatalf("expected no original path, got %v", http["original_path"])
+					}
+				} else {
+					if http["path"] != tc.expectedPath {
+						t.Fatalf("expected path %q, got %v", tc.expectedPath, http["path"])
+					}
+					if http["original_path"] != tc.path {
+						t.Fatalf("expected original path %q, got %v", tc.path, http["original_path"])
+					}
+				}
+
+				if !reflect.DeepEqual(input["parsed_path"], tc.parsedPath) {
+					t.Fatalf("expected parsed path %v, got %v", tc.parsedPath, input["parsed_path"])
+				}
+			})
+		}
+	}
+}
+
+func TestRequestToInputDefaultBodyContentType(t *testing.T) {
+	tests := map[string]struct {
+		headers            string
+		defaultContentType string
+		parsedBody         interface{}
+	}{
+		"default":               {headers: `{}`, defaultContentType: "application/json", parsedBody: map[string]interface{}{"firstname": "foo"}},
+		"empty content-type":    {headers: `{"content-type": ""}`, defaultContentType: "application/json", parsedBody: map[string]interface{}{"firstname": "foo"}},
+		"explicit content-type": {headers: `{"content-type": "text/plain"}`, defaultContentType: "application/json"},
+		"no default":            {headers: `{}`},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			request := fmt.Sprintf(`{"attributes": {"request": {"http": {"method": "POST", "path": "/", "headers": %s, "body": "{\"firstname\": \"foo\"}"}}}}`, tc.headers)
+			input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+				o.DefaultBodyContentType = tc.defaultContentType
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(input["parsed_body"], tc.parsedBody) {
+				t.Fatalf("expected parsed body %v, got %v", tc.parsedBody, input["parsed_body"])
+			}
+
+			http := input["attributes"].(map[string]interface{})["request"].(map[string]interface{})["http"].(map[string]interface{})
+			headers, _ := http["headers"].(map[string]interface{})
+			if tc.headers == `{}` && headers["content-type"] != nil {
+				t.Fatalf("expected no content-type header in the input, got %v", headers["content-type"])
+			}
+		})
+	}
+}
+
+func TestRequestToInputMultipartMetadata(t *testing.T) {
+	body := "--foo\r\nContent-Disposition: form-data; name=\"description\"\r\n\r\nhello world\r\n" +
+		"--foo\r\nContent-Disposition: form-data; name=\"file\"; filename=\"report.json\"\r\nContent-Type: application/json\r\n\r\n{\"name\": \"bar\"}\r\n" +
+		"--foo--\r\n"
+
+	tests := map[string]struct {
+		headers        map[string]string
+		body           string
+		parts          interface{}
+		truncated      bool
+		bodyParseError bool
+	}{
+		"parts": {
+			headers: map[string]string{"content-type": "multipart/form-data; boundary=foo"},
+			body:    body,
+			parts: []interface{}{
+				map[string]interface{}{"name": "description", "filename": "", "content_type": "", "size": int64(11)},
+				map[string]interface{}{"name": "file", "filename": "report.json", "content_type": "application/json", "size": int64(15)},
+			},
+		},
+		"truncated": {
+			headers:   map[string]string{"content-type": "multipart/form-data; boundary=foo", "content-length": "1000"},
+			body:      body[:40],
+			truncated: true,
+		},
+		"too many parts": {
+			headers:        map[string]string{"content-type": "multipart/form-data; boundary=foo"},
+			body:           strings.Repeat("--foo\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nb\r\n", maxMultipartParts+1) + "--foo--\r\n",
+			bodyParseError: true,
+		},
+		"malformed": {
+			headers:        map[string]string{"content-type": "multipart/form-data; boundary=foo"},
+			body:           "--foo\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nb",
+			bodyParseError: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &ext_authz.CheckRequest{Attributes: &ext_authz.AttributeContext{
+				Request: &ext_authz.AttributeContext_Request{
+					Http: &ext_authz.AttributeContext_HttpRequest{
+						Path:    "/",
+						Headers: tc.headers,
+						Body:    tc.body,
+					},
+				},
+			}}
+
+			input, err := RequestToInput(req, logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+				o.MultipartMetadata = true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(input["parsed_multipart"], tc.parts) {
+				t.Fatalf("Expected parts %v but got %v", tc.parts, input["parsed_multipart"])
+			}
+			if _, ok := input["parsed_body"]; ok {
+				t.Fatalf("Expected no parsed_body but got %v", input["parsed_body"])
+			}
+			if input["truncated_body"] != tc.truncated {
+				t.Fatalf("Expected truncated_body %v but got %v", tc.truncated, input["truncated_body"])
+			}
+			if _, ok := input["body_parse_error"]; ok != tc.bodyParseError {
+				t.Fatalf("Expected body_parse_error %v but got %v", tc.bodyParseError, input["body_parse_error"])
+			}
+		})
+	}
+
+	t.Run("not multipart", func(t *testing.T) {
+		req := &ext_authz.CheckRequest{Attributes: &ext_authz.AttributeContext{
+			Request: &ext_authz.AttributeContext_Request{
+				Http: &ext_authz.AttributeContext_HttpRequest{
+					Path:    "/",
+					Headers: map[string]string{"content-type": "application/json"},
+					Body:    `{"firstname": "foo"}`,
+				},
+			},
+		}}
+
+		input, err := RequestToInput(req, logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+			o.MultipartMetadata = true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := input["parsed_multipart"]; ok {
+			t.Fatalf("Expected no parsed_multipart but got %v", input["parsed_multipart"])
+		}
+		if !reflect.DeepEqual(input["parsed_body"], map[string]interface{}{"firstname": "foo"}) {
+			t.Fatalf("Expected parsed body but got %v", input["parsed_body"])
+		}
+	})
+}
+
+func TestRequestToInputSourceWorkload(t *testing.T) {
+	tests := map[string]struct {
+		metadata  string
+		principal string
+		fields    map[string]string
+		expected  map[string]interface{}
+	}{
+		"istio proxy metadata": {
+			metadata: `{"istio.peer": {"WORKLOAD_NAME": "reviews-v2", "NAMESPACE": "bookinfo", "LABELS": {"app": "reviews", "version": "v2"}}}`,
+			expected: map[string]interface{}{"name": "reviews-v2", "namespace": "bookinfo", "version": "v2"},
+		},
+		"canonical revision": {
+			metadata: `{"istio.peer": {"LABELS": {"version": "v2", "service.istio.io/canonical-revision": "v3"}}}`,
+			expected: map[string]interface{}{"name": "", "namespace": "", "version": "v3"},
+		},
+		"mapping": {
+			metadata: `{"envoy.filters.http.header_to_metadata": {"workload": {"name": "ratings", "ns": "prod"}}, "istio.peer": {"WORKLOAD_NAME": "reviews-v2"}}`,
+			fields:   map[string]string{"name": "envoy.filters.http.header_to_metadata/workload/name", "namespace": "envoy.filters.http.header_to_metadata/workload/ns"},
+			expected: map[string]interface{}{"name": "ratings", "namespace": "prod", "version": ""},
+		},
+		"missing mapped key": {
+			metadata: `{"istio.peer": {"WORKLOAD_NAME": "reviews-v2"}}`,
+			fields:   map[string]string{"name": "istio.peer/NAME"},
+			expected: map[string]interface{}{"name": "", "namespace": "", "version": ""},
+		},
+		"spiffe namespace": {
+			metadata:  `{}`,
+			principal: "spiffe://cluster.local/ns/bookinfo/sa/reviews",
+			expected:  map[string]interface{}{"name": "", "namespace": "bookinfo", "version": ""},
+		},
+		"non istio spiffe id": {
+			metadata:  `{}`,
+			principal: "spiffe://example.org/service/reviews",
+			expected:  map[string]interface{}{"name": "", "namespace": "", "version": ""},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			request := fmt.Sprintf(`{"attributes": {"source": {"principal": %q}, "metadata_context": {"filter_metadata": %s}, "request": {"http": {"method": "GET", "path": "/"}}}}`, tc.principal, tc.metadata)
+			input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+				o.SourceWorkload = true
+				o.SourceWorkloadFields = tc.fields
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(input["source_workload"], tc.expected) {
+				t.Fatalf("Expected source workload %v but got %v", tc.expected, input["source_workload"])
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		request := `{"attributes": {"metadata_context": {"filter_metadata": {"istio.peer": {"WORKLOAD_NAME": "reviews-v2"}}}, "request": {"http": {"method": "GET", "path": "/"}}}}`
+		input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := input["source_workload"]; ok {
+			t.Fatalf("Expected no source workload but got %v", input["source_workload"])
+		}
+	})
+}
+
+func TestRequestToInputHeaderLimits(t *testing.T) {
+	headers := map[string]string{"a": "1", "b": "22", "c": "333", "traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+
+	tests := map[string]struct {
+		maxHeaders     int
+		maxHeaderBytes int
+		truncate       bool
+		expected       map[string]interface{}
+		err            bool
+	}{
+		"within limits": {
+			maxHeaders:     4,
+			maxHeaderBytes: 1024,
+			expected:       map[string]interface{}{"a": "1", "b": "22", "c": "333", "traceparent": headers["traceparent"]},
+		},
+		"too many headers": {
+			maxHeaders: 3,
+			err:        true,
+		},
+		"too large headers": {
+			maxHeaderBytes: 64,
+			err:            true,
+		},
+		"truncated count": {
+			maxHeaders: 2,
+			truncate:   true,
+			expected:   map[string]interface{}{"a": "1", "b": "22"},
+		},
+		"truncated size": {
+			maxHeaderBytes: 7,
+			truncate:       true,
+			expected:       map[string]interface{}{"a": "1", "b": "22"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &ext_authz.CheckRequest{Attributes: &ext_authz.AttributeContext{
+				Request: &ext_authz.AttributeContext_Request{
+					Http: &ext_authz.AttributeContext_HttpRequest{Method: "GET", Path: "/", Headers: headers},
+				},
+			}}
+
+			input, err := RequestToInput(req, logging.NewNoOpLogger(), nil, false, func(o *InputOptions) {
+				o.MaxHeaders = tc.maxHeaders
+				o.MaxHeaderBytes = tc.maxHeaderBytes
+				o.TruncateHeaders = tc.truncate
+			})
+			if tc.err {
+				if !errors.Is(err, ErrHeaderLimitExceeded) {
+					t.Fatalf("Expected ErrHeaderLimitExceeded but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			http := input["attributes"].(map[string]interface{})["request"].(map[string]interface{})["http"].(map[string]interface{})
+			if !reflect.DeepEqual(http["headers"], tc.expected) {
+				t.Fatalf("Expected headers %v but got %v", tc.expected, http["headers"])
+			}
+			if input["truncated_headers"] != tc.truncate {
+				t.Fatalf("Expected truncated_headers %v but got %v", tc.truncate, input["truncated_headers"])
+			}
+			// The trace context is only read from the headers that are kept.
+			if _, ok := input["trace"]; ok == tc.truncate {
+				t.Fatalf("Unexpected trace context %v", input["trace"])
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		input, err := RequestToInput(createCheckRequest(`{"attributes": {"request": {"http": {"method": "GET", "path": "/"}}}}`), logging.NewNoOpLogger(), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := input["truncated_headers"]; ok {
+			t.Fatalf("Expected no truncated_headers but got %v", input["truncated_headers"])
+		}
+	})
+}
+
+func TestRequestToInputJSONNumberPrecision(t *testing.T) {
+	// 9007199254740993 is 2^53 + 1, which a float64 rounds to 9007199254740992.
+	tests := map[string]struct {
+		contentType string
+		body        string
+		number      func(parsedBody interface{}) interface{}
+	}{
+		"json": {
+			contentType: "application/json",
+			body:        `{"id": 9007199254740993, "max": 18446744073709551615}`,
+			number: func(parsedBody interface{}) interface{} {
+				return parsedBody.(map[string]interface{})["id"]
+			},
+		},
+		"multipart json part": {
+			contentType: "multipart/form-data; boundary=foo",
+			body:        "--foo\r\nContent-Disposition: form-data; name=\"a\"\r\nContent-Type: application/json\r\n\r\n{\"id\": 9007199254740993}\r\n--foo--\r\n",
+			number: func(parsedBody interface{}) interface{} {
+				return parsedBody.(map[string][]interface{})["a"][0].(map[string]interface{})["id"]
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &ext_authz.CheckRequest{Attributes: &ext_authz.AttributeContext{
+				Request: &ext_authz.AttributeContext_Request{
+					Http: &ext_authz.AttributeContext_HttpRequest{
+						Path:    "/",
+						Headers: map[string]string{"content-type": tc.contentType},
+						Body:    tc.body,
+					},
+				},
+			}}
+
+			input, err := RequestToInput(req, logging.NewNoOpLogger(), nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := tc.number(input["parsed_body"]); n != json.Number("9007199254740993") {
+				t.Fatalf("Expected exact number 9007199254740993 but got %#v", n)
+			}
+		})
+	}
+}
+
+func TestRequestToInputMinimalProfile(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "request": {
+			"http": {
+			  "method": "GET",
+			  "path": "/api/v1/products?limit=10",
+			  "headers": {
+				"authorization": "Bearer foo",
+				"content-type": "application/json",
+				"x-tenant": "acme"
+			  },
+			  "body": "{\"firstname\": \"foo\"}"
+			}
+		  }
+		}
+	  }`
+
+	opt := func(o *InputOptions) {
+		o.Profile = InputProfileMinimal
+		o.ProfileHeaders = []string{"x-tenant", "x-missing"}
+	}
+
+	input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, false, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"attributes": map[string]interface{}{
+			"request": map[string]interface{}{
+				"http": map[string]interface{}{
+					"method":  "GET",
+					"path":    "/api/v1/products?limit=10",
+					"headers": map[string]interface{}{"x-tenant": "acme"},
+				},
+			},
+			"source": map[string]interface{}{
+				"address": map[string]interface{}{
+					"socketAddress": map[string]interface{}{
+						"address": "",
+					},
+				},
+			},
+		},
+		"version":      v3Info,
+		"parsed_path":  []interface{}{"api", "v1", "products"},
+		"parsed_query": map[string]interface{}{"limit": []interface{}{"10"}},
+	}
+
+	if !reflect.DeepEqual(input, expected) {
+		t.Fatalf("expected input: %v, got: %v", expected, input)
+	}
+}
+
+func TestRequestToInputNodeHeader(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "request": {
+			"http": {
+			  "method": "GET",
+			  "path": "/api/v1/products",
+			  "headers": {
+				"x-envoy-cluster": "cluster-a"
+			  }
+			}
+		  }
+		}
+	  }`
+
+	tests := map[string]struct {
+		options  InputOptions
+		expected interface{}
+	}{
+		"disabled":        {options: InputOptions{}, expected: nil},
+		"full profile":    {options: InputOptions{NodeHeader: "x-envoy-cluster"}, expected: "cluster-a"},
+		"minimal profile": {options: InputOptions{Profile: InputProfileMinimal, NodeHeader: "x-envoy-cluster"}, expected: "cluster-a"},
+		"missing header":  {options: InputOptions{NodeHeader: "x-envoy-node"}, expected: nil},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opt := func(o *InputOptions) { *o = tc.options }
+			input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, true, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attributes := input["attributes"].(map[string]interface{})
+			if node := attributes["node"]; node != tc.expected {
+				t.Fatalf("expected node: %v, got: %v", tc.expected, node)
+			}
+		})
+	}
+}
+
+func TestRequestToInputRawRequest(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "request": {
+			"http": {
+			  "method": "GET",
+			  "path": "/api/v1/products",
+			  "headers": {
+				"X-Tenant": "acme"
+			  }
+			}
+		  },
+		  "context_extensions": {
+			"service": "products"
+		  }
+		}
+	  }`
+
+	tests := map[string]struct {
+		options InputOptions
+	}{
+		"full profile":    {options: InputOptions{IncludeRawRequest: true, HeaderNormalization: HeaderNormalizationCanonical}},
+		"minimal profile": {options: InputOptions{IncludeRawRequest: true, Profile: InputProfileMinimal}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opt := func(o *InputOptions) { *o = tc.options }
+			input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, true, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, ok := input["raw"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("expected raw request but got: %v", input["raw"])
+			}
+
+			attributes := raw["attributes"].(map[string]interface{})
+			headers := attributes["request"].(map[string]interface{})["http"].(map[string]interface{})["headers"].(map[string]interface{})
+			if headers["X-Tenant"] != "acme" {
+				t.Fatalf("expected headers as sent by Envoy but got: %v", headers)
+			}
+			if extensions := attributes["contextExtensions"].(map[string]interface{}); extensions["service"] != "products" {
+				t.Fatalf("expected context extensions but got: %v", extensions)
+			}
+		})
+	}
+
+	input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := input["raw"]; ok {
+		t.Fatal("expected no raw request by default")
+	}
+}
+
+func TestRequestToInputHeaderNormalization(t *testing.T) {
+	request := `{
+		"attributes": {
+		  "request": {
+			"http": {
+			  "method": "GET",
+			  "path": "/api/v1/products",
+			  "headers": {
+				"content-type": "application/json",
+				"X-Tenant": "acme",
+				"x-tenant": "globex"
+			  }
+			}
+		  }
+		}
+	  }`
+
+	original := map[string]interface{}{
+		"content-type": "application/json",
+		"X-Tenant":     "acme",
+		"x-tenant":     "globex",
+	}
+
+	tests := map[string]struct {
+		options  InputOptions
+		headers  map[string]interface{}
+		original interface{}
+	}{
+		"none": {
+			options: InputOptions{},
+			headers: original,
+		},
+		"lowercase": {
+			options: InputOptions{HeaderNormalization: HeaderNormalizationLowercase},
+			headers: map[string]interface{}{"content-type": "application/json", "x-tenant": "acme,globex"},
+		},
+		"canonical with original": {
+			options:  InputOptions{HeaderNormalization: HeaderNormalizationCanonical, PreserveOriginalHeaders: true},
+			headers:  map[string]interface{}{"Content-Type": "application/json", "X-Tenant": "acme,globex"},
+			original: original,
+		},
+		"minimal profile": {
+			options: InputOptions{Profile: InputProfileMinimal, ProfileHeaders: []string{"content-type"}, HeaderNormalization: HeaderNormalizationCanonical},
+			headers: map[string]interface{}{"Content-Type": "application/json"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opt := func(o *InputOptions) { *o = tc.options }
+			input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, true, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			http := input["attributes"].(map[string]interface{})["request"].(map[string]interface{})["http"].(map[string]interface{})
+			if !reflect.DeepEqual(http["headers"], tc.headers) {
+				t.Fatalf("expected headers: %v, got: %v", tc.headers, http["headers"])
+			}
+			if tc.original == nil {
+				if _, ok := http["headers_original"]; ok {
+					t.Fatalf("expected no headers_original, got: %v", http["headers_original"])
+				}
+			} else if !reflect.DeepEqual(http["headers_original"], tc.original) {
+				t.Fatalf("expected headers_original: %v, got: %v", tc.original, http["headers_original"])
+			}
+		})
+	}
+}
+
+func TestGetTraceContext(t *testing.T) {
+	tests := map[string]struct {
+		headers map[string]string
+		want    map[string]interface{}
+	}{
+		"none": {
+			headers: map[string]string{"accept": "*/*"},
+			want:    nil,
+		},
+		"traceparent": {
+			headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			want: map[string]interface{}{
+				"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"span_id":  "00f067aa0ba902b7",
+				"sampled":  true,
+			},
+		},
+		"invalid traceparent with request id": {
+			headers: map[string]string{"traceparent": "foo", "x-request-id": "92a6c0f7-0250-944b-9cfc-ae10cbcedd8e"},
+			want:    map[string]interface{}{"request_id": "92a6c0f7-0250-944b-9cfc-ae10cbcedd8e"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := getTraceContext(tc.headers)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected trace context: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetBaggage(t *testing.T) {
+	tests := map[string]struct {
+		headers map[string]string
+		want    map[string]interface{}
+	}{
+		"none": {
+			headers: map[string]string{"accept": "*/*"},
+			want:    nil,
+		},
+		"members": {
+			headers: map[string]string{"baggage": "tenant=acme,experiment=new%20checkout;ttl=60"},
+			want:    map[string]interface{}{"tenant": "acme", "experiment": "new checkout"},
+		},
+		"invalid": {
+			headers: map[string]string{"baggage": "tenant"},
+			want:    nil,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := getBaggage(tc.headers)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected baggage: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetParsedJWT(t *testing.T) {
+	segment := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	token := segment(`{"alg":"HS256","typ":"JWT"}`) + "." + segment(`{"sub":"alice","iat":1516239022}`) + ".c2lnbmF0dXJl"
+	parsed := map[string]interface{}{
+		"header":  map[string]interface{}{"alg": "HS256", "typ": "JWT"},
+		"payload": map[string]interface{}{"sub": "alice", "iat": json.Number("1516239022")},
+	}
+
+	tests := map[string]struct {
+		headers map[string]string
+		header  string
+		want    map[string]interface{}
+	}{
+		"bearer": {
+			headers: map[string]string{"authorization": "Bearer " + token},
+			header:  "authorization",
+			want:    parsed,
+		},
+		"other header": {
+			headers: map[string]string{"x-jwt-assertion": token},
+			header:  "x-jwt-assertion",
+			want:    parsed,
+		},
+		"missing": {
+			headers: map[string]string{"accept": "*/*"},
+			header:  "authorization",
+		},
+		"opaque token": {
+			headers: map[string]string{"authorization": "Bearer 8xLOxBtZp8"},
+			header:  "authorization",
+		},
+		"invalid payload": {
+			headers: map[string]string{"authorization": "Bearer " + segment(`{"alg":"none"}`) + ".e30K!.sig"},
+			header:  "authorization",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := getParsedJWT(tc.headers, tc.header)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected parsed JWT: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetSPIFFEID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spiffeURI, err := url.Parse("spiffe://Example.ORG/ns/default/sa/web/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "web"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{spiffeURI},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+
+	tests := map[string]struct {
+		principal   string
+		certificate string
+		want        string
+		found       bool
+	}{
+		"principal":             {principal: "SPIFFE://cluster.local/ns/default/sa/web", want: "spiffe://cluster.local/ns/default/sa/web", found: true},
+		"certificate":           {principal: "CN=web", certificate: certificate, want: "spiffe://example.org/ns/default/sa/web", found: true},
+		"no spiffe id":          {principal: "CN=web"},
+		"malformed certificate": {certificate: "foo"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, found := getSPIFFEID(logging.NewNoOpLogger(), tc.principal, tc.certificate)
+			if got != tc.want || found != tc.found {
+				t.Fatalf("expected %q (%v), got %q (%v)", tc.want, tc.found, got, found)
+			}
+		})
+	}
+
+	request := fmt.Sprintf(`{
+		"attributes": {
+		  "source": {
+			"principal": "CN=web",
+			"certificate": %q
+		  },
+		  "request": {
+			"http": {
+			  "path": "/"
+			}
+		  }
+		}
+	  }`, certificate)
+
+	input, err := RequestToInput(createCheckRequest(request), logging.NewNoOpLogger(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal := input["attributes"].(map[string]interface{})["source"].(map[string]interface{})["principal"]
+	if principal != "spiffe://example.org/ns/default/sa/web" {
+		t.Fatalf("expected normalized SPIFFE ID principal, got %v", principal)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	ext_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	ext_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
@@ -12,7 +15,9 @@ import (
 	"github.com/open-policy-agent/opa-envoy-plugin/internal/util"
 	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/topdown/builtins"
+	"golang.org/x/net/http/httpguts"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -26,6 +31,20 @@ type EvalResult struct {
 	Metrics        metrics.Metrics
 	Txn            storage.Transaction
 	NDBuiltinCache builtins.NDBCache
+	Undefined      bool // The query produced no result and Decision was set by the caller.
+
+	// CountExpressions makes Eval count the expressions evaluated in the
+	// ExpressionsEvaluatedCounter metric. It traces the evaluation, which
+	// slows it down.
+	CountExpressions bool
+
+	// ResponseHeaderAppendAction is the append action of the
+	// response_headers_to_add without one in response_headers_to_add_actions.
+	// It defaults to APPEND_IF_EXISTS_OR_ADD, which is Envoy's default.
+	ResponseHeaderAppendAction ext_core_v3.HeaderValueOption_HeaderAppendAction
+
+	// Tracer, if set, traces the evaluation, e.g. to explain the decision.
+	Tracer *topdown.BufferTracer
 }
 
 // StopFunc should be called as soon as the evaluation is finished
@@ -151,7 +170,8 @@ func (result *EvalResult) GetRequestHTTPHeadersToRemove() ([]string, error) {
 	return nil, result.invalidDecisionErr()
 }
 
-// GetResponseHTTPHeaders - returns the http headers to return if they are part of the decision
+// GetResponseHTTPHeaders - returns the http headers of the "headers" key of the decision. They are sent to the
+// upstream with an allowed request (see GetUpstreamHeaders) and to the client with a denied one.
 func (result *EvalResult) GetResponseHTTPHeaders() (http.Header, error) {
 	var responseHeaders = make(http.Header)
 
@@ -177,7 +197,7 @@ func (result *EvalResult) GetResponseHTTPHeaders() (http.Header, error) {
 	return nil, result.invalidDecisionErr()
 }
 
-// GetResponseEnvoyHeaderValueOptions - returns the http headers to return if they are part of the decision as envoy header value options
+// GetResponseEnvoyHeaderValueOptions - returns the http headers of GetResponseHTTPHeaders as envoy header value options
 func (result *EvalResult) GetResponseEnvoyHeaderValueOptions() ([]*ext_core_v3.HeaderValueOption, error) {
 	headers, err := result.GetResponseHTTPHeaders()
 	if err != nil {
@@ -187,7 +207,94 @@ func (result *EvalResult) GetResponseEnvoyHeaderValueOptions() ([]*ext_core_v3.H
 	return transformHTTPHeaderToEnvoyHeaderValueOption(headers)
 }
 
-// GetResponseHTTPHeadersToAdd - returns the http headers to send to the downstream client
+// GetUpstreamHeaders - returns the headers that Envoy adds to an allowed request before forwarding it to the
+// upstream, i.e. OkHttpResponse.Headers. They are set by the "headers" key of the decision, and removed with
+// "request_headers_to_remove". The client never sees them, unless the upstream echoes them.
+func (result *EvalResult) GetUpstreamHeaders() ([]*ext_core_v3.HeaderValueOption, error) {
+	return result.GetResponseEnvoyHeaderValueOptions()
+}
+
+// GetClientResponseHeaders - returns the headers that Envoy adds to the response of the upstream to an allowed
+// request before sending it to the client, i.e. OkHttpResponse.ResponseHeadersToAdd. They are set by the
+// "response_headers_to_add" key of the decision, with the append actions of "response_headers_to_add_actions".
+// The upstream never sees them.
+func (result *EvalResult) GetClientResponseHeaders() ([]*ext_core_v3.HeaderValueOption, error) {
+	return result.GetResponseHTTPHeadersToAdd()
+}
+
+// GetQueryParametersToSet - returns the query parameters to set on the original request before dispatching
+// it to the upstream
+func (result *EvalResult) GetQueryParametersToSet() ([]*ext_core_v3.QueryParameter, error) {
+	params := []*ext_core_v3.QueryParameter{}
+
+	switch decision := result.Decision.(type) {
+	case bool:
+		return params, nil
+	case map[string]interface{}:
+		val, ok := decision["query_parameters_to_set"]
+		if !ok {
+			return params, nil
+		}
+
+		object, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("type assertion error, expected query_parameters_to_set to be of type 'object' but got '%T'", val)
+		}
+
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value, ok := object[key].(string)
+			if !ok {
+				return nil, fmt.Errorf("type assertion error, expected query_parameters_to_set value to be of type 'string' but got '%T'", object[key])
+			}
+			params = append(params, &ext_core_v3.QueryParameter{Key: key, Value: value})
+		}
+		return params, nil
+	}
+
+	return nil, result.invalidDecisionErr()
+}
+
+// GetQueryParametersToRemove - returns the query parameters to remove from the original request before
+// dispatching it to the upstream
+func (result *EvalResult) GetQueryParametersToRemove() ([]string, error) {
+	params := []string{}
+
+	switch decision := result.Decision.(type) {
+	case bool:
+		return params, nil
+	case map[string]interface{}:
+		val, ok := decision["query_parameters_to_remove"]
+		if !ok {
+			return params, nil
+		}
+
+		switch val := val.(type) {
+		case []string:
+			return val, nil
+		case []interface{}:
+			for _, vval := range val {
+				param, ok := vval.(string)
+				if !ok {
+					return nil, fmt.Errorf("type assertion error, expected query_parameters_to_remove value to be of type 'string' but got '%T'", vval)
+				}
+				params = append(params, param)
+			}
+			return params, nil
+		default:
+			return nil, fmt.Errorf("type assertion error, expected query_parameters_to_remove to be of type '[]string' but got '%T'", val)
+		}
+	}
+
+	return nil, result.invalidDecisionErr()
+}
+
+// GetResponseHTTPHeadersToAdd - returns the http headers to send to the downstream client, see GetClientResponseHeaders
 func (result *EvalResult) GetResponseHTTPHeadersToAdd() ([]*ext_core_v3.HeaderValueOption, error) {
 	var responseHeaders = make(http.Header)
 
@@ -208,11 +315,67 @@ func (result *EvalResult) GetResponseHTTPHeadersToAdd() ([]*ext_core_v3.HeaderVa
 		if err != nil {
 			return nil, err
 		}
-	default:
-		return nil, result.invalidDecisionErr()
+
+		actions, err := getHeaderAppendActions(decision, "response_headers_to_add_actions")
+		if err != nil {
+			return nil, err
+		}
+
+		finalHeaders, err = transformHTTPHeaderToEnvoyHeaderValueOption(responseHeaders)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool, len(finalHeaders))
+		for _, option := range finalHeaders {
+			key := option.GetHeader().GetKey()
+			option.AppendAction = result.ResponseHeaderAppendAction
+			if action, ok := actions[key]; ok {
+				option.AppendAction = action
+			}
+			// Each value is a separate option. Overwriting with the values
+			// after the first one would only keep the last value, e.g. of
+			// several Set-Cookie headers, so they are appended instead.
+			if seen[key] && option.AppendAction == ext_core_v3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD {
+				option.AppendAction = ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+			}
+			seen[key] = true
+		}
+		return finalHeaders, nil
+	}
+
+	return nil, result.invalidDecisionErr()
+}
+
+// getHeaderAppendActions returns the append actions, keyed by canonical header
+// name, of the object at key in the decision. The actions are the names of the
+// Envoy HeaderValueOption.HeaderAppendAction enum, in any case, e.g.
+// "OVERWRITE_IF_EXISTS_OR_ADD". Headers without an action are appended, which
+// is Envoy's default.
+func getHeaderAppendActions(decision map[string]interface{}, key string) (map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction, error) {
+	val, ok := decision[key]
+	if !ok {
+		return nil, nil
+	}
+
+	object, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("type assertion error, expected %s to be of type 'object' but got '%T'", key, val)
 	}
 
-	return transformHTTPHeaderToEnvoyHeaderValueOption(responseHeaders)
+	actions := make(map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction, len(object))
+	for header, v := range object {
+		name, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("type assertion error, expected %s value to be of type 'string' but got '%T'", key, v)
+		}
+		action, ok := ext_core_v3.HeaderValueOption_HeaderAppendAction_value[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid %s value for header '%s': %q", key, header, name)
+		}
+		actions[http.CanonicalHeaderKey(header)] = ext_core_v3.HeaderValueOption_HeaderAppendAction(action)
+	}
+	return actions, nil
 }
 
 // HasResponseBody returns true if the decision defines a body (only true for structured decisions)
@@ -250,6 +413,168 @@ func (result *EvalResult) GetResponseBody() (string, error) {
 	return body, nil
 }
 
+// GetResponseBodyBytes returns the http body to return if it is part of the decision. The body is either
+// a string, which is returned as is, or an object or array, which is serialized to JSON. The boolean
+// return value reports whether the body was serialized to JSON.
+func (result *EvalResult) GetResponseBodyBytes() ([]byte, bool, error) {
+	var ok bool
+	var val interface{}
+	var decision map[string]interface{}
+
+	if decision, ok = result.Decision.(map[string]interface{}); !ok {
+		return nil, false, nil
+	}
+
+	if val, ok = decision["body"]; !ok {
+		return nil, false, nil
+	}
+
+	switch body := val.(type) {
+	case string:
+		return []byte(body), false, nil
+	case map[string]interface{}, []interface{}:
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to serialize body to JSON: %w", err)
+		}
+		return bs, true, nil
+	}
+
+	return nil, false, fmt.Errorf("type assertion error, expected body to be of type 'string', 'object' or 'array' but got '%T'", val)
+}
+
+// GetResponseRedirect returns the location to redirect the client to if it is part of the decision.
+// Unless the decision defines a http_status, redirects use the 302 (Found) status code.
+func (result *EvalResult) GetResponseRedirect() (string, error) {
+	var ok bool
+	var val interface{}
+	var location string
+	var decision map[string]interface{}
+
+	if decision, ok = result.Decision.(map[string]interface{}); !ok {
+		return "", nil
+	}
+
+	if val, ok = decision["redirect"]; !ok {
+		return "", nil
+	}
+
+	if location, ok = val.(string); !ok {
+		return "", fmt.Errorf("type assertion error, expected redirect to be of type 'string' but got '%T'", val)
+	}
+
+	return location, nil
+}
+
+// GetResponseChallenges returns the WWW-Authenticate header values of the
+// "challenge" of the decision, an object or an array of objects with the
+// "scheme" of the challenge and its parameters, e.g. {"scheme": "Bearer",
+// "realm": "api", "error": "invalid_token"} is rendered as
+// `Bearer realm="api", error="invalid_token"`. The realm comes first, the
+// other parameters are sorted.
+func (result *EvalResult) GetResponseChallenges() ([]string, error) {
+	decision, ok := result.Decision.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	val, ok := decision["challenge"]
+	if !ok {
+		return nil, nil
+	}
+
+	var challenges []interface{}
+	switch val := val.(type) {
+	case map[string]interface{}:
+		challenges = []interface{}{val}
+	case []interface{}:
+		challenges = val
+	default:
+		return nil, fmt.Errorf("type assertion error, expected challenge to be of type 'object' or 'array' but got '%T'", val)
+	}
+
+	values := make([]string, 0, len(challenges))
+	for _, c := range challenges {
+		challenge, ok := c.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("type assertion error, expected challenge to be of type 'object' but got '%T'", c)
+		}
+		value, err := renderChallenge(challenge)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func renderChallenge(challenge map[string]interface{}) (string, error) {
+	scheme, ok := challenge["scheme"].(string)
+	if !ok || !httpguts.ValidHeaderFieldName(scheme) {
+		return "", fmt.Errorf("invalid challenge, expected scheme to be a token but got '%v'", challenge["scheme"])
+	}
+
+	names := make([]string, 0, len(challenge))
+	for name := range challenge {
+		if name != "scheme" {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == "realm" || names[j] == "realm" {
+			return names[i] == "realm"
+		}
+		return names[i] < names[j]
+	})
+
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return "", fmt.Errorf("invalid challenge parameter name %q", name)
+		}
+		value, ok := challenge[name].(string)
+		if !ok {
+			return "", fmt.Errorf("type assertion error, expected challenge parameter %q to be of type 'string' but got '%T'", name, challenge[name])
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return "", fmt.Errorf("invalid challenge parameter %q value %q", name, value)
+		}
+		params = append(params, name+"="+quoteString(value))
+	}
+
+	if len(params) == 0 {
+		return scheme, nil
+	}
+	return scheme + " " + strings.Join(params, ", "), nil
+}
+
+// quoteString returns s as an HTTP quoted-string.
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// GetReason returns the "reason" of the decision, e.g. why the request was
+// denied, and an empty string if there is none.
+func (result *EvalResult) GetReason() (string, error) {
+	decision, ok := result.Decision.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	val, ok := decision["reason"]
+	if !ok {
+		return "", nil
+	}
+
+	reason, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("type assertion error, expected reason to be of type 'string' but got '%T'", val)
+	}
+
+	return reason, nil
+}
+
 // GetResponseHTTPStatus returns the http status to return if they are part of the decision
 func (result *EvalResult) GetResponseHTTPStatus() (int, error) {
 	var ok bool
@@ -267,6 +592,12 @@ func (result *EvalResult) GetResponseHTTPStatus() (int, error) {
 		return status, nil
 	case map[string]interface{}:
 		if val, ok = decision["http_status"]; !ok {
+			if _, ok = decision["redirect"]; ok {
+				return http.StatusFound, nil
+			}
+			if _, ok = decision["challenge"]; ok {
+				return http.StatusUnauthorized, nil
+			}
 			return status, nil
 		}
 
@@ -316,6 +647,53 @@ func (result *EvalResult) GetDynamicMetadata() (*_structpb.Struct, error) {
 	return nil, nil
 }
 
+// GetCacheTTL returns the "cache_ttl" of the decision, for how long the
+// decision may be reused for identical requests, and false if there is none.
+func (result *EvalResult) GetCacheTTL() (time.Duration, bool, error) {
+	decision, ok := result.Decision.(map[string]interface{})
+	if !ok {
+		return 0, false, nil
+	}
+
+	val, ok := decision["cache_ttl"]
+	if !ok {
+		return 0, false, nil
+	}
+
+	ttl, err := ParseCacheTTL(val)
+	if err != nil {
+		return 0, false, err
+	}
+	return ttl, true, nil
+}
+
+// ParseCacheTTL parses the cache_ttl of a decision, either a number of seconds
+// or a duration string such as "30s". It must not be negative.
+func ParseCacheTTL(val interface{}) (time.Duration, error) {
+	var ttl time.Duration
+	switch val := val.(type) {
+	case json.Number:
+		seconds, err := val.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("error converting JSON number to float: %v", err)
+		}
+		ttl = time.Duration(seconds * float64(time.Second))
+	case string:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cache_ttl: %v", err)
+		}
+		ttl = d
+	default:
+		return 0, fmt.Errorf("type assertion error, expected cache_ttl to be of type 'number' or 'string' but got '%T'", val)
+	}
+
+	if ttl < 0 {
+		return 0, fmt.Errorf("invalid cache_ttl: %v must not be negative", ttl)
+	}
+	return ttl, nil
+}
+
 // GetResponseEnvoyHTTPStatus returns the http status to return if they are part of the decision
 func (result *EvalResult) GetResponseEnvoyHTTPStatus() (*ext_type_v3.HttpStatus, error) {
 	status := &ext_type_v3.HttpStatus{
@@ -328,7 +706,8 @@ func (result *EvalResult) GetResponseEnvoyHTTPStatus() (*ext_type_v3.HttpStatus,
 		return nil, err
 	}
 
-	//This check is partially redundant but might be more strict than http.StatusText()
+	// Any code defined by Envoy is passed through as is. Envoy rejects
+	// responses with a status outside its StatusCode enum, so report those here.
 	if _, ok := ext_type_v3.StatusCode_name[int32(httpStatusCode)]; !ok {
 		return nil, fmt.Errorf("Invalid HTTP status code %v", httpStatusCode)
 	}
@@ -0,0 +1,81 @@
+package envoyauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ResponseToInput builds the input of the response-path query from the
+// attributes of an upstream response:
+//
+//	{
+//	  "request": {...},
+//	  "response": {"status_code": 200, "headers": {"content-type": "..."}}
+//	}
+//
+// "request" is optional and passed through as is, e.g. the input the request
+// was checked with. Header names are lowercased like those of the request.
+func ResponseToInput(attributes map[string]interface{}) (map[string]interface{}, error) {
+	resp, ok := attributes["response"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("missing or invalid \"response\" object")
+	}
+
+	statusCode, err := responseStatusCode(resp["status_code"])
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]interface{}{}
+	if h, ok := resp["headers"]; ok && h != nil {
+		object, ok := h.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("type assertion error, expected response headers to be of type 'object' but got '%T'", h)
+		}
+		for k, v := range object {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("type assertion error, expected response header %q to be of type 'string' but got '%T'", k, v)
+			}
+			headers[strings.ToLower(k)] = s
+		}
+	}
+
+	input := map[string]interface{}{
+		"response": map[string]interface{}{
+			"status_code": statusCode,
+			"headers":     headers,
+		},
+	}
+	if req, ok := attributes["request"]; ok && req != nil {
+		input["request"] = req
+	}
+	return input, nil
+}
+
+func responseStatusCode(v interface{}) (int, error) {
+	var code int
+	switch v := v.(type) {
+	case float64:
+		code = int(v)
+		if float64(code) != v {
+			return 0, fmt.Errorf("invalid response status_code %v", v)
+		}
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("invalid response status_code %v", v)
+		}
+		code = int(n)
+	case nil:
+		return 0, fmt.Errorf("missing response status_code")
+	default:
+		return 0, fmt.Errorf("type assertion error, expected response status_code to be of type 'number' but got '%T'", v)
+	}
+
+	if code < 100 || code > 599 {
+		return 0, fmt.Errorf("invalid response status_code %d", code)
+	}
+	return code, nil
+}
@@ -0,0 +1,78 @@
+package envoyauth
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResponseToInput(t *testing.T) {
+	tests := map[string]struct {
+		attributes string
+		expected   map[string]interface{}
+		wantErr    bool
+	}{
+		"response only": {
+			attributes: `{"response": {"status_code": 200, "headers": {"Content-Type": "text/plain"}}}`,
+			expected: map[string]interface{}{
+				"response": map[string]interface{}{
+					"status_code": 200,
+					"headers":     map[string]interface{}{"content-type": "text/plain"},
+				},
+			},
+		},
+		"with request": {
+			attributes: `{"request": {"path": "/foo"}, "response": {"status_code": 404}}`,
+			expected: map[string]interface{}{
+				"request": map[string]interface{}{"path": "/foo"},
+				"response": map[string]interface{}{
+					"status_code": 404,
+					"headers":     map[string]interface{}{},
+				},
+			},
+		},
+		"missing response": {
+			attributes: `{"request": {}}`,
+			wantErr:    true,
+		},
+		"missing status code": {
+			attributes: `{"response": {}}`,
+			wantErr:    true,
+		},
+		"status code out of range": {
+			attributes: `{"response": {"status_code": 99}}`,
+			wantErr:    true,
+		},
+		"fractional status code": {
+			attributes: `{"response": {"status_code": 200.5}}`,
+			wantErr:    true,
+		},
+		"non-string header": {
+			attributes: `{"response": {"status_code": 200, "headers": {"x": 1}}}`,
+			wantErr:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var attributes map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.attributes), &attributes); err != nil {
+				t.Fatal(err)
+			}
+
+			input, err := ResponseToInput(attributes)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error but got %v", input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(input, tc.expected) {
+				t.Fatalf("Expected %v but got %v", tc.expected, input)
+			}
+		})
+	}
+}
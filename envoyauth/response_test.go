@@ -2,10 +2,13 @@ package envoyauth
 
 import (
 	"encoding/json"
+	"net/http"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	ext_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	_structpb "github.com/golang/protobuf/ptypes/struct"
 	"google.golang.org/protobuf/proto"
 )
@@ -129,6 +132,252 @@ func TestGetRequestHTTPHeadersToRemove(t *testing.T) {
 	})
 }
 
+func TestGetQueryParametersToSet(t *testing.T) {
+	tests := map[string]struct {
+		decision interface{}
+		exp      []*ext_core_v3.QueryParameter
+		wantErr  bool
+	}{
+		"bool_eval_result": {
+			true,
+			[]*ext_core_v3.QueryParameter{},
+			false,
+		},
+		"invalid_eval_result": {
+			"hello",
+			nil,
+			true,
+		},
+		"empty_map_result": {
+			map[string]interface{}{},
+			[]*ext_core_v3.QueryParameter{},
+			false,
+		},
+		"bad_params_value": {
+			map[string]interface{}{"query_parameters_to_set": []interface{}{"foo"}},
+			nil,
+			true,
+		},
+		"bad_param_value": {
+			map[string]interface{}{"query_parameters_to_set": map[string]interface{}{"foo": 1}},
+			nil,
+			true,
+		},
+		"sorted_params": {
+			map[string]interface{}{"query_parameters_to_set": map[string]interface{}{"foo": "bar", "baz": "qux"}},
+			[]*ext_core_v3.QueryParameter{{Key: "baz", Value: "qux"}, {Key: "foo", Value: "bar"}},
+			false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			er := EvalResult{
+				Decision: tc.decision,
+			}
+
+			result, err := er.GetQueryParametersToSet()
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got nil")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+
+				if !reflect.DeepEqual(tc.exp, result) {
+					t.Fatalf("Expected result %v but got %v", tc.exp, result)
+				}
+			}
+		})
+	}
+}
+
+func TestGetQueryParametersToRemove(t *testing.T) {
+	tests := map[string]struct {
+		decision interface{}
+		exp      []string
+		wantErr  bool
+	}{
+		"bool_eval_result": {
+			true,
+			[]string{},
+			false,
+		},
+		"invalid_eval_result": {
+			"hello",
+			nil,
+			true,
+		},
+		"empty_map_result": {
+			map[string]interface{}{},
+			[]string{},
+			false,
+		},
+		"bad_params_value": {
+			map[string]interface{}{"query_parameters_to_remove": "foo"},
+			nil,
+			true,
+		},
+		"interface_array_params_value": {
+			map[string]interface{}{"query_parameters_to_remove": []interface{}{"foo", "bar"}},
+			[]string{"foo", "bar"},
+			false,
+		},
+		"interface_array_bad_param_value": {
+			map[string]interface{}{"query_parameters_to_remove": []interface{}{1}},
+			nil,
+			true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			er := EvalResult{
+				Decision: tc.decision,
+			}
+
+			result, err := er.GetQueryParametersToRemove()
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got nil")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+
+				if !reflect.DeepEqual(tc.exp, result) {
+					t.Fatalf("Expected result %v but got %v", tc.exp, result)
+				}
+			}
+		})
+	}
+}
+
+func TestGetResponseHTTPHeadersToAddActions(t *testing.T) {
+	tests := map[string]struct {
+		decision      map[string]interface{}
+		defaultAction ext_core_v3.HeaderValueOption_HeaderAppendAction
+		expected      map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction
+		err           bool
+	}{
+		"default": {
+			decision: map[string]interface{}{
+				"response_headers_to_add": map[string]interface{}{"x-foo": "bar"},
+			},
+			expected: map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction{
+				"X-Foo": ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+			},
+		},
+		"actions": {
+			decision: map[string]interface{}{
+				"response_headers_to_add": map[string]interface{}{"x-foo": "bar", "x-bar": "baz", "x-baz": "qux"},
+				"response_headers_to_add_actions": map[string]interface{}{
+					"x-foo": "OVERWRITE_IF_EXISTS_OR_ADD",
+					"X-Bar": "add_if_absent",
+				},
+			},
+			expected: map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction{
+				"X-Foo": ext_core_v3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+				"X-Bar": ext_core_v3.HeaderValueOption_ADD_IF_ABSENT,
+				"X-Baz": ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+			},
+		},
+		"default action": {
+			decision: map[string]interface{}{
+				"response_headers_to_add":         map[string]interface{}{"x-foo": "bar", "x-bar": "baz"},
+				"response_headers_to_add_actions": map[string]interface{}{"x-bar": "APPEND_IF_EXISTS_OR_ADD"},
+			},
+			defaultAction: ext_core_v3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+			expected: map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction{
+				"X-Foo": ext_core_v3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+				"X-Bar": ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+			},
+		},
+		"invalid action": {
+			decision: map[string]interface{}{
+				"response_headers_to_add":         map[string]interface{}{"x-foo": "bar"},
+				"response_headers_to_add_actions": map[string]interface{}{"x-foo": "replace"},
+			},
+			err: true,
+		},
+		"invalid actions": {
+			decision: map[string]interface{}{
+				"response_headers_to_add":         map[string]interface{}{"x-foo": "bar"},
+				"response_headers_to_add_actions": "OVERWRITE_IF_EXISTS",
+			},
+			err: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			er := EvalResult{Decision: tc.decision, ResponseHeaderAppendAction: tc.defaultAction}
+			result, err := er.GetResponseHTTPHeadersToAdd()
+			if tc.err {
+				if err == nil {
+					t.Fatal("Expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction{}
+			for _, option := range result {
+				actual[option.GetHeader().GetKey()] = option.GetAppendAction()
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("Expected append actions %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestGetResponseHTTPHeadersToAddSetCookie(t *testing.T) {
+	for name, action := range map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction{
+		"append":    ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+		"overwrite": ext_core_v3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	} {
+		t.Run(name, func(t *testing.T) {
+			er := EvalResult{
+				Decision: map[string]interface{}{
+					"allowed": true,
+					"response_headers_to_add": []interface{}{
+						map[string]interface{}{"set-cookie": "session=abc; HttpOnly"},
+						map[string]interface{}{"Set-Cookie": "csrf=def; Secure"},
+					},
+				},
+				ResponseHeaderAppendAction: action,
+			}
+
+			result, err := er.GetResponseHTTPHeadersToAdd()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(result) != 2 {
+				t.Fatalf("Expected two headers but got %v", result)
+			}
+			for i, value := range []string{"session=abc; HttpOnly", "csrf=def; Secure"} {
+				if result[i].GetHeader().GetKey() != "Set-Cookie" || result[i].GetHeader().GetValue() != value {
+					t.Fatalf("Expected Set-Cookie %q but got %v", value, result[i].GetHeader())
+				}
+			}
+			// The first cookie may overwrite those of the upstream, the second
+			// one must not overwrite the first one.
+			if result[0].GetAppendAction() != action || result[1].GetAppendAction() != ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD {
+				t.Fatalf("Unexpected append actions %v and %v", result[0].GetAppendAction(), result[1].GetAppendAction())
+			}
+		})
+	}
+}
+
 func TestGetResponseHTTPHeadersToAdd(t *testing.T) {
 	input := make(map[string]interface{})
 	er := EvalResult{
@@ -289,6 +538,40 @@ func TestGetResponseHeaders(t *testing.T) {
 	}
 }
 
+func TestGetUpstreamAndClientResponseHeaders(t *testing.T) {
+	er := EvalResult{
+		Decision: map[string]interface{}{
+			"allowed":                 true,
+			"headers":                 map[string]interface{}{"x-upstream": "to-upstream"},
+			"response_headers_to_add": map[string]interface{}{"x-client": "to-client"},
+		},
+	}
+
+	upstream, err := er.GetUpstreamHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstream) != 1 || upstream[0].GetHeader().GetKey() != "X-Upstream" || upstream[0].GetHeader().GetValue() != "to-upstream" {
+		t.Fatalf("Expected the headers key only in the upstream headers but got %v", upstream)
+	}
+
+	client, err := er.GetClientResponseHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client) != 1 || client[0].GetHeader().GetKey() != "X-Client" || client[0].GetHeader().GetValue() != "to-client" {
+		t.Fatalf("Expected the response_headers_to_add key only in the client response headers but got %v", client)
+	}
+
+	er.Decision = true
+	if upstream, err = er.GetUpstreamHeaders(); err != nil || len(upstream) != 0 {
+		t.Fatalf("Expected no upstream headers for a boolean decision but got %v, %v", upstream, err)
+	}
+	if client, err = er.GetClientResponseHeaders(); err != nil || len(client) != 0 {
+		t.Fatalf("Expected no client response headers for a boolean decision but got %v, %v", client, err)
+	}
+}
+
 func TestGetResponseBody(t *testing.T) {
 	input := make(map[string]interface{})
 	er := EvalResult{
@@ -325,6 +608,222 @@ func TestGetResponseBody(t *testing.T) {
 	}
 }
 
+func TestGetResponseBodyBytes(t *testing.T) {
+	tests := map[string]struct {
+		decision interface{}
+		want     string
+		isJSON   bool
+		wantErr  bool
+	}{
+		"boolean decision": {decision: false},
+		"no body":          {decision: map[string]interface{}{}},
+		"string body":      {decision: map[string]interface{}{"body": "hello"}, want: "hello"},
+		"object body": {
+			decision: map[string]interface{}{"body": map[string]interface{}{"code": json.Number("42"), "message": "denied"}},
+			want:     `{"code":42,"message":"denied"}`,
+			isJSON:   true,
+		},
+		"array body":  {decision: map[string]interface{}{"body": []interface{}{"a", "b"}}, want: `["a","b"]`, isJSON: true},
+		"number body": {decision: map[string]interface{}{"body": json.Number("1")}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			er := EvalResult{Decision: tc.decision}
+			body, isJSON, err := er.GetResponseBodyBytes()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if string(body) != tc.want || isJSON != tc.isJSON {
+				t.Fatalf("Expected body %q (json: %v) but got %q (json: %v)", tc.want, tc.isJSON, body, isJSON)
+			}
+		})
+	}
+}
+
+func TestGetResponseRedirect(t *testing.T) {
+	input := make(map[string]interface{})
+	er := EvalResult{
+		Decision: input,
+	}
+
+	result, err := er.GetResponseRedirect()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if result != "" {
+		t.Fatalf("Expected empty redirect but got %v", result)
+	}
+
+	input["redirect"] = "https://login.example.com"
+	result, err = er.GetResponseRedirect()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if result != "https://login.example.com" {
+		t.Fatalf("Expected result \"https://login.example.com\" but got %v", result)
+	}
+
+	status, err := er.GetResponseHTTPStatus()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if status != http.StatusFound {
+		t.Fatalf("Expected http status %v but got %v", http.StatusFound, status)
+	}
+
+	input["redirect"] = 123
+	_, err = er.GetResponseRedirect()
+	if err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "but got 'int'") {
+		t.Fatalf("Assertion error type reflection failed")
+	}
+}
+
+func TestGetResponseChallenges(t *testing.T) {
+	tests := map[string]struct {
+		challenge interface{}
+		expected  []string
+		wantErr   bool
+	}{
+		"none": {},
+		"scheme only": {
+			challenge: map[string]interface{}{"scheme": "Basic"},
+			expected:  []string{"Basic"},
+		},
+		"realm first": {
+			challenge: map[string]interface{}{"scheme": "Bearer", "scope": "read", "error": "invalid_token", "realm": "api"},
+			expected:  []string{`Bearer realm="api", error="invalid_token", scope="read"`},
+		},
+		"quoted": {
+			challenge: map[string]interface{}{"scheme": "Bearer", "error_description": `the "token" \ expired`},
+			expected:  []string{`Bearer error_description="the \"token\" \\ expired"`},
+		},
+		"array": {
+			challenge: []interface{}{map[string]interface{}{"scheme": "Bearer"}, map[string]interface{}{"scheme": "Basic", "realm": "api"}},
+			expected:  []string{"Bearer", `Basic realm="api"`},
+		},
+		"missing scheme":  {challenge: map[string]interface{}{"realm": "api"}, wantErr: true},
+		"invalid param":   {challenge: map[string]interface{}{"scheme": "Bearer", "a b": "c"}, wantErr: true},
+		"non-string":      {challenge: map[string]interface{}{"scheme": "Bearer", "realm": json.Number("1")}, wantErr: true},
+		"line break":      {challenge: map[string]interface{}{"scheme": "Bearer", "realm": "a\nb"}, wantErr: true},
+		"invalid type":    {challenge: "Bearer", wantErr: true},
+		"invalid element": {challenge: []interface{}{"Bearer"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			decision := map[string]interface{}{"allowed": false}
+			if tc.challenge != nil {
+				decision["challenge"] = tc.challenge
+			}
+			er := EvalResult{Decision: decision}
+
+			actual, err := er.GetResponseChallenges()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Fatalf("Expected challenges %v but got %v", tc.expected, actual)
+			}
+
+			status, err := er.GetResponseHTTPStatus()
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if exp := map[bool]int{true: http.StatusUnauthorized, false: http.StatusForbidden}[tc.challenge != nil]; status != exp {
+				t.Fatalf("Expected http status %v but got %v", exp, status)
+			}
+		})
+	}
+}
+
+func TestGetReason(t *testing.T) {
+	input := make(map[string]interface{})
+	er := EvalResult{
+		Decision: input,
+	}
+
+	result, err := er.GetReason()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if result != "" {
+		t.Fatalf("Expected empty reason but got %v", result)
+	}
+
+	input["reason"] = "token expired"
+	result, err = er.GetReason()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if result != "token expired" {
+		t.Fatalf("Expected result \"token expired\" but got %v", result)
+	}
+
+	input["reason"] = []string{"token expired"}
+	_, err = er.GetReason()
+	if err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "but got '[]string'") {
+		t.Fatalf("Assertion error type reflection failed")
+	}
+}
+
+func TestGetCacheTTL(t *testing.T) {
+	tests := map[string]struct {
+		decision interface{}
+		expected time.Duration
+		ok       bool
+		err      bool
+	}{
+		"boolean":    {decision: true},
+		"none":       {decision: map[string]interface{}{"allowed": true}},
+		"seconds":    {decision: map[string]interface{}{"cache_ttl": json.Number("30")}, expected: 30 * time.Second, ok: true},
+		"fraction":   {decision: map[string]interface{}{"cache_ttl": json.Number("0.5")}, expected: 500 * time.Millisecond, ok: true},
+		"duration":   {decision: map[string]interface{}{"cache_ttl": "5m"}, expected: 5 * time.Minute, ok: true},
+		"zero":       {decision: map[string]interface{}{"cache_ttl": json.Number("0")}, ok: true},
+		"negative":   {decision: map[string]interface{}{"cache_ttl": "-1s"}, err: true},
+		"malformed":  {decision: map[string]interface{}{"cache_ttl": "soon"}, err: true},
+		"wrong type": {decision: map[string]interface{}{"cache_ttl": true}, err: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			er := EvalResult{Decision: tc.decision}
+			ttl, ok, err := er.GetCacheTTL()
+			if (err != nil) != tc.err {
+				t.Fatalf("Expected error %v but got %v", tc.err, err)
+			}
+			if ttl != tc.expected || ok != tc.ok {
+				t.Fatalf("Expected cache TTL %v, %v but got %v, %v", tc.expected, tc.ok, ttl, ok)
+			}
+		})
+	}
+}
+
 func TestGetResponseHttpStatus(t *testing.T) {
 	input := make(map[string]interface{})
 	er := EvalResult{
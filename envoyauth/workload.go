@@ -0,0 +1,95 @@
+package envoyauth
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Fields of input.source_workload.
+const (
+	SourceWorkloadName      = "name"
+	SourceWorkloadNamespace = "namespace"
+	SourceWorkloadVersion   = "version"
+)
+
+// defaultSourceWorkloadKeys are the keys of the fields of input.source_workload
+// in the Istio proxy metadata, looked up in every filter metadata of the
+// request, in the order of their filter names, when the field has no path in
+// InputOptions.SourceWorkloadFields.
+var defaultSourceWorkloadKeys = map[string][][]string{
+	SourceWorkloadName:      {{"WORKLOAD_NAME"}},
+	SourceWorkloadNamespace: {{"NAMESPACE"}},
+	SourceWorkloadVersion: {
+		{"LABELS", "service.istio.io/canonical-revision"},
+		{"LABELS", "app.kubernetes.io/version"},
+		{"LABELS", "version"},
+	},
+}
+
+// getSourceWorkload returns the name, namespace and version of the workload
+// that sent the request, empty if unknown. Each field is read from its path in
+// fields, "<filter>/<key>[/<key>...]", or from the Istio proxy metadata keys.
+// A namespace that is not in the metadata is taken from the Istio SPIFFE ID
+// of the source, "spiffe://<trust domain>/ns/<namespace>/sa/<account>".
+func getSourceWorkload(filterMetadata map[string]*structpb.Struct, principal string, fields map[string]string) map[string]interface{} {
+	filters := make([]string, 0, len(filterMetadata))
+	for filter := range filterMetadata {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+
+	workload := map[string]interface{}{}
+	for _, field := range []string{SourceWorkloadName, SourceWorkloadNamespace, SourceWorkloadVersion} {
+		var value string
+		if path, ok := fields[field]; ok {
+			filter, keys, _ := strings.Cut(path, "/")
+			value = metadataString(filterMetadata[filter], strings.Split(keys, "/"))
+		} else {
+		lookup:
+			for _, filter := range filters {
+				for _, keys := range defaultSourceWorkloadKeys[field] {
+					if value = metadataString(filterMetadata[filter], keys); value != "" {
+						break lookup
+					}
+				}
+			}
+		}
+		workload[field] = value
+	}
+
+	if workload[SourceWorkloadNamespace] == "" {
+		workload[SourceWorkloadNamespace] = spiffeNamespace(principal)
+	}
+	return workload
+}
+
+// metadataString returns the string at keys in the nested structs of s, or an
+// empty string if there is none.
+func metadataString(s *structpb.Struct, keys []string) string {
+	for i, key := range keys {
+		v, ok := s.GetFields()[key]
+		if !ok {
+			return ""
+		}
+		if i == len(keys)-1 {
+			return v.GetStringValue()
+		}
+		s = v.GetStructValue()
+	}
+	return ""
+}
+
+// spiffeNamespace returns the namespace of an Istio SPIFFE ID.
+func spiffeNamespace(id string) string {
+	_, path, ok := strings.Cut(strings.TrimPrefix(id, "spiffe://"), "/")
+	if !ok || !strings.HasPrefix(id, "spiffe://") {
+		return ""
+	}
+	segments := strings.Split(path, "/")
+	if len(segments) != 4 || segments[0] != "ns" || segments[2] != "sa" {
+		return ""
+	}
+	return segments[1]
+}
@@ -0,0 +1,64 @@
+package envoyauth
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// trustedClientAddress returns the address of the client that sent the request
+// to the first trusted proxy in front of Envoy, based on the address of the
+// peer of Envoy and on the x-forwarded-for header, where each proxy appends
+// the address of its own peer. Like Envoy's XFF original IP detection:
+//
+//   - With TrustedProxies, the peer and the addresses of the header are
+//     walked from the right as long as they belong to a trusted proxy. The
+//     first untrusted address is the client, or the leftmost if all are
+//     trusted.
+//   - Otherwise, with XFFNumTrustedHops set to N, the peer and the N-1
+//     proxies before it are trusted and the client is the Nth address from
+//     the right of the header, or the leftmost if there are fewer.
+func trustedClientAddress(peer, xff string, options InputOptions) (string, bool) {
+	var hops []string
+	if xff != "" {
+		for _, s := range strings.Split(xff, ",") {
+			hops = append(hops, strings.TrimSpace(s))
+		}
+	}
+
+	if len(options.TrustedProxies) > 0 {
+		addr := peer
+		for i := len(hops); ; i-- {
+			ip, err := netip.ParseAddr(addr)
+			if err != nil {
+				return "", false
+			}
+			if i == 0 || !trustedProxy(ip.Unmap(), options.TrustedProxies) {
+				return ip.String(), true
+			}
+			addr = hops[i-1]
+		}
+	}
+
+	if options.XFFNumTrustedHops > 0 && len(hops) > 0 {
+		i := len(hops) - options.XFFNumTrustedHops
+		if i < 0 {
+			i = 0
+		}
+		ip, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			return "", false
+		}
+		return ip.String(), true
+	}
+
+	return "", false
+}
+
+func trustedProxy(ip netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,455 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+)
+
+// additionalQuery is a query of additional-paths, response-path or
+// grpc-method-paths, or the main query. Like the main query, it is prepared on
+// first use and again after the compiler has been updated.
+type additionalQuery struct {
+	parsedQuery ast.Body
+	prepared    atomic.Pointer[preparedQuery]
+}
+
+// preparedQuery is a query prepared with the compiler of the time. It is
+// replaced as a whole rather than reset, so that a check still preparing the
+// query with a previous compiler only stores it in the replaced one.
+type preparedQuery struct {
+	once sync.Once
+	pq   *rego.PreparedEvalQuery
+}
+
+func newAdditionalQuery(path string) (*additionalQuery, error) {
+	parsedQuery, err := ast.ParseBody(stringPathToDataRef(path).String())
+	if err != nil {
+		return nil, err
+	}
+	return newQuery(parsedQuery), nil
+}
+
+func newQuery(parsedQuery ast.Body) *additionalQuery {
+	q := &additionalQuery{parsedQuery: parsedQuery}
+	q.reset()
+	return q
+}
+
+// reset makes the query prepared again on its next use.
+func (q *additionalQuery) reset() {
+	q.prepared.Store(new(preparedQuery))
+}
+
+// evalContext returns the context evaluating q with the store, compiler and
+// caches of p.
+func (q *additionalQuery) evalContext(p *envoyExtAuthzGrpcServer) additionalQueryEvalContext {
+	return additionalQueryEvalContext{envoyExtAuthzGrpcServer: p, parsedQuery: q.parsedQuery, prepared: q.prepared.Load()}
+}
+
+// additionalQueryEvalContext evaluates a query with the store, compiler and
+// caches of the plugin. It prepares the query in the preparedQuery of the query
+// at the time the context was created.
+type additionalQueryEvalContext struct {
+	*envoyExtAuthzGrpcServer
+	parsedQuery ast.Body
+	prepared    *preparedQuery
+}
+
+func (c additionalQueryEvalContext) ParsedQuery() ast.Body {
+	return c.parsedQuery
+}
+
+func (c additionalQueryEvalContext) PreparedQueryDoOnce() *sync.Once {
+	return &c.prepared.once
+}
+
+func (c additionalQueryEvalContext) PreparedQuery() *rego.PreparedEvalQuery {
+	return c.prepared.pq
+}
+
+func (c additionalQueryEvalContext) SetPreparedQuery(pq *rego.PreparedEvalQuery) {
+	c.prepared.pq = pq
+}
+
+func sameAdditionalQueries(a, b []*additionalQuery) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].parsedQuery.Equal(b[i].parsedQuery) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameQuery(a, b *additionalQuery) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.parsedQuery.Equal(b.parsedQuery)
+}
+
+// Values of additional-paths-strategy.
+const (
+	additionalPathsStrategyMostRestrictive = "most-restrictive"
+	additionalPathsStrategyDenyOverrides   = "deny-overrides"
+)
+
+// denialKeys are the keys of a decision that make up the response of a denied
+// request.
+var denialKeys = []string{"body", "http_status", "redirect", "challenge"}
+
+// mergeDecisions combines the decisions of the main query and of the
+// additional queries, in that order:
+//
+//   - the request is allowed only if every decision allows it;
+//   - headers, response_headers_to_add, request_headers_to_remove and
+//     query_parameters_to_remove are concatenated;
+//   - dynamic_metadata, query_parameters_to_set and
+//     response_headers_to_add_actions are merged, the first decision setting
+//     a key wins;
+//   - body, http_status, redirect and challenge are those of the most
+//     restrictive decision that denies the request, see denialRank, if any,
+//     and otherwise redirect and http_status are those of the first decision
+//     redirecting the request;
+//   - the headers of a denied request are taken from the decisions from the
+//     most restrictive, a header set by a decision overriding those of the
+//     less restrictive ones;
+//   - cache_ttl is the shortest of those of the decisions, and is left out
+//     unless every decision sets one;
+//   - for any other key the first decision setting it wins.
+//
+// With additionalPathsStrategyDenyOverrides, a denied request is answered
+// with the merged response of all the decisions denying it instead:
+//
+//   - body, http_status, redirect and challenge are each taken from the most
+//     restrictive denying decision that sets them;
+//   - headers and response_headers_to_add of the allowing decisions are
+//     dropped;
+//   - reason joins the reasons of the denying decisions with "; ", which are
+//     also listed at reasons.
+//
+// Boolean decisions are merged into a boolean decision, unless they are
+// combined with object decisions.
+func mergeDecisions(decisions []interface{}, strategy string) (interface{}, error) {
+	allBool := true
+	for _, decision := range decisions {
+		switch decision.(type) {
+		case bool:
+		case map[string]interface{}:
+			allBool = false
+		default:
+			return nil, fmt.Errorf("illegal value for policy evaluation result: %T", decision)
+		}
+	}
+
+	if allBool {
+		allowed := true
+		for _, decision := range decisions {
+			allowed = allowed && decision.(bool)
+		}
+		return allowed, nil
+	}
+
+	objects := make([]map[string]interface{}, len(decisions))
+	allowed := true
+	var denials, allows []map[string]interface{}
+
+	for i, decision := range decisions {
+		object, ok := decision.(map[string]interface{})
+		if !ok {
+			object = map[string]interface{}{"allowed": decision}
+		}
+
+		a, ok := object["allowed"].(bool)
+		if !ok {
+			return nil, fmt.Errorf("unable to determine evaluation result due to missing or invalid \"allowed\" key")
+		}
+		if a {
+			allows = append(allows, object)
+		} else {
+			denials = append(denials, object)
+		}
+		allowed = allowed && a
+		objects[i] = object
+	}
+
+	denyOverrides := strategy == additionalPathsStrategyDenyOverrides && !allowed
+	merged := map[string]interface{}{}
+
+	for _, object := range objects {
+		for key, val := range object {
+			switch key {
+			case "allowed", "body", "http_status", "redirect", "challenge", "cache_ttl":
+			case "headers":
+				if !allowed {
+					continue
+				}
+				fallthrough
+			case "response_headers_to_add":
+				if denyOverrides && object["allowed"] == true {
+					continue
+				}
+				fallthrough
+			case "request_headers_to_remove", "query_parameters_to_remove":
+				if prev, ok := merged[key]; ok {
+					merged[key] = append(asSlice(prev), asSlice(val)...)
+				} else {
+					merged[key] = val
+				}
+			case "dynamic_metadata", "query_parameters_to_set", "response_headers_to_add_actions":
+				merged[key] = mergeObjects(merged[key], val)
+			case "reason":
+				if denyOverrides {
+					continue
+				}
+				fallthrough
+			default:
+				if _, ok := merged[key]; !ok {
+					merged[key] = val
+				}
+			}
+		}
+	}
+
+	if ttl, ok := mergeCacheTTLs(objects); ok {
+		merged["cache_ttl"] = ttl
+	}
+
+	merged["allowed"] = allowed
+	if len(denials) == 0 {
+		// The redirect of an allowed request comes with its status.
+		for _, object := range objects {
+			if val, ok := object["redirect"]; ok {
+				merged["redirect"] = val
+				if status, ok := object["http_status"]; ok {
+					merged["http_status"] = status
+				}
+				break
+			}
+		}
+		return merged, nil
+	}
+
+	ranked := append([]map[string]interface{}{}, denials...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return denialRank(ranked[i]) < denialRank(ranked[j])
+	})
+
+	// Headers meant for the upstream are not returned to the client.
+	responders := ranked
+	if !denyOverrides {
+		responders = append(responders, allows...)
+	}
+	if headers, ok := mergeDenialHeaders(responders); ok {
+		merged["headers"] = headers
+	}
+
+	if !denyOverrides {
+		for _, key := range denialKeys {
+			if val, ok := ranked[0][key]; ok {
+				merged[key] = val
+			}
+		}
+		return merged, nil
+	}
+
+	for _, denial := range ranked {
+		for _, key := range denialKeys {
+			if _, ok := merged[key]; ok {
+				continue
+			}
+			if val, ok := denial[key]; ok {
+				merged[key] = val
+			}
+		}
+	}
+	if reason, reasons := mergeReasons(denials); len(reasons) > 0 {
+		merged["reason"] = reason
+		merged["reasons"] = reasons
+	}
+	return merged, nil
+}
+
+// denialRank orders denials from the most restrictive, by the status of their
+// response: 403, also the status of denials that set none, then 401 and 407,
+// which ask for credentials, the other client errors, the server errors and
+// the other statuses, e.g. redirects. A denial with an invalid status comes
+// first, for the response getters to reject it.
+func denialRank(denial map[string]interface{}) int {
+	status, err := (&envoyauth.EvalResult{Decision: denial}).GetResponseHTTPStatus()
+	switch {
+	case err != nil:
+		return 0
+	case status == http.StatusForbidden:
+		return 1
+	case status == http.StatusUnauthorized, status == http.StatusProxyAuthRequired:
+		return 2
+	case status >= 400 && status < 500:
+		return 3
+	case status >= 500:
+		return 4
+	}
+	return 5
+}
+
+// mergeDenialHeaders merges the headers of the decisions, ordered from the most
+// restrictive. A header is taken from the first decision that sets it, with all
+// of its values in that decision. Values that are not header objects are kept
+// for the response getters to reject.
+func mergeDenialHeaders(objects []map[string]interface{}) (interface{}, bool) {
+	var merged []interface{}
+	set := map[string]bool{}
+	for _, object := range objects {
+		val, ok := object["headers"]
+		if !ok {
+			continue
+		}
+		var names []string
+		for _, h := range asSlice(val) {
+			headers, ok := h.(map[string]interface{})
+			if !ok {
+				merged = append(merged, h)
+				continue
+			}
+			kept := make(map[string]interface{}, len(headers))
+			for name, v := range headers {
+				if set[http.CanonicalHeaderKey(name)] {
+					continue
+				}
+				kept[name] = v
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+			if len(kept) > 0 {
+				merged = append(merged, kept)
+			}
+		}
+		for _, name := range names {
+			set[name] = true
+		}
+	}
+
+	switch len(merged) {
+	case 0:
+		return nil, false
+	case 1:
+		return merged[0], true
+	}
+	return merged, true
+}
+
+// mergeCacheTTLs returns the shortest cache_ttl of the decisions, and false if
+// a decision has none. An invalid cache_ttl is returned as is, to be reported
+// with the merged decision.
+func mergeCacheTTLs(objects []map[string]interface{}) (interface{}, bool) {
+	var shortest interface{}
+	var shortestTTL time.Duration
+	for i, object := range objects {
+		val, ok := object["cache_ttl"]
+		if !ok {
+			return nil, false
+		}
+		ttl, err := envoyauth.ParseCacheTTL(val)
+		if err != nil {
+			return val, true
+		}
+		if i == 0 || ttl < shortestTTL {
+			shortest, shortestTTL = val, ttl
+		}
+	}
+	return shortest, true
+}
+
+// mergeReasons returns the reasons of the denials, and their reasons joined
+// with "; ". If a reason is not a string, it is returned instead, for the
+// response getters to reject.
+func mergeReasons(denials []map[string]interface{}) (interface{}, []interface{}) {
+	var reasons []interface{}
+	var joined []string
+	var invalid interface{}
+	for _, denial := range denials {
+		reason, ok := denial["reason"]
+		if !ok {
+			continue
+		}
+		reasons = append(reasons, reason)
+		if s, ok := reason.(string); ok {
+			joined = append(joined, s)
+		} else if invalid == nil {
+			invalid = reason
+		}
+	}
+	if invalid != nil {
+		return invalid, reasons
+	}
+	return strings.Join(joined, "; "), reasons
+}
+
+func asSlice(val interface{}) []interface{} {
+	switch val := val.(type) {
+	case []interface{}:
+		return append([]interface{}{}, val...)
+	case []string:
+		s := make([]interface{}, 0, len(val))
+		for _, v := range val {
+			s = append(s, v)
+		}
+		return s
+	}
+	return []interface{}{val}
+}
+
+// mergeObjects adds the keys of val missing from prev. Values that are not
+// objects are left for the response getters to reject.
+func mergeObjects(prev, val interface{}) interface{} {
+	if prev == nil {
+		return val
+	}
+
+	prevObject, ok := prev.(map[string]interface{})
+	if !ok {
+		return prev
+	}
+	object, ok := val.(map[string]interface{})
+	if !ok {
+		return prev
+	}
+
+	merged := make(map[string]interface{}, len(prevObject)+len(object))
+	for k, v := range object {
+		merged[k] = v
+	}
+	for k, v := range prevObject {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeNDBCache adds the non-deterministic builtin calls of src to dst.
+func mergeNDBCache(dst, src builtins.NDBCache) builtins.NDBCache {
+	if dst == nil {
+		return src
+	}
+	for name, calls := range src {
+		if _, ok := dst[name]; !ok {
+			dst[name] = calls
+			continue
+		}
+		calls.Foreach(func(k, v *ast.Term) {
+			dst[name].Insert(k, v)
+		})
+	}
+	return dst
+}
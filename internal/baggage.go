@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/baggage"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// callBaggage returns the OpenTelemetry baggage propagated on the gRPC call
+// from Envoy, extracted into ctx by the tracing interceptor or, without
+// distributed tracing, read from the call metadata.
+func callBaggage(ctx context.Context) baggage.Baggage {
+	if b := baggage.FromContext(ctx); b.Len() > 0 {
+		return b
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("baggage")
+	if len(values) == 0 {
+		return baggage.Baggage{}
+	}
+	b, _ := baggage.Parse(strings.Join(values, ","))
+	return b
+}
+
+// addCallBaggage adds the members of the call baggage to input.baggage, which
+// holds the baggage header of the checked request. Members of the call
+// baggage, set by Envoy, replace those of the request. The input is copied,
+// not modified, as it may be cached.
+func addCallBaggage(input map[string]interface{}, inputValue ast.Value, b baggage.Baggage) (map[string]interface{}, ast.Value, error) {
+	obj, ok := inputValue.(ast.Object)
+	if !ok {
+		return input, inputValue, nil
+	}
+
+	members := map[string]interface{}{}
+	if prev, ok := input["baggage"].(map[string]interface{}); ok {
+		for k, v := range prev {
+			members[k] = v
+		}
+	}
+	for _, m := range b.Members() {
+		members[m.Key()] = m.Value()
+	}
+
+	membersValue, err := ast.InterfaceToValue(members)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := ast.StringTerm("baggage")
+	value := ast.NewObject()
+	obj.Foreach(func(k, v *ast.Term) {
+		if !k.Equal(key) {
+			value.Insert(k, v)
+		}
+	})
+	value.Insert(key, ast.NewTerm(membersValue))
+
+	enriched := make(map[string]interface{}, len(input)+1)
+	for k, v := range input {
+		enriched[k] = v
+	}
+	enriched["baggage"] = members
+	return enriched, value, nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"google.golang.org/grpc/status"
+
+	batchv1 "github.com/open-policy-agent/opa-envoy-plugin/proto/batch/v1"
+)
+
+// batchAuthorizationServer implements the BatchAuthorization service on top of
+// the same check pipeline used for Envoy's Authorization service.
+type batchAuthorizationServer struct {
+	batchv1.UnimplementedBatchAuthorizationServer
+	v3 *envoyExtAuthzGrpcServer
+}
+
+// BatchCheck is opa.envoy.batch.v1.BatchAuthorization/BatchCheck. The requests
+// are checked concurrently, at most max-concurrent-checks (GOMAXPROCS by
+// default) at a time.
+func (s *batchAuthorizationServer) BatchCheck(ctx context.Context, req *batchv1.BatchCheckRequest) (*batchv1.BatchCheckResponse, error) {
+	requests := req.GetRequests()
+	results := make([]*batchv1.BatchCheckResult, len(requests))
+
+	limit := s.v3.config().MaxConcurrentChecks
+	if limit <= 0 {
+		limit = runtime.GOMAXPROCS(0)
+	}
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i := range requests {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			resp, err := s.v3.Check(ctx, requests[i])
+			if err != nil {
+				results[i] = &batchv1.BatchCheckResult{Error: status.Convert(err).Proto()}
+				return
+			}
+			results[i] = &batchv1.BatchCheckResult{Response: resp}
+		}(i)
+	}
+
+	wg.Wait()
+
+	return &batchv1.BatchCheckResponse{Results: results}, nil
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	rpc_status "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+// waitForBundles keeps the plugin from reporting itself ready until the bundle
+// plugin has activated all configured bundles. Without bundles the policy is
+// loaded before the plugins start, so there is nothing to wait for.
+func (p *envoyExtAuthzGrpcServer) waitForBundles() {
+	if bundle.Lookup(p.manager) == nil {
+		p.bundlesActivated.Store(true)
+		return
+	}
+
+	p.manager.RegisterPluginStatusListener(p.name, p.pluginStatusChanged)
+	p.pluginStatusChanged(p.manager.PluginStatus())
+}
+
+func (p *envoyExtAuthzGrpcServer) pluginStatusChanged(statuses map[string]*plugins.Status) {
+	s, ok := statuses[bundle.Name]
+	if !ok || s == nil || s.State != plugins.StateOK {
+		return
+	}
+
+	if !p.bundlesActivated.CompareAndSwap(false, true) {
+		return
+	}
+
+	p.Logger().Info("Bundles activated, serving policy decisions.")
+	p.reportReady()
+}
+
+// preBundleCheck returns the configured pre-bundle-decision for requests
+// received before the bundles have been activated.
+func preBundleCheck(cfg *Config) (*ext_authz_v3.CheckResponse, *Error) {
+	return fallbackCheck(cfg.PreBundleDecision, internalError(BundleNotActivatedErr, status.Error(codes.Unavailable, "bundles have not been activated yet")))
+}
+
+// fallbackCheck returns the response to a request that is not evaluated: allowed,
+// denied or, for "unavailable", the error err.
+func fallbackCheck(decision string, err Error) (*ext_authz_v3.CheckResponse, *Error) {
+	switch decision {
+	case preBundleDecisionAllow:
+		return &ext_authz_v3.CheckResponse{Status: &rpc_status.Status{Code: int32(code.Code_OK)}}, nil
+	case preBundleDecisionDeny:
+		return &ext_authz_v3.CheckResponse{Status: &rpc_status.Status{Code: int32(code.Code_PERMISSION_DENIED)}}, nil
+	}
+
+	return nil, &err
+}
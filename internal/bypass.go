@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	rpc_status "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// validatePaths checks the paths of the option, e.g. bypass-paths, matched by
+// matchesPaths.
+func validatePaths(option string, paths []string) error {
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") || strings.Contains(strings.TrimSuffix(path, "*"), "*") {
+			return fmt.Errorf("invalid config: %s must start with \"/\" and may only end with \"*\": %q", option, path)
+		}
+	}
+	return nil
+}
+
+// bypassDecision is the decision logged for requests matching bypass-paths.
+func bypassDecision() map[string]interface{} {
+	return map[string]interface{}{"allowed": true, "bypassed": true}
+}
+
+// matchesPaths reports whether the path of req, without its query string,
+// matches one of paths, e.g. of bypass-paths or dry-run-paths. A path ending
+// with "*" matches any path with that prefix, other paths must match exactly.
+func matchesPaths(paths []string, req interface{}) bool {
+	if len(paths) == 0 {
+		return false
+	}
+
+	_, path, _ := requestSummary(req)
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	for _, p := range paths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+func bypassResponse() *ext_authz_v3.CheckResponse {
+	return &ext_authz_v3.CheckResponse{
+		Status: &rpc_status.Status{Code: int32(code.Code_OK)},
+		HttpResponse: &ext_authz_v3.CheckResponse_OkResponse{
+			OkResponse: &ext_authz_v3.OkHttpResponse{},
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteSizeUnits are the units accepted in byte sizes. Like gRPC's own 4MB
+// default message size, they are powers of 1024.
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+}
+
+// byteSize is a size in bytes, configured either as an integer number of bytes
+// or as a string with a unit, e.g. "4MB".
+type byteSize int
+
+func (s *byteSize) UnmarshalJSON(bs []byte) error {
+	if !bytes.HasPrefix(bs, []byte(`"`)) {
+		var n int
+		if err := json.Unmarshal(bs, &n); err != nil {
+			return fmt.Errorf("invalid config: size %s must be an integer or a string like \"4MB\"", bs)
+		}
+		*s = byteSize(n)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(bs, &str); err != nil {
+		return err
+	}
+	n, err := parseByteSize(str)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+// parseByteSize parses a number of bytes with an optional unit: B, KB, MB or GB
+// (case insensitive, also as KiB, MiB and GiB).
+func parseByteSize(str string) (int, error) {
+	s := strings.TrimSpace(str)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+
+	unit, ok := byteSizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("size %q must be a number of bytes with an optional unit: B, KB, MB or GB", str)
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("size %q: %w", str, err)
+	}
+
+	size := n * float64(unit)
+	if size > math.MaxInt32 {
+		return 0, fmt.Errorf("size %q must not exceed %d bytes", str, math.MaxInt32)
+	}
+	return int(size), nil
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	circuitBreakerClosed   = 0
+	circuitBreakerOpen     = 1
+	circuitBreakerHalfOpen = 2
+)
+
+// circuitBreaker stops evaluating the policy after threshold consecutive
+// evaluation errors, e.g. while a service queried with http.send is down, so
+// that checks fail fast instead of waiting for the dependency to time out.
+// Once openDuration has passed, one check per openDuration is evaluated again:
+// the breaker closes when it succeeds.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mtx       sync.Mutex
+	failures  int
+	openUntil time.Time
+
+	// probe identifies the check let through while half-open until its
+	// outcome is recorded.
+	probe     uint64
+	lastProbe uint64
+
+	trips    prometheus.Counter
+	rejected prometheus.Counter
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+	}
+}
+
+// Allow reports whether the policy may be evaluated. The check let through
+// while half-open gets a non-zero probe, to be passed to Release once the check
+// is done: if the check did not record an outcome, e.g. as it ended before
+// evaluating the policy, the next check is let through instead of waiting for
+// openDuration.
+func (b *circuitBreaker) Allow() (bool, uint64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		if b.rejected != nil {
+			b.rejected.Inc()
+		}
+		return false, 0
+	}
+	if b.failures >= b.threshold {
+		// Half-open: let this check through and keep rejecting the others
+		// until it has had time to complete.
+		b.openUntil = now.Add(b.openDuration)
+		b.lastProbe++
+		b.probe = b.lastProbe
+		return true, b.probe
+	}
+	return true, 0
+}
+
+// Release frees the half-open slot taken by probe if its outcome was not
+// recorded.
+func (b *circuitBreaker) Release(probe uint64) {
+	if probe == 0 {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.probe == probe {
+		b.probe = 0
+		b.openUntil = time.Time{}
+	}
+}
+
+// Record records the outcome of a policy evaluation.
+func (b *circuitBreaker) Record(failed bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.probe = 0
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = time.Now().Add(b.openDuration)
+		if b.trips != nil {
+			b.trips.Inc()
+		}
+	}
+}
+
+// State returns circuitBreakerClosed, circuitBreakerOpen or circuitBreakerHalfOpen.
+func (b *circuitBreaker) State() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch {
+	case b.failures < b.threshold:
+		return circuitBreakerClosed
+	case time.Now().Before(b.openUntil):
+		return circuitBreakerOpen
+	}
+	return circuitBreakerHalfOpen
+}
+
+func (b *circuitBreaker) registerMetrics(reg prometheus.Registerer) {
+	b.trips = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "circuit_breaker_trips",
+		Help: "A counter for the times the circuit breaker opened after repeated evaluation errors",
+	})
+	b.rejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "circuit_breaker_rejected_checks",
+		Help: "A counter for check requests answered with circuit-breaker-decision while the circuit breaker was open",
+	})
+	state := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "The state of the circuit breaker: 0 (closed), 1 (open) or 2 (half-open)",
+	}, func() float64 { return float64(b.State()) })
+
+	reg.MustRegister(b.trips, b.rejected, state)
+}
+
+// circuitOpenCheck returns the configured circuit-breaker-decision for requests
+// received while the circuit breaker is open.
+func circuitOpenCheck(cfg *Config) (*ext_authz_v3.CheckResponse, *Error) {
+	return fallbackCheck(cfg.CircuitBreakerDecision, internalError(CircuitOpenErr, status.Error(codes.Unavailable, "policy evaluation suspended after repeated errors")))
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// gzipResponses compresses the responses of calls whose client advertises gzip
+// in "grpc-accept-encoding", even if the request itself was not compressed.
+//
+// Importing the gzip package registers the compressor process-wide, so requests
+// sent with "grpc-encoding: gzip" are decompressed, and their responses
+// compressed, regardless of grpc-enable-gzip.
+func gzipResponses(ctx context.Context) {
+	supported, err := grpc.ClientSupportedCompressors(ctx)
+	if err != nil {
+		return
+	}
+	for _, name := range supported {
+		if name == gzip.Name {
+			_ = grpc.SetSendCompressor(ctx, gzip.Name)
+			return
+		}
+	}
+}
+
+func gzipUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	gzipResponses(ctx)
+	return handler(ctx, req)
+}
+
+func gzipStreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	gzipResponses(ss.Context())
+	return handler(srv, ss)
+}
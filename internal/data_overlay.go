@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// DataOverlay selects, for each request, an object of the store that is merged
+// into the data document seen by the policy. The overlay is the object at
+// data.<Path>.<name>, where name is the string found in the input at Key, e.g.
+// "attributes/context_extensions/tenant".
+//
+// The overlay takes precedence over the base documents of the store: objects
+// are merged recursively, and any other overlay value replaces the base value
+// at its path. Rules are not affected. The store itself is not modified.
+type DataOverlay struct {
+	Path string `json:"path"`
+	Key  string `json:"key"`
+
+	path storage.Path
+	key  []string
+}
+
+func (o *DataOverlay) parse() error {
+	path, key, err := parseStoreLookup("data-overlay", o.Path, o.Key)
+	if err != nil {
+		return err
+	}
+	o.path, o.key = path, key
+	return nil
+}
+
+// lookup returns the overlay selected by input, or false if the input has no
+// key or the store no object for it.
+func (o *DataOverlay) lookup(ctx context.Context, store storage.Store, txn storage.Transaction, input map[string]interface{}, logger logging.Logger) (map[string]interface{}, bool, error) {
+	name, ok := lookupInputString(input, o.key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	path := append(append(storage.Path{}, o.path...), name)
+	v, err := store.Read(ctx, txn, path)
+	if storage.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	overlay, ok := v.(map[string]interface{})
+	if !ok {
+		logger.WithFields(map[string]interface{}{"path": path.String()}).Debug("Data overlay is not an object, ignoring it.")
+		return nil, false, nil
+	}
+	return overlay, true, nil
+}
+
+type dataOverlayKey struct{}
+
+// withDataOverlay returns a context for which overlayStore reads include overlay.
+func withDataOverlay(ctx context.Context, overlay map[string]interface{}) context.Context {
+	return context.WithValue(ctx, dataOverlayKey{}, overlay)
+}
+
+// overlayStore merges the data overlay of the context, if any, into the
+// documents read from the store. The policy evaluation reads the base documents
+// with the context of the evaluation.
+type overlayStore struct {
+	storage.Store
+}
+
+func (s overlayStore) Read(ctx context.Context, txn storage.Transaction, path storage.Path) (interface{}, error) {
+	overlay, ok := ctx.Value(dataOverlayKey{}).(map[string]interface{})
+	if !ok {
+		return s.Store.Read(ctx, txn, path)
+	}
+
+	var node interface{} = overlay
+	replaced := false
+	for i, k := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[k]
+			if !ok {
+				if replaced {
+					return nil, notFoundError(path)
+				}
+				return s.Store.Read(ctx, txn, path)
+			}
+			node = v
+		case []interface{}:
+			// The overlay replaced the array at path[:i] of the base documents.
+			idx, err := strconv.Atoi(k)
+			if err != nil || idx < 0 || idx >= len(n) {
+				return nil, notFoundError(path)
+			}
+			node, replaced = n[idx], true
+		default:
+			return nil, notFoundError(path[:i+1])
+		}
+	}
+	if replaced {
+		return node, nil
+	}
+
+	base, err := s.Store.Read(ctx, txn, path)
+	if storage.IsNotFound(err) {
+		return node, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return mergeOverlay(base, node), nil
+}
+
+func notFoundError(path storage.Path) *storage.Error {
+	return &storage.Error{Code: storage.NotFoundErr, Message: path.String() + ": document does not exist"}
+}
+
+// mergeOverlay returns base with overlay merged in, without modifying either.
+func mergeOverlay(base, overlay interface{}) interface{} {
+	baseObj, ok := base.(map[string]interface{})
+	if !ok {
+		return overlay
+	}
+	overlayObj, ok := overlay.(map[string]interface{})
+	if !ok {
+		return overlay
+	}
+
+	merged := make(map[string]interface{}, len(baseObj)+len(overlayObj))
+	for k, v := range baseObj {
+		merged[k] = v
+	}
+	for k, v := range overlayObj {
+		if b, ok := merged[k]; ok {
+			merged[k] = mergeOverlay(b, v)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
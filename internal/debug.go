@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugHandler serves the net/http/pprof profiles under /debug/pprof/.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// validateDebugAddr checks that the debug server only listens on a loopback
+// address: the profiles expose the command line and the memory of the process.
+func validateDebugAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid config: debug-addr: %w", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("invalid config: debug-addr must be a loopback address, e.g. localhost:6060: %q", addr)
+	}
+	return nil
+}
+
+func (p *envoyExtAuthzGrpcServer) listenDebug() {
+	logger := p.Logger()
+	logger.WithFields(map[string]interface{}{"addr": p.debugServer.Addr}).Info("Starting debug server.")
+
+	if err := p.debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Debug listener failed.")
+	}
+}
+
+func (p *envoyExtAuthzGrpcServer) stopDebug(ctx context.Context) {
+	if p.debugServer != nil {
+		_ = p.debugServer.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,391 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/plugins/logs"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/server"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+const (
+	defaultMaskDecisionPath = "/system/log/mask"
+	defaultDropDecisionPath = "/system/log/drop"
+)
+
+// decisionFile writes decision log events to a local file, one JSON object per
+// line, independently of the decision logs plugin: each keeps logging when the
+// other fails. The file is rotated once it exceeds maxSize bytes or is older
+// than maxAge, and the rotated files beyond the newest maxBackups are removed.
+// A zero limit disables it.
+type decisionFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mtx    sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newDecisionFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) *decisionFile {
+	return &decisionFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+}
+
+// decisionFileEvent is a decision log event with the explanation of the
+// decision, for decisions explained with the explain-header.
+type decisionFileEvent struct {
+	logs.EventV1
+	Explanation string `json:"explanation,omitempty"`
+}
+
+// decisionFileFilter returns the JSON object of a decision log event as
+// written to the file, or nil if the event is dropped.
+type decisionFileFilter func(event map[string]interface{}) (map[string]interface{}, error)
+
+// mergeLabels returns the labels of OPA with the extra labels that OPA does
+// not set.
+func mergeLabels(labels, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return labels
+	}
+
+	merged := make(map[string]string, len(labels)+len(extra))
+	for k, v := range extra {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Log appends the decision log event of info to the file, filtered by filter
+// if set.
+func (d *decisionFile) Log(info *server.Info, labels map[string]string, filter decisionFileFilter) error {
+	bundles := map[string]logs.BundleInfoV1{}
+	for name, b := range info.Bundles {
+		bundles[name] = logs.BundleInfoV1{Revision: b.Revision}
+	}
+
+	event := decisionFileEvent{EventV1: logs.EventV1{
+		Labels:         labels,
+		DecisionID:     info.DecisionID,
+		TraceID:        info.TraceID,
+		SpanID:         info.SpanID,
+		Revision:       info.Revision,
+		Bundles:        bundles,
+		Path:           info.Path,
+		Query:          info.Query,
+		Input:          info.Input,
+		Result:         info.Results,
+		MappedResult:   info.MappedResults,
+		NDBuiltinCache: info.NDBuiltinCache,
+		Error:          info.Error,
+		Timestamp:      info.Timestamp,
+	}}
+	if info.Metrics != nil {
+		event.Metrics = info.Metrics.All()
+	}
+	if len(info.Trace) > 0 {
+		event.Explanation = explanation(info.Trace, maxExplanationBytes)
+	}
+
+	var logged interface{} = event
+	if filter != nil {
+		// The filtered copy must not modify the input logged by the decision
+		// logs plugin.
+		bs, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		var doc map[string]interface{}
+		if err := util.UnmarshalJSON(bs, &doc); err != nil {
+			return err
+		}
+		if doc, err = filter(doc); err != nil || doc == nil {
+			return err
+		}
+		logged = doc
+	}
+
+	bs, err := json.Marshal(logged)
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.f != nil && d.expired(len(bs)) {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if d.f == nil {
+		if err := d.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := d.f.Write(bs)
+	d.size += int64(n)
+	return err
+}
+
+// Close closes the file.
+func (d *decisionFile) Close() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+func (d *decisionFile) expired(n int) bool {
+	return (d.maxSize > 0 && d.size > 0 && d.size+int64(n) > d.maxSize) ||
+		(d.maxAge > 0 && time.Since(d.opened) > d.maxAge)
+}
+
+func (d *decisionFile) open() error {
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	d.f = f
+	d.size = fi.Size()
+	d.opened = time.Now()
+	return nil
+}
+
+// rotate renames the file after the current time and removes the oldest
+// rotated files. The next write opens a new file.
+func (d *decisionFile) rotate() error {
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	d.f = nil
+
+	if err := os.Rename(d.path, d.path+"."+time.Now().UTC().Format("20060102T150405.000000000")); err != nil {
+		return err
+	}
+
+	if d.maxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(d.path + ".*")
+	if err != nil {
+		return err
+	}
+	// The timestamps sort chronologically.
+	sort.Strings(backups)
+	for len(backups) > d.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// filterDecisionFileEvent applies the drop and mask policies of the
+// decision_logs plugin to the events of decision-log-file, like the plugin
+// does to its own events. The explanation of a masked event is left out, as
+// the trace may show the masked values.
+func (p *envoyExtAuthzGrpcServer) filterDecisionFileEvent(ctx context.Context) decisionFileFilter {
+	return func(event map[string]interface{}) (map[string]interface{}, error) {
+		explanation, explained := event["explanation"]
+		delete(event, "explanation")
+
+		drop, err := p.dropEvent(ctx, nil, event)
+		if err != nil || drop {
+			return nil, err
+		}
+		event, masked, err := p.maskEvent(ctx, nil, event)
+		if err != nil {
+			return nil, err
+		}
+		if explained && !masked {
+			event["explanation"] = explanation
+		}
+		return event, nil
+	}
+}
+
+// maskEvent applies the rules of the mask policy of the decision_logs plugin
+// (data.system.log.mask by default) to event, the JSON object of a decision
+// log event, and reports whether a rule applied. Like the plugin, only the
+// input, result and nd_builtin_cache of the event are masked.
+func (p *envoyExtAuthzGrpcServer) maskEvent(ctx context.Context, txn storage.Transaction, event map[string]interface{}) (map[string]interface{}, bool, error) {
+	maskPath := defaultMaskDecisionPath
+	if plugin := logs.Lookup(p.manager); plugin != nil && plugin.Config().MaskDecision != nil {
+		maskPath = *plugin.Config().MaskDecision
+	}
+
+	rs, err := p.evalLogPolicy(ctx, txn, maskPath, event)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rs) == 0 {
+		return event, false, nil
+	}
+
+	rules, ok := rs[0].Expressions[0].Value.([]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected mask rule format %v (%[1]T)", rs[0].Expressions[0].Value)
+	}
+
+	var masked bool
+	for _, rule := range rules {
+		op, path, value := "remove", "", interface{}(nil)
+		switch rule := rule.(type) {
+		case string:
+			path = rule
+		case map[string]interface{}:
+			if s, ok := rule["op"].(string); ok {
+				op = s
+			}
+			path, _ = rule["path"].(string)
+			value = rule["value"]
+		default:
+			return nil, false, fmt.Errorf("invalid mask rule format encountered: %T", rule)
+		}
+
+		parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		switch parts[0] {
+		case "input", "result", "nd_builtin_cache":
+		default:
+			continue
+		}
+		for i := range parts {
+			if _, err := url.PathUnescape(parts[i]); err != nil {
+				return nil, false, err
+			}
+			parts[i] = url.PathEscape(parts[i])
+		}
+
+		switch op {
+		case "remove":
+			maskRemove(event, parts)
+		case "upsert":
+			maskUpsert(event, parts, value)
+		default:
+			return nil, false, fmt.Errorf("mask op is not supported: %s", op)
+		}
+		masked = true
+	}
+	return event, masked, nil
+}
+
+// dropEvent reports whether the drop policy of the decision_logs plugin
+// (data.system.log.drop by default) drops event, the JSON object of a decision
+// log event.
+func (p *envoyExtAuthzGrpcServer) dropEvent(ctx context.Context, txn storage.Transaction, event map[string]interface{}) (bool, error) {
+	dropPath := defaultDropDecisionPath
+	if plugin := logs.Lookup(p.manager); plugin != nil && plugin.Config().DropDecision != nil {
+		dropPath = *plugin.Config().DropDecision
+	}
+
+	rs, err := p.evalLogPolicy(ctx, txn, dropPath, event)
+	if err != nil {
+		return false, err
+	}
+	return rs.Allowed(), nil
+}
+
+// evalLogPolicy evaluates the decision log policy at path against event.
+func (p *envoyExtAuthzGrpcServer) evalLogPolicy(ctx context.Context, txn storage.Transaction, path string, event map[string]interface{}) (rego.ResultSet, error) {
+	return rego.New(
+		rego.ParsedQuery(ast.NewBody(ast.NewExpr(ast.NewTerm(stringPathToDataRef(path))))),
+		rego.Compiler(p.manager.GetCompiler()),
+		rego.Store(p.manager.Store),
+		rego.Transaction(txn),
+		rego.Runtime(p.manager.Info),
+		rego.Input(event),
+	).Eval(ctx)
+}
+
+func maskRemove(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+
+	root := node
+	for _, key := range path[:len(path)-1] {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			node = v[key]
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return root
+			}
+			node = v[idx]
+		default:
+			return root
+		}
+	}
+
+	if object, ok := node.(map[string]interface{}); ok {
+		delete(object, path[len(path)-1])
+	}
+	return root
+}
+
+func maskUpsert(node interface{}, path []string, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return node
+	}
+
+	for _, key := range path[:len(path)-1] {
+		child, ok := object[key]
+		if !ok {
+			child = map[string]interface{}{}
+			object[key] = child
+		}
+		if object, ok = child.(map[string]interface{}); !ok {
+			return node
+		}
+	}
+	object[path[len(path)-1]] = value
+	return node
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"encoding/json"
+
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/server"
+)
+
+// decisionLogTruncation is the order in which parts of a decision log event are
+// dropped when the event exceeds max-decision-log-bytes: the request body, then
+// the request headers, then the ND builtin cache. The body and headers of
+// input.raw (include-raw-request) are dropped with those of the input.
+var decisionLogTruncation = []func(info *server.Info, input map[string]interface{}) map[string]interface{}{
+	func(_ *server.Info, input map[string]interface{}) map[string]interface{} {
+		input = withoutKeys(input, nil, "parsed_body")
+		return withoutHTTPKeys(input, "body", "raw_body", "rawBody")
+	},
+	func(_ *server.Info, input map[string]interface{}) map[string]interface{} {
+		return withoutHTTPKeys(input, "headers", "headers_original", "headerMap")
+	},
+	func(info *server.Info, input map[string]interface{}) map[string]interface{} {
+		info.NDBuiltinCache = nil
+		return input
+	},
+}
+
+// truncateDecisionLog drops parts of the decision log event info, in the order
+// of decisionLogTruncation, until its input, result and ND builtin cache
+// serialize to at most maxBytes, and then adds "truncated": true to the input.
+// The input is the one evaluated by the policy, nested under rootKey if set. It
+// is copied, not modified, as it may be cached.
+func truncateDecisionLog(info *server.Info, rootKey string, maxBytes int, logger logging.Logger) error {
+	size, err := decisionLogSize(info)
+	if err != nil || size <= maxBytes {
+		return err
+	}
+	originalSize := size
+
+	var input map[string]interface{}
+	if info.Input != nil {
+		input, _ = (*info.Input).(map[string]interface{})
+		if rootKey != "" {
+			input, _ = input[rootKey].(map[string]interface{})
+		}
+	}
+
+	steps := 0
+	for _, truncate := range decisionLogTruncation {
+		input = truncate(info, input)
+		setLoggedInput(info, rootKey, input)
+		steps++
+
+		if size, err = decisionLogSize(info); err != nil {
+			return err
+		}
+		if size <= maxBytes {
+			break
+		}
+	}
+
+	// The first step copied the input.
+	if input != nil {
+		input["truncated"] = true
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"decision-id": info.DecisionID,
+		"size":        originalSize,
+		"max-size":    maxBytes,
+		"steps":       steps,
+	}).Debug("Truncated the decision log.")
+
+	return nil
+}
+
+func setLoggedInput(info *server.Info, rootKey string, input map[string]interface{}) {
+	if input == nil {
+		return
+	}
+	var x interface{} = input
+	if rootKey != "" {
+		x = map[string]interface{}{rootKey: input}
+	}
+	info.Input = &x
+}
+
+// decisionLogSize returns the serialized size of the parts of info that depend
+// on the request.
+func decisionLogSize(info *server.Info) (int, error) {
+	bs, err := json.Marshal(struct {
+		Input          *interface{} `json:"input,omitempty"`
+		Result         *interface{} `json:"result,omitempty"`
+		NDBuiltinCache *interface{} `json:"nd_builtin_cache,omitempty"`
+	}{info.Input, info.Results, info.NDBuiltinCache})
+	return len(bs), err
+}
+
+// withoutHTTPKeys returns a copy of input without the keys of its request http
+// attributes and of those of input.raw, whose keys are the protojson names.
+func withoutHTTPKeys(input map[string]interface{}, keys ...string) map[string]interface{} {
+	path := []string{"attributes", "request", "http"}
+	input = withoutKeys(input, path, keys...)
+	if raw, ok := input["raw"].(map[string]interface{}); ok {
+		input["raw"] = withoutKeys(raw, path, keys...)
+	}
+	return input
+}
+
+// withoutKeys returns a copy of m without the keys of the object at path. The
+// objects along the path are copied, the others are shared with m.
+func withoutKeys(m map[string]interface{}, path []string, keys ...string) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	if len(path) > 0 {
+		if child, ok := c[path[0]].(map[string]interface{}); ok {
+			c[path[0]] = withoutKeys(child, path[1:], keys...)
+		}
+		return c
+	}
+
+	for _, k := range keys {
+		delete(c, k)
+	}
+	return c
+}
@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	_structpb "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// decisionMetadata converts a decision for the dynamic metadata of the
+// response. The decision is converted through JSON, which also bounds its size:
+// decisions serializing to more than maxBytes are rejected.
+func decisionMetadata(decision interface{}, maxBytes int) (*_structpb.Value, error) {
+	bs, err := json.Marshal(decision)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && len(bs) > maxBytes {
+		return nil, fmt.Errorf("decision size %d exceeds decision-metadata-max-size %d", len(bs), maxBytes)
+	}
+
+	var v _structpb.Value
+	if err := protojson.Unmarshal(bs, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+
+	"github.com/open-policy-agent/opa/logging"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+)
+
+// Levels accepted by decision-log-console-level. An empty value disables the
+// decision summary log.
+var decisionSummaryLevels = map[string]logging.Level{
+	"debug": logging.Debug,
+	"info":  logging.Info,
+	"warn":  logging.Warn,
+	"error": logging.Error,
+}
+
+// logDecisionSummary writes one access-style line per check. The field names are
+// part of the plugin's interface, as operators parse them; do not rename them.
+func (p *envoyExtAuthzGrpcServer) logDecisionSummary(cfg *Config, req interface{}, result *envoyauth.EvalResult, internalErr Error, durationMs float64) {
+	level, ok := decisionSummaryLevels[cfg.DecisionLogConsoleLevel]
+	if !ok {
+		return
+	}
+
+	logger := p.Logger()
+	if logger.GetLevel() < level {
+		return
+	}
+
+	method, path, source := requestSummary(req)
+	fields := map[string]interface{}{
+		"decision-id":    result.DecisionID,
+		"dry-run":        cfg.dryRun(req),
+		"method":         method,
+		"path":           path,
+		"source-address": source,
+		"duration-ms":    durationMs,
+	}
+
+	if internalErr.Code != "" {
+		fields["allowed"] = false
+		fields["error"] = internalErr.Code
+		fields["error-category"] = internalErr.Category().Error()
+	} else {
+		allowed, _ := result.IsAllowed()
+		fields["allowed"] = allowed
+	}
+
+	if result.Undefined {
+		fields["decision"] = "undefined"
+	}
+
+	if len(cfg.DecisionLogLabels) > 0 {
+		fields["labels"] = cfg.DecisionLogLabels
+	}
+
+	logger = logger.WithFields(fields)
+	const msg = "Authorization decision."
+	switch level {
+	case logging.Debug:
+		logger.Debug(msg)
+	case logging.Info:
+		logger.Info(msg)
+	case logging.Warn:
+		logger.Warn(msg)
+	default:
+		logger.Error(msg)
+	}
+}
+
+// requestSummary returns the HTTP method and path, and the source address of a
+// v2 or v3 CheckRequest.
+func requestSummary(req interface{}) (string, string, string) {
+	switch req := req.(type) {
+	case *ext_authz_v3.CheckRequest:
+		http := req.GetAttributes().GetRequest().GetHttp()
+		return http.GetMethod(), http.GetPath(), req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress()
+	case *ext_authz_v2.CheckRequest:
+		http := req.GetAttributes().GetRequest().GetHttp()
+		return http.GetMethod(), http.GetPath(), req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress()
+	}
+	return "", "", ""
+}
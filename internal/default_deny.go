@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	ext_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	ext_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// defaultDeniedResponse returns the HTTP response for requests denied by a
+// boolean decision, or nil if neither default-deny-status nor
+// default-deny-body is set. Without default-deny-content-type, the content
+// type is inferred from the body.
+func (cfg *Config) defaultDeniedResponse() *ext_authz_v3.DeniedHttpResponse {
+	if cfg.DefaultDenyStatus == 0 && cfg.DefaultDenyBody == "" {
+		return nil
+	}
+
+	code := ext_type_v3.StatusCode_Forbidden
+	if cfg.DefaultDenyStatus != 0 {
+		code = ext_type_v3.StatusCode(cfg.DefaultDenyStatus)
+	}
+	resp := &ext_authz_v3.DeniedHttpResponse{
+		Status: &ext_type_v3.HttpStatus{Code: code},
+		Body:   cfg.DefaultDenyBody,
+	}
+
+	contentType := cfg.DefaultDenyContentType
+	if contentType == "" && cfg.DefaultDenyBody != "" {
+		contentType = inferContentType(cfg.DefaultDenyBody)
+	}
+	if contentType != "" {
+		resp.Headers = []*ext_core_v3.HeaderValueOption{
+			{Header: &ext_core_v3.HeaderValue{Key: "Content-Type", Value: contentType}},
+		}
+	}
+
+	return resp
+}
+
+func inferContentType(body string) string {
+	trimmed := strings.TrimSpace(body)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "application/json"
+	}
+	return http.DetectContentType([]byte(body))
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of grpc-request-duration-metric.
+const (
+	durationMetricHistogram = "histogram"
+	durationMetricSummary   = "summary"
+	durationMetricBoth      = "both"
+)
+
+// defaultGRPCRequestDurationObjectives are the quantiles of the
+// grpc_request_duration_summary_seconds summary, with their allowed error.
+var defaultGRPCRequestDurationObjectives = map[float64]float64{
+	0.5:  0.05,
+	0.9:  0.01,
+	0.99: 0.001,
+}
+
+// validateGRPCRequestDurationMetric checks the type of the authz duration
+// metric and parses the objectives of its summary.
+func (cfg *Config) validateGRPCRequestDurationMetric() error {
+	switch cfg.GRPCRequestDurationMetric {
+	case "":
+		cfg.GRPCRequestDurationMetric = durationMetricHistogram
+	case durationMetricHistogram, durationMetricSummary, durationMetricBoth:
+	default:
+		return fmt.Errorf("invalid config: grpc-request-duration-metric must be one of %q, %q or %q", durationMetricHistogram, durationMetricSummary, durationMetricBoth)
+	}
+
+	if len(cfg.GRPCRequestDurationSecondsObjectives) == 0 {
+		cfg.grpcRequestDurationObjectives = defaultGRPCRequestDurationObjectives
+		return nil
+	}
+
+	cfg.grpcRequestDurationObjectives = make(map[float64]float64, len(cfg.GRPCRequestDurationSecondsObjectives))
+	for q, e := range cfg.GRPCRequestDurationSecondsObjectives {
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil || quantile <= 0 || quantile >= 1 {
+			return fmt.Errorf("invalid config: grpc-request-duration-seconds-objectives keys must be quantiles between 0 and 1: %q", q)
+		}
+		if e <= 0 || e >= 1 {
+			return fmt.Errorf("invalid config: grpc-request-duration-seconds-objectives errors must be between 0 and 1: %v", e)
+		}
+		cfg.grpcRequestDurationObjectives[quantile] = e
+	}
+	return nil
+}
+
+// durationHistogram reports whether the authz duration is exported as a
+// histogram, and durationSummary as a summary. Without validation, e.g. in
+// programs embedding the plugin, it is a histogram.
+func (cfg *Config) durationHistogram() bool {
+	return cfg.GRPCRequestDurationMetric != durationMetricSummary
+}
+
+func (cfg *Config) durationSummary() bool {
+	return cfg.GRPCRequestDurationMetric == durationMetricSummary || cfg.GRPCRequestDurationMetric == durationMetricBoth
+}
+
+// newAuthzDurationSummary returns the summary of the authz duration, which
+// computes the quantiles of the objectives in the plugin. Its quantiles cannot
+// be aggregated across instances, unlike the buckets of the histogram.
+func newAuthzDurationSummary(objectives map[float64]float64) *prometheus.SummaryVec {
+	if objectives == nil {
+		objectives = defaultGRPCRequestDurationObjectives
+	}
+	return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "grpc_request_duration_summary_seconds",
+		Help:       "A summary of duration for grpc authz requests.",
+		Objectives: objectives,
+	}, []string{"handler"})
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnv expands the ${NAME} references to environment variables of the
+// options holding secrets and file paths, e.g. so that the configuration of a
+// discovery bundle does not contain them. OPA only expands the references of
+// its local configuration file, replacing unset variables with empty strings.
+func (cfg *Config) expandEnv() error {
+	for _, field := range []struct {
+		option string
+		value  *string
+	}{
+		{"peer-auth-token", &cfg.PeerAuthToken},
+		{"explain-secret", &cfg.ExplainSecret},
+		{"grpc-tls-cert-file", &cfg.GRPCTLSCertFile},
+		{"grpc-tls-key-file", &cfg.GRPCTLSKeyFile},
+		{"jwks-url", &cfg.JWKSURL},
+		{"proto-descriptor", &cfg.ProtoDescriptor},
+		{"decision-log-file", &cfg.DecisionLogFile},
+	} {
+		v, err := expandEnvReferences(*field.value)
+		if err != nil {
+			return fmt.Errorf("invalid config: %s: %w", field.option, err)
+		}
+		*field.value = v
+	}
+	return nil
+}
+
+// expandEnvReferences replaces the ${NAME} references of s with the value of
+// the environment variable NAME, which must be set. "$${" is a literal "${".
+func expandEnvReferences(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated environment variable reference")
+		}
+		name := s[i+2 : i+2+end]
+		if !envVarName.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable name %q", name)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		b.WriteString(s[:i])
+		b.WriteString(value)
+		s = s[i+3+end:]
+	}
+}
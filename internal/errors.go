@@ -3,6 +3,11 @@ package internal
 import (
 	"errors"
 	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/open-policy-agent/opa/storage"
 )
 
 // Error is the error type returned by the internal check function
@@ -19,6 +24,15 @@ const (
 	// StartTxnErr error code returned when unable to start new storage transaction
 	StartTxnErr string = "start_txn_error"
 
+	// BundleNotActivatedErr error code returned when a request is received before the bundles have been activated
+	BundleNotActivatedErr string = "bundle_not_activated"
+
+	// CircuitOpenErr error code returned when a request is received while the circuit breaker is open
+	CircuitOpenErr string = "circuit_open"
+
+	// EvalQueueFullErr error code returned when the eval-workers are busy and their queue is full
+	EvalQueueFullErr string = "eval_queue_full"
+
 	// RequestParseErr error code returned when unable to parse protobuf request to input map
 	RequestParseErr string = "request_parse_error"
 
@@ -28,15 +42,83 @@ const (
 	// InputParseErr error code returned when unable to convert input map to ast value
 	InputParseErr string = "input_parse_error"
 
+	// InputEnrichmentErr error code returned when unable to read the input-enrichment data from the store
+	InputEnrichmentErr string = "input_enrichment_error"
+
+	// DataOverlayErr error code returned when unable to read the data-overlay data from the store
+	DataOverlayErr string = "data_overlay_error"
+
 	// EnvoyAuthEvalErr error code returned when auth eval fails
 	EnvoyAuthEvalErr string = "envoyauth_eval_error"
 
+	// EvalTimeoutErr error code returned when policy evaluation exceeds the eval-timeout
+	EvalTimeoutErr string = "eval_timeout"
+
 	// EnvoyAuthResultErr error code returned when error in fetching result from auth eval
 	EnvoyAuthResultErr string = "envoyauth_result_error"
 )
 
+// Error categories group the error codes by the stage of the check that failed,
+// e.g. to alert differently on bad requests and on infrastructure errors. An
+// internal error matches its category with errors.Is.
+var (
+	// ErrInternal is the category of errors unrelated to the request or the policy
+	ErrInternal = errors.New("internal")
+
+	// ErrUnavailable is the category of errors returned before the plugin is ready,
+	// while the circuit breaker is open or while the eval-workers are saturated
+	ErrUnavailable = errors.New("unavailable")
+
+	// ErrBodyParse is the category of errors building the input from the request
+	ErrBodyParse = errors.New("request_parse")
+
+	// ErrStorageTxn is the category of storage errors
+	ErrStorageTxn = errors.New("storage")
+
+	// ErrEval is the category of policy evaluation errors
+	ErrEval = errors.New("eval")
+
+	// ErrResponseShape is the category of errors caused by a decision that does not match the expected structure
+	ErrResponseShape = errors.New("response_shape")
+)
+
+// Category returns the category of the error, one of the Err* category errors.
+func (e *Error) Category() error {
+	switch e.Code {
+	case StartTxnErr, InputEnrichmentErr, DataOverlayErr:
+		return ErrStorageTxn
+	case BundleNotActivatedErr, CircuitOpenErr, EvalQueueFullErr:
+		return ErrUnavailable
+	case RequestParseErr, InputParseErr:
+		return ErrBodyParse
+	case CheckRequestTimeoutErr, EvalTimeoutErr:
+		return ErrEval
+	case EnvoyAuthEvalErr:
+		var storageErr *storage.Error
+		if errors.As(e.Unwrap(), &storageErr) {
+			return ErrStorageTxn
+		}
+		return ErrEval
+	case EnvoyAuthResultErr:
+		return ErrResponseShape
+	}
+	return ErrInternal
+}
+
+// grpcError returns the error to return to the gRPC client. Storage errors are
+// reported as UNAVAILABLE, which clients may retry.
+func (e *Error) grpcError() error {
+	if e.Category() == ErrStorageTxn {
+		return status.Error(codes.Unavailable, e.Unwrap().Error())
+	}
+	return e.Unwrap()
+}
+
 // Is allows matching internal errors using errors.Is
 func (e *Error) Is(target error) bool {
+	if target == e.Category() {
+		return true
+	}
 	var t *Error
 	if errors.As(target, &t) {
 		return (t.Code == "" || e.Code == t.Code) && errors.Is(e.Unwrap(), t.Unwrap())
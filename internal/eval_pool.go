@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errEvalQueueFull is returned by evalPool.Run when all the workers are busy
+// and the queue is full.
+var errEvalQueueFull = status.Error(codes.ResourceExhausted, "policy evaluation queue is full")
+
+// errEvalPoolClosed is returned by evalPool.Run once the plugin is stopped.
+var errEvalPoolClosed = status.Error(codes.Unavailable, "policy evaluation pool is closed")
+
+// validateEvalPool checks the eval-workers and eval-queue-size options and
+// sets their defaults.
+func (cfg *Config) validateEvalPool() error {
+	if cfg.EvalWorkers < 0 {
+		return fmt.Errorf("invalid config: eval-workers must be a non-negative integer")
+	}
+	if cfg.EvalQueueSize < 0 {
+		return fmt.Errorf("invalid config: eval-queue-size must be a non-negative integer")
+	}
+	if cfg.EvalQueueSize > 0 && cfg.EvalWorkers == 0 {
+		return fmt.Errorf("invalid config: eval-queue-size requires eval-workers")
+	}
+	if cfg.EvalQueueSize == 0 {
+		cfg.EvalQueueSize = cfg.EvalWorkers
+	}
+	return nil
+}
+
+const (
+	evalTaskQueued = iota
+	evalTaskRunning
+	evalTaskCancelled
+)
+
+// evalTask is an evaluation waiting in the queue of an evalPool. The worker
+// that dequeues it and the check waiting for it race to move it out of the
+// queued state: a task cancelled by its check is never run.
+type evalTask struct {
+	fn    func() error
+	state atomic.Int32
+	done  chan error
+}
+
+// evalPool evaluates the policy on a fixed number of workers instead of the
+// goroutines of the gRPC requests, which bounds the evaluations running at
+// once, e.g. to GOMAXPROCS. Evaluations wait in a queue of bounded size for a
+// free worker: a check that finds the queue full is rejected rather than
+// waiting, so that Envoy can fail over instead of piling up requests.
+type evalPool struct {
+	tasks  chan *evalTask
+	queued atomic.Int64
+	quit   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	// Set by registerMetrics when performance metrics are enabled.
+	rejected prometheus.Counter
+}
+
+func newEvalPool(workers, queueSize int) *evalPool {
+	ep := &evalPool{
+		tasks: make(chan *evalTask, queueSize),
+		quit:  make(chan struct{}),
+	}
+	ep.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go ep.work()
+	}
+	return ep
+}
+
+func (ep *evalPool) work() {
+	defer ep.wg.Done()
+	for {
+		select {
+		case t := <-ep.tasks:
+			if ep.dequeue(t, evalTaskRunning) {
+				t.done <- t.fn()
+			}
+		case <-ep.quit:
+			return
+		}
+	}
+}
+
+// Run evaluates fn on a worker and returns its error. It returns
+// errEvalQueueFull without running fn if the queue is full, and ctx's error if
+// ctx is done before a worker is free. Once fn has started, Run waits for it:
+// fn is expected to honour ctx.
+func (ep *evalPool) Run(ctx context.Context, fn func() error) error {
+	t := &evalTask{fn: fn, done: make(chan error, 1)}
+
+	select {
+	case <-ep.quit:
+		return errEvalPoolClosed
+	default:
+	}
+
+	ep.queued.Add(1)
+	select {
+	case ep.tasks <- t:
+	default:
+		ep.queued.Add(-1)
+		if ep.rejected != nil {
+			ep.rejected.Inc()
+		}
+		return errEvalQueueFull
+	}
+
+	select {
+	case err := <-t.done:
+		return err
+	case <-ctx.Done():
+		if ep.dequeue(t, evalTaskCancelled) {
+			return ctx.Err()
+		}
+	case <-ep.quit:
+		if ep.dequeue(t, evalTaskCancelled) {
+			return errEvalPoolClosed
+		}
+	}
+	return <-t.done
+}
+
+// dequeue moves t out of the queued state, and returns false if a worker or
+// its check already did. A cancelled task keeps its slot in the queue until a
+// worker skips it.
+func (ep *evalPool) dequeue(t *evalTask, state int32) bool {
+	if !t.state.CompareAndSwap(evalTaskQueued, state) {
+		return false
+	}
+	ep.queued.Add(-1)
+	return true
+}
+
+// Close stops the workers once their current evaluation is done. Queued
+// evaluations are cancelled.
+func (ep *evalPool) Close() {
+	ep.once.Do(func() { close(ep.quit) })
+	ep.wg.Wait()
+}
+
+// registerMetrics creates the evaluation pool metrics and registers them with
+// reg.
+func (ep *evalPool) registerMetrics(reg prometheus.Registerer) {
+	ep.rejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "eval_pool_rejected_checks",
+		Help: "A counter for check requests rejected because the evaluation queue was full",
+	})
+	queued := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eval_pool_queued_checks",
+		Help: "The number of check requests waiting for an evaluation worker",
+	}, func() float64 { return float64(ep.queued.Load()) })
+
+	reg.MustRegister(ep.rejected, queued)
+}
+
+// evalRejected reports whether err is the rejection of a full evaluation queue
+// or of a closed pool, which is not an error of the policy.
+func evalRejected(err error) bool {
+	return errors.Is(err, errEvalQueueFull) || errors.Is(err, errEvalPoolClosed)
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// maxExplanationBytes limits the size of the explanation of a decision. Traces
+// of policies with many rules easily reach megabytes.
+const maxExplanationBytes = 64 << 10
+
+// explainRequested reports whether req carries the explain-header with the
+// explain-secret.
+func explainRequested(cfg *Config, req interface{}) bool {
+	if cfg.ExplainHeader == "" {
+		return false
+	}
+	value, ok := requestHeader(req, cfg.ExplainHeader)
+	return ok && subtle.ConstantTimeCompare([]byte(value), []byte(cfg.ExplainSecret)) == 1
+}
+
+// explanation formats the trace of the evaluation like `opa eval --explain
+// full`, truncated after maxBytes at a line boundary.
+func explanation(trace []*topdown.Event, maxBytes int) string {
+	var buf bytes.Buffer
+	topdown.PrettyTraceWithLocation(&buf, trace)
+	if buf.Len() <= maxBytes {
+		return buf.String()
+	}
+
+	s := buf.String()[:maxBytes]
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[:i+1]
+	}
+	return s + fmt.Sprintf("... (truncated, %d bytes)\n", buf.Len())
+}
+
+// removeRequestHeader removes the (lowercase) header name from the request
+// headers of the input, including the original and raw headers, so that the
+// explain-secret never reaches the policy or the decision log.
+func removeRequestHeader(input map[string]interface{}, name string) {
+	remove := func(headers interface{}) {
+		h, ok := headers.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for k := range h {
+			if strings.EqualFold(k, name) {
+				delete(h, k)
+			}
+		}
+	}
+
+	for _, doc := range []interface{}{input, input["raw"]} {
+		d, ok := doc.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		attributes, _ := d["attributes"].(map[string]interface{})
+		request, _ := attributes["request"].(map[string]interface{})
+		http, _ := request["http"].(map[string]interface{})
+		remove(http["headers"])
+		remove(http["headers_original"])
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// grpcMethodQuery is the query of a path of grpc-method-paths.
+type grpcMethodQuery struct {
+	path  string
+	query *additionalQuery
+}
+
+// parseGRPCMethodPaths prepares the queries of grpc-method-paths, keyed by
+// "package.Service/Method" or "package.Service/*".
+func (cfg *Config) parseGRPCMethodPaths() error {
+	cfg.grpcMethodQueries = nil
+	for method, path := range cfg.GRPCMethodPaths {
+		key := strings.TrimPrefix(method, "/")
+		service, name, ok := strings.Cut(key, "/")
+		if !ok || service == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid config: grpc-method-paths keys must be \"package.Service/Method\" or \"package.Service/*\": %q", method)
+		}
+		if path == "" {
+			return fmt.Errorf("invalid config: grpc-method-paths must not contain empty paths")
+		}
+
+		q, err := newAdditionalQuery(path)
+		if err != nil {
+			return err
+		}
+		if cfg.grpcMethodQueries == nil {
+			cfg.grpcMethodQueries = map[string]*grpcMethodQuery{}
+		}
+		cfg.grpcMethodQueries[key] = &grpcMethodQuery{path: path, query: q}
+	}
+	return nil
+}
+
+// grpcMethodQuery returns the query of grpc-method-paths for the gRPC method
+// of req, whose path is "/package.Service/Method". An exact method wins over
+// the "package.Service/*" wildcard of its service.
+func (cfg *Config) grpcMethodQuery(req interface{}) (*grpcMethodQuery, bool) {
+	if len(cfg.grpcMethodQueries) == 0 {
+		return nil, false
+	}
+
+	contentType, ok := requestHeader(req, "content-type")
+	if !ok || !strings.HasPrefix(contentType, "application/grpc") {
+		return nil, false
+	}
+
+	_, path, _ := requestSummary(req)
+	key := strings.TrimPrefix(path, "/")
+	if q, ok := cfg.grpcMethodQueries[key]; ok {
+		return q, true
+	}
+
+	service, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return nil, false
+	}
+	q, ok := cfg.grpcMethodQueries[service+"/*"]
+	return q, ok
+}
+
+func sameGRPCMethodQueries(a, b map[string]*grpcMethodQuery) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, q := range a {
+		other, ok := b[key]
+		if !ok || q.path != other.path || !sameQuery(q.query, other.query) {
+			return false
+		}
+	}
+	return true
+}
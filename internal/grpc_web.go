@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	grpcWebCheckPath   = "/envoy.service.auth.v3.Authorization/Check"
+	grpcWebContentType = "application/grpc-web"
+	grpcWebTextType    = "application/grpc-web-text"
+
+	// Frame flags of the gRPC-Web wire format.
+	grpcWebDataFrame    = 0x00
+	grpcWebTrailerFrame = 0x80
+)
+
+// grpcWebHandler serves the v3 Check method with the gRPC-Web protocol, in the
+// binary (application/grpc-web) and base64 (application/grpc-web-text)
+// variants, for browser-based tools and curl. Only uncompressed messages are
+// supported.
+type grpcWebHandler struct {
+	p *envoyExtAuthzGrpcServer
+}
+
+func (h grpcWebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := h.p.config()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		allowHeaders := "content-type, x-grpc-web, x-user-agent, grpc-timeout"
+		if cfg.PeerAuthToken != "" {
+			allowHeaders += ", " + cfg.PeerAuthMetadataKey
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodPost || r.URL.Path != grpcWebCheckPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextType)
+	if !text && !strings.HasPrefix(contentType, grpcWebContentType) {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	respContentType := grpcWebContentType + "+proto"
+	if text {
+		respContentType = grpcWebTextType + "+proto"
+	}
+	w.Header().Set("Content-Type", respContentType)
+	w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+
+	resp, err := h.check(r, cfg, text)
+
+	var out bytes.Buffer
+	if err == nil {
+		var bs []byte
+		if bs, err = proto.Marshal(resp); err == nil {
+			writeGRPCWebFrame(&out, grpcWebDataFrame, bs)
+		}
+	}
+
+	st := status.Convert(err)
+	trailer := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", st.Code(), st.Message())
+	writeGRPCWebFrame(&out, grpcWebTrailerFrame, []byte(trailer))
+
+	body := out.Bytes()
+	if text {
+		body = []byte(base64.StdEncoding.EncodeToString(body))
+	}
+	_, _ = w.Write(body)
+}
+
+func (h grpcWebHandler) check(r *http.Request, cfg *Config, text bool) (*ext_authz_v3.CheckResponse, error) {
+	ctx := metadata.NewIncomingContext(r.Context(), headerMetadata(r.Header))
+	if cfg.PeerAuthToken != "" {
+		auth := peerAuthenticator{key: cfg.PeerAuthMetadataKey, token: cfg.PeerAuthToken}
+		if err := auth.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	maxSize := cfg.grpcMaxRecvMsgSize()
+	var body io.Reader = io.LimitReader(r.Body, int64(maxSize)+5)
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	msg, err := readGRPCWebFrame(body, maxSize)
+	if err != nil {
+		if size, limit, ok := oversizedMessage(err); ok {
+			h.p.logOversizedMessage(ctx, r.URL.Path, size, limit, cfg.grpcMaxRecvMsgSizeOption(), false)
+		}
+		return nil, err
+	}
+
+	var req ext_authz_v3.CheckRequest
+	if err := proto.Unmarshal(msg, &req); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to unmarshal check request: %v", err)
+	}
+
+	return h.p.Check(ctx, &req)
+}
+
+func readGRPCWebFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to read message prefix: %v", err)
+	}
+	if prefix[0] != grpcWebDataFrame {
+		return nil, status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > int64(maxSize) {
+		return nil, status.Errorf(codes.ResourceExhausted, "message larger than max (%d vs. %d)", size, maxSize)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to read message: %v", err)
+	}
+	return msg, nil
+}
+
+func writeGRPCWebFrame(w *bytes.Buffer, flag byte, msg []byte) {
+	var prefix [5]byte
+	prefix[0] = flag
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	w.Write(prefix[:])
+	w.Write(msg)
+}
+
+// headerMetadata converts HTTP headers to the incoming gRPC metadata seen by
+// Check, e.g. for the peer-auth-token.
+func headerMetadata(header http.Header) metadata.MD {
+	md := make(metadata.MD, len(header))
+	for k, v := range header {
+		md.Append(strings.ToLower(k), v...)
+	}
+	return md
+}
+
+func (p *envoyExtAuthzGrpcServer) listenGRPCWeb() {
+	logger := p.Logger()
+	logger.WithFields(map[string]interface{}{"addr": p.grpcWebServer.Addr}).Info("Starting gRPC-Web server.")
+
+	if err := p.grpcWebServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("gRPC-Web listener failed.")
+	}
+}
+
+func (p *envoyExtAuthzGrpcServer) stopGRPCWeb(ctx context.Context) {
+	if p.grpcWebServer != nil {
+		_ = p.grpcWebServer.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Strategies of decision-log-header-transforms, besides "first-<n>-chars".
+const (
+	headerTransformRedact     = "redact"
+	headerTransformHashSHA256 = "hash-sha256"
+)
+
+// redactedHeaderValue replaces the values of the headers transformed with
+// headerTransformRedact.
+const redactedHeaderValue = "[redacted]"
+
+var headerTransformFirstChars = regexp.MustCompile(`^first-([1-9][0-9]*)-chars$`)
+
+// headerTransform transforms the value of a request header in the decision log.
+type headerTransform func(value string) string
+
+// validateHeaderLogTransforms checks the decision-log-header-transforms and
+// parses their strategies.
+func (cfg *Config) validateHeaderLogTransforms() error {
+	if len(cfg.DecisionLogHeaderTransforms) == 0 {
+		cfg.headerLogTransforms = nil
+		return nil
+	}
+
+	cfg.headerLogTransforms = make(map[string]headerTransform, len(cfg.DecisionLogHeaderTransforms))
+	for name, strategy := range cfg.DecisionLogHeaderTransforms {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("invalid config: decision-log-header-transforms keys must be header names")
+		}
+		t, err := parseHeaderTransform(strategy)
+		if err != nil {
+			return fmt.Errorf("invalid config: decision-log-header-transforms: %q: %w", name, err)
+		}
+		cfg.headerLogTransforms[strings.ToLower(name)] = t
+	}
+	return nil
+}
+
+func parseHeaderTransform(strategy string) (headerTransform, error) {
+	switch strategy {
+	case headerTransformRedact:
+		return func(string) string { return redactedHeaderValue }, nil
+	case headerTransformHashSHA256:
+		return func(value string) string {
+			sum := sha256.Sum256([]byte(value))
+			return hex.EncodeToString(sum[:])
+		}, nil
+	}
+
+	m := headerTransformFirstChars.FindStringSubmatch(strategy)
+	if m == nil {
+		return nil, fmt.Errorf("strategy must be one of %q, %q or \"first-<n>-chars\": %q", headerTransformRedact, headerTransformHashSHA256, strategy)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return nil, err
+	}
+	// A value of at most n characters would be logged whole.
+	return func(value string) string {
+		runes := []rune(value)
+		if len(runes) <= n {
+			return redactedHeaderValue
+		}
+		return string(runes[:n])
+	}, nil
+}
+
+// transformLoggedHeaders returns a copy of input whose request headers,
+// including the original and raw headers, are transformed by the transform of
+// their (lowercase) name. input is not modified, as the policy evaluates it and
+// it may be cached.
+func transformLoggedHeaders(input map[string]interface{}, transforms map[string]headerTransform) map[string]interface{} {
+	c := transformRequestHeaders(input, transforms)
+	if raw, ok := c["raw"].(map[string]interface{}); ok {
+		c["raw"] = transformRequestHeaders(raw, transforms)
+	}
+	return c
+}
+
+// transformRequestHeaders returns a copy of doc with the headers at
+// attributes.request.http transformed. The objects along the path are copied,
+// the others are shared with doc.
+func transformRequestHeaders(doc map[string]interface{}, transforms map[string]headerTransform) map[string]interface{} {
+	c := copyObject(doc)
+	attributes, ok := c["attributes"].(map[string]interface{})
+	if !ok {
+		return c
+	}
+	attributes = copyObject(attributes)
+	c["attributes"] = attributes
+	request, ok := attributes["request"].(map[string]interface{})
+	if !ok {
+		return c
+	}
+	request = copyObject(request)
+	attributes["request"] = request
+	http, ok := request["http"].(map[string]interface{})
+	if !ok {
+		return c
+	}
+	http = copyObject(http)
+	request["http"] = http
+
+	for _, key := range []string{"headers", "headers_original"} {
+		headers, ok := http[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		headers = copyObject(headers)
+		for name, value := range headers {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			if t, ok := transforms[strings.ToLower(name)]; ok {
+				headers[name] = t(s)
+			}
+		}
+		http[key] = headers
+	}
+	return c
+}
+
+func copyObject(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// inputKey is the SHA-256 digest of a CheckRequest, collision-resistant so
+// that a request is never given the input of another request.
+type inputKey [sha256.Size]byte
+
+// inputCache is a fixed size LRU cache of the input built for a CheckRequest.
+// The input only depends on the request and the plugin configuration, so the
+// entries stay valid across policy updates. The cache is purged when the proto
+// descriptor used to parse gRPC bodies is reloaded.
+type inputCache struct {
+	mtx     sync.Mutex
+	size    int
+	entries map[inputKey]*list.Element
+	lru     *list.List
+
+	// Set by registerMetrics when performance metrics are enabled.
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+}
+
+type inputCacheEntry struct {
+	key   inputKey
+	input map[string]interface{}
+	value ast.Value
+}
+
+func newInputCache(size int) *inputCache {
+	return &inputCache{
+		size:    size,
+		entries: make(map[inputKey]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the input and its converted value cached for key. The returned
+// values are shared and must not be modified.
+func (c *inputCache) Get(key inputKey) (map[string]interface{}, ast.Value, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		if c.misses != nil {
+			c.misses.Inc()
+		}
+		return nil, nil, false
+	}
+	if c.hits != nil {
+		c.hits.Inc()
+	}
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*inputCacheEntry)
+	return entry.input, entry.value, true
+}
+
+// Add inserts the input for key, evicting the least recently used entry if the
+// cache is full.
+func (c *inputCache) Add(key inputKey, input map[string]interface{}, value ast.Value) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&inputCacheEntry{key: key, input: input, value: value})
+
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*inputCacheEntry).key)
+		if c.evictions != nil {
+			c.evictions.Inc()
+		}
+	}
+}
+
+// withoutVolatileAttributes clears the attributes Envoy sets anew for every
+// request, attributes.request.time and attributes.request.http.id, until the
+// returned function restores them. Identical requests then share an input
+// cache entry, and their input has neither attribute.
+func withoutVolatileAttributes(req interface{}) (restore func()) {
+	switch req := req.(type) {
+	case *ext_authz_v3.CheckRequest:
+		r := req.GetAttributes().GetRequest()
+		if r == nil {
+			break
+		}
+		t := r.Time
+		r.Time = nil
+		var id string
+		if h := r.GetHttp(); h != nil {
+			id, h.Id = h.Id, ""
+		}
+		return func() {
+			r.Time = t
+			if h := r.GetHttp(); h != nil {
+				h.Id = id
+			}
+		}
+	case *ext_authz_v2.CheckRequest:
+		r := req.GetAttributes().GetRequest()
+		if r == nil {
+			break
+		}
+		t := r.Time
+		r.Time = nil
+		var id string
+		if h := r.GetHttp(); h != nil {
+			id, h.Id = h.Id, ""
+		}
+		return func() {
+			r.Time = t
+			if h := r.GetHttp(); h != nil {
+				h.Id = id
+			}
+		}
+	}
+	return func() {}
+}
+
+// Len returns the number of cached entries.
+func (c *inputCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.lru.Len()
+}
+
+// registerMetrics creates the cache metrics and registers them with reg. The
+// hit rate is rate(input_cache_hits) / (rate(input_cache_hits) + rate(input_cache_misses)).
+func (c *inputCache) registerMetrics(reg prometheus.Registerer) {
+	c.hits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "input_cache_hits",
+		Help: "A counter for check requests whose input was found in the input cache",
+	})
+	c.misses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "input_cache_misses",
+		Help: "A counter for check requests whose input was not found in the input cache",
+	})
+	c.evictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "input_cache_evictions",
+		Help: "A counter for entries evicted from the input cache to make room for new ones",
+	})
+	entries := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "input_cache_entries",
+		Help: "The number of entries in the input cache",
+	}, func() float64 { return float64(c.Len()) })
+
+	reg.MustRegister(c.hits, c.misses, c.evictions, entries)
+}
+
+// Purge removes all entries from the cache.
+func (c *inputCache) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.entries = make(map[inputKey]*list.Element, c.size)
+	c.lru.Init()
+}
+
+// inputCacheKey hashes the deterministic protobuf encoding of a v2 or v3
+// CheckRequest, which must not have its volatile attributes.
+func inputCacheKey(req interface{}) (inputKey, error) {
+	var msg proto.Message
+	var version byte
+
+	switch req := req.(type) {
+	case *ext_authz_v3.CheckRequest:
+		msg, version = req, 3
+	case *ext_authz_v2.CheckRequest:
+		msg, version = req, 2
+	}
+
+	bs, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return inputKey{}, err
+	}
+
+	h := sha256.New()
+	_, _ = h.Write([]byte{version})
+	_, _ = h.Write(bs)
+
+	var key inputKey
+	h.Sum(key[:0])
+	return key, nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// InputEnrichment adds the fields of an object of the store to the input. The
+// object is looked up at data.<Path>.<key>, where key is the string found in
+// the input at Key, e.g. "attributes/source/principal". Fields already in the
+// input are never replaced: the input built from the request wins over the
+// enrichments, and earlier enrichments win over later ones.
+type InputEnrichment struct {
+	Path string `json:"path"`
+	Key  string `json:"key"`
+
+	path storage.Path
+	key  []string
+}
+
+func (e *InputEnrichment) parse() error {
+	path, key, err := parseStoreLookup("input-enrichment", e.Path, e.Key)
+	if err != nil {
+		return err
+	}
+	e.path, e.key = path, key
+	return nil
+}
+
+// parseStoreLookup parses the data path and the input key of an option looking
+// up objects of the store by a request attribute.
+func parseStoreLookup(option, path, key string) (storage.Path, []string, error) {
+	parsed, ok := storage.ParsePathEscaped("/" + strings.Trim(path, "/"))
+	if !ok || strings.Trim(path, "/") == "" {
+		return nil, nil, fmt.Errorf("invalid config: %s path must be a non-empty data path: %q", option, path)
+	}
+	if strings.Trim(key, "/") == "" {
+		return nil, nil, fmt.Errorf("invalid config: %s key must be a non-empty input path: %q", option, key)
+	}
+	return parsed, strings.Split(strings.Trim(key, "/"), "/"), nil
+}
+
+// lookupInputString returns the non-empty string in input at the key path.
+func lookupInputString(input map[string]interface{}, key []string) (string, bool) {
+	var v interface{} = input
+	for _, k := range key {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[k]; !ok {
+			return "", false
+		}
+	}
+	s, ok := v.(string)
+	return s, ok && s != ""
+}
+
+// inputEnrichmentFields returns the fields the input-enrichment entries add to
+// input. Entries without a key in the input or without an object in the store
+// add nothing.
+func inputEnrichmentFields(ctx context.Context, store storage.Store, txn storage.Transaction, enrichments []InputEnrichment, input map[string]interface{}, logger logging.Logger) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	for i := range enrichments {
+		e := &enrichments[i]
+		key, ok := lookupInputString(input, e.key)
+		if !ok {
+			continue
+		}
+
+		path := append(append(storage.Path{}, e.path...), key)
+		v, err := store.Read(ctx, txn, path)
+		if storage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			logger.WithFields(map[string]interface{}{"path": path.String()}).Debug("Input enrichment is not an object, ignoring it.")
+			continue
+		}
+
+		for k, x := range obj {
+			if _, found := input[k]; found {
+				logger.WithFields(map[string]interface{}{"path": path.String(), "field": k}).Debug("Input enrichment field is already in the input, ignoring it.")
+				continue
+			}
+			if _, found := fields[k]; found {
+				continue
+			}
+			if fields == nil {
+				fields = map[string]interface{}{}
+			}
+			fields[k] = x
+		}
+	}
+	return fields, nil
+}
+
+// enrichInput returns copies of input and of its value with fields added. The
+// input may be shared with the input cache and must not be modified.
+func enrichInput(input map[string]interface{}, inputValue ast.Value, fields map[string]interface{}) (map[string]interface{}, ast.Value, error) {
+	fieldsValue, err := ast.InterfaceToValue(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, ok := inputValue.(ast.Object)
+	if !ok {
+		return nil, nil, fmt.Errorf("input is not an object")
+	}
+	// The fields are not in the input, so the objects are merged without
+	// conflicts.
+	merged, _ := obj.Merge(fieldsValue.(ast.Object))
+
+	enriched := make(map[string]interface{}, len(input)+len(fields))
+	for k, v := range input {
+		enriched[k] = v
+	}
+	for k, v := range fields {
+		enriched[k] = v
+	}
+	return enriched, merged, nil
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// logInput logs the input built for the policy, for log-input, at debug
+// level. Like the decision log, the input is masked by the mask_decision
+// policy of the decision_logs plugin (data.system.log.mask by default), and is
+// not logged if the mask policy fails.
+func (p *envoyExtAuthzGrpcServer) logInput(ctx context.Context, txn storage.Transaction, cfg *Config, input map[string]interface{}, decisionID string, logger logging.Logger) {
+	if logger.GetLevel() < logging.Debug {
+		return
+	}
+
+	// Mask rules refer to the input as logged in the decision log.
+	if len(cfg.headerLogTransforms) > 0 {
+		input = transformLoggedHeaders(input, cfg.headerLogTransforms)
+	}
+	var logged interface{} = input
+	if cfg.InputRootKey != "" {
+		logged = map[string]interface{}{cfg.InputRootKey: input}
+	}
+	// The masked copy must not modify the input evaluated by the policy.
+	if err := util.RoundTrip(&logged); err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to log input.")
+		return
+	}
+
+	masked, err := p.maskInput(ctx, txn, cfg.Path, decisionID, logged)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to mask input, not logging it.")
+		return
+	}
+
+	logger.WithFields(map[string]interface{}{"input": masked}).Debug("Built input.")
+}
+
+// maskInput applies the rules of the mask policy targeting the input to
+// input, the rules being evaluated against a partial decision log event.
+func (p *envoyExtAuthzGrpcServer) maskInput(ctx context.Context, txn storage.Transaction, path, decisionID string, input interface{}) (interface{}, error) {
+	event, _, err := p.maskEvent(ctx, txn, map[string]interface{}{"decision_id": decisionID, "path": path, "input": input})
+	if err != nil {
+		return nil, err
+	}
+	return event["input"], nil
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InstanceName returns the name of the plugin instance: PluginName for the
+// default instance and PluginName followed by "_" and instance otherwise, e.g.
+// envoy_ext_authz_grpc_egress. It is both the key of the instance in the
+// "plugins" section of the OPA configuration and the name of its status.
+func InstanceName(instance string) string {
+	if instance == "" {
+		return PluginName
+	}
+	return PluginName + "_" + instance
+}
+
+// Logger returns the logger of the plugin manager, with the name of the
+// instance for instances other than the default one.
+func (p *envoyExtAuthzGrpcServer) Logger() logging.Logger {
+	if p.name == PluginName {
+		return p.manager.Logger()
+	}
+	return p.manager.Logger().WithFields(map[string]interface{}{"plugin": p.name})
+}
+
+// prometheusRegisterer registers the metrics of the instance with a "plugin"
+// label, so that the metrics of several instances do not collide.
+func (p *envoyExtAuthzGrpcServer) prometheusRegisterer() prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"plugin": p.name}, p.manager.PrometheusRegister())
+}
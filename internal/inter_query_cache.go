@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	iCache "github.com/open-policy-agent/opa/topdown/cache"
+)
+
+// validateInterQueryCache checks the inter-query-cache-* options, which override
+// the `caching` section of the OPA configuration for the plugin.
+func (cfg *Config) validateInterQueryCache() error {
+	if cfg.InterQueryCacheMaxSize < 0 {
+		return fmt.Errorf("invalid config: inter-query-cache-max-size must not be negative")
+	}
+
+	if cfg.InterQueryCacheEvictionThreshold < 0 || cfg.InterQueryCacheEvictionThreshold > 100 {
+		return fmt.Errorf("invalid config: inter-query-cache-eviction-threshold must be a percentage between 1 and 100")
+	}
+
+	cfg.interQueryCacheEvictionPeriod = 0
+	if cfg.InterQueryCacheEvictionPeriod != "" {
+		d, err := time.ParseDuration(cfg.InterQueryCacheEvictionPeriod)
+		if err != nil {
+			return fmt.Errorf("invalid config: inter-query-cache-eviction-period: %w", err)
+		}
+		if d < time.Second {
+			return fmt.Errorf("invalid config: inter-query-cache-eviction-period must be at least 1s")
+		}
+		cfg.interQueryCacheEvictionPeriod = d
+	}
+
+	return nil
+}
+
+// interQueryCacheConfig returns base, the inter-query cache configuration of
+// OPA, with the options set in the plugin configuration.
+func (cfg *Config) interQueryCacheConfig(base *iCache.Config) *iCache.Config {
+	if cfg.InterQueryCacheMaxSize == 0 && cfg.InterQueryCacheEvictionThreshold == 0 && cfg.interQueryCacheEvictionPeriod == 0 {
+		return base
+	}
+
+	// Without a caching configuration, OPA uses the defaults.
+	c, _ := iCache.ParseCachingConfig(nil)
+	if base != nil {
+		builtin := base.InterQueryBuiltinCache
+		if builtin.MaxSizeBytes != nil {
+			c.InterQueryBuiltinCache.MaxSizeBytes = builtin.MaxSizeBytes
+		}
+		if builtin.ForcedEvictionThresholdPercentage != nil {
+			c.InterQueryBuiltinCache.ForcedEvictionThresholdPercentage = builtin.ForcedEvictionThresholdPercentage
+		}
+		if builtin.StaleEntryEvictionPeriodSeconds != nil {
+			c.InterQueryBuiltinCache.StaleEntryEvictionPeriodSeconds = builtin.StaleEntryEvictionPeriodSeconds
+		}
+	}
+
+	if cfg.InterQueryCacheMaxSize > 0 {
+		maxSize := int64(cfg.InterQueryCacheMaxSize)
+		c.InterQueryBuiltinCache.MaxSizeBytes = &maxSize
+	}
+	if cfg.InterQueryCacheEvictionThreshold > 0 {
+		threshold := int64(cfg.InterQueryCacheEvictionThreshold)
+		c.InterQueryBuiltinCache.ForcedEvictionThresholdPercentage = &threshold
+	}
+	if cfg.interQueryCacheEvictionPeriod > 0 {
+		period := int64(cfg.interQueryCacheEvictionPeriod / time.Second)
+		c.InterQueryBuiltinCache.StaleEntryEvictionPeriodSeconds = &period
+	}
+
+	return c
+}
@@ -6,14 +6,19 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"math"
+	"mime"
 	"net"
+	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ext_core_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
@@ -22,21 +27,29 @@ import (
 	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	ext_type_v2 "github.com/envoyproxy/go-control-plane/envoy/type"
 	ext_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/net/http/httpguts"
 	"google.golang.org/genproto/googleapis/rpc/code"
 	rpc_status "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoregistry"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/config"
 	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/plugins"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/server"
@@ -53,6 +66,8 @@ import (
 	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
 	internal_util "github.com/open-policy-agent/opa-envoy-plugin/internal/util"
 	"github.com/open-policy-agent/opa-envoy-plugin/opa/decisionlog"
+	batchv1 "github.com/open-policy-agent/opa-envoy-plugin/proto/batch/v1"
+	responsev1 "github.com/open-policy-agent/opa-envoy-plugin/proto/response/v1"
 )
 
 const (
@@ -62,6 +77,26 @@ const (
 	defaultEnableReflection         = false
 	defaultSkipRequestBodyParse     = false
 	defaultEnablePerformanceMetrics = false
+	defaultLogNDBuiltinCache        = true
+	defaultPeerAuthMetadataKey      = "x-opa-peer-auth-token"
+
+	// Delay before opening a storage transaction again after a transient
+	// error. It doubles with every attempt, up to maxTxnAttempts.
+	txnRetryDelay  = 10 * time.Millisecond
+	maxTxnAttempts = 4
+
+	// Time a client has to complete the handshake of a new connection, which
+	// grpc-go sets to 120s.
+	defaultGRPCConnectionTimeout = 10 * time.Second
+
+	// Time the circuit breaker stays open before evaluating a check again.
+	defaultCircuitBreakerOpenDuration = 30 * time.Second
+
+	// Size of the decision-log-file after which it is rotated.
+	defaultDecisionLogFileMaxSize = 100 * 1024 * 1024
+
+	// Size above which decisions are left out of the decision-metadata-key.
+	defaultDecisionMetadataMaxSize = 16 * 1024
 
 	// Those are the defaults from grpc-go.
 	// See https://github.com/grpc/grpc-go/blob/master/server.go#L58 for more details.
@@ -70,6 +105,32 @@ const (
 
 	// PluginName is the name to register with the OPA plugin manager
 	PluginName = "envoy_ext_authz_grpc"
+
+	// Decisions returned by a plugin configured with wait-for-bundle until the
+	// bundles have been activated, also used for circuit-breaker-decision.
+	preBundleDecisionAllow       = "allow"
+	preBundleDecisionDeny        = "deny"
+	preBundleDecisionUnavailable = "unavailable"
+
+	// Responses to a query that produces no result.
+	undefinedDecisionDeny  = "deny"
+	undefinedDecisionAllow = "allow"
+	undefinedDecisionError = "error"
+
+	// Values of response-header-append-action.
+	responseHeaderAppendActionAppend      = "append"
+	responseHeaderAppendActionOverwrite   = "overwrite"
+	responseHeaderAppendActionAddIfAbsent = "add-if-absent"
+
+	// Values of header-limit-action.
+	headerLimitActionReject   = "reject"
+	headerLimitActionTruncate = "truncate"
+
+	// Counters added to the metrics of every decision, and so to the decision
+	// log, to correlate decisions with payload sizes.
+	requestBodyBytesCounter     = "request_body_bytes"
+	responseBodyBytesCounter    = "response_body_bytes"
+	responseHeadersBytesCounter = "response_headers_bytes"
 )
 
 var defaultGRPCRequestDurationSecondsBuckets = []float64{
@@ -86,6 +147,12 @@ var defaultGRPCRequestDurationSecondsBuckets = []float64{
 	1,
 }
 
+var responseHeaderAppendActions = map[string]ext_core_v3.HeaderValueOption_HeaderAppendAction{
+	responseHeaderAppendActionAppend:      ext_core_v3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+	responseHeaderAppendActionOverwrite:   ext_core_v3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	responseHeaderAppendActionAddIfAbsent: ext_core_v3.HeaderValueOption_ADD_IF_ABSENT,
+}
+
 // Validate receives a slice of bytes representing the plugin's
 // configuration and returns a configuration value that can be used to
 // instantiate the plugin.
@@ -99,14 +166,379 @@ func Validate(m *plugins.Manager, bs []byte) (*Config, error) {
 		SkipRequestBodyParse:              defaultSkipRequestBodyParse,
 		EnablePerformanceMetrics:          defaultEnablePerformanceMetrics,
 		GRPCRequestDurationSecondsBuckets: defaultGRPCRequestDurationSecondsBuckets,
+		ExpressionsEvaluatedSampleRate:    defaultExpressionsEvaluatedSampleRate,
+		LogNDBuiltinCache:                 defaultLogNDBuiltinCache,
+		DecisionLogFileMaxSize:            defaultDecisionLogFileMaxSize,
+		DecisionMetadataMaxSize:           defaultDecisionMetadataMaxSize,
 	}
 
 	if err := util.Unmarshal(bs, &cfg); err != nil {
 		return nil, err
 	}
 
+	if err := cfg.expandEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.parseQuery(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.PreBundleDecision {
+	case "":
+		cfg.PreBundleDecision = preBundleDecisionUnavailable
+	case preBundleDecisionAllow, preBundleDecisionDeny, preBundleDecisionUnavailable:
+	default:
+		return nil, fmt.Errorf("invalid config: pre-bundle-decision must be one of %q, %q or %q", preBundleDecisionAllow, preBundleDecisionDeny, preBundleDecisionUnavailable)
+	}
+
+	switch cfg.CircuitBreakerDecision {
+	case "":
+		cfg.CircuitBreakerDecision = preBundleDecisionUnavailable
+	case preBundleDecisionAllow, preBundleDecisionDeny, preBundleDecisionUnavailable:
+	default:
+		return nil, fmt.Errorf("invalid config: circuit-breaker-decision must be one of %q, %q or %q", preBundleDecisionAllow, preBundleDecisionDeny, preBundleDecisionUnavailable)
+	}
+
+	switch cfg.UndefinedDecision {
+	case "":
+		cfg.UndefinedDecision = undefinedDecisionError
+	case undefinedDecisionDeny, undefinedDecisionAllow, undefinedDecisionError:
+	default:
+		return nil, fmt.Errorf("invalid config: undefined-decision must be one of %q, %q or %q", undefinedDecisionDeny, undefinedDecisionAllow, undefinedDecisionError)
+	}
+
+	switch cfg.HeaderNormalization {
+	case "":
+		cfg.HeaderNormalization = envoyauth.HeaderNormalizationNone
+	case envoyauth.HeaderNormalizationNone, envoyauth.HeaderNormalizationLowercase, envoyauth.HeaderNormalizationCanonical:
+	default:
+		return nil, fmt.Errorf("invalid config: header-normalization must be one of %q, %q or %q", envoyauth.HeaderNormalizationNone, envoyauth.HeaderNormalizationLowercase, envoyauth.HeaderNormalizationCanonical)
+	}
+
+	switch cfg.InputProfile {
+	case "":
+		cfg.InputProfile = envoyauth.InputProfileFull
+	case envoyauth.InputProfileFull, envoyauth.InputProfileMinimal:
+	default:
+		return nil, fmt.Errorf("invalid config: input-profile must be one of %q or %q", envoyauth.InputProfileFull, envoyauth.InputProfileMinimal)
+	}
+
+	if err := validatePaths("bypass-paths", cfg.BypassPaths); err != nil {
+		return nil, err
+	}
+
+	if err := validatePaths("dry-run-paths", cfg.DryRunPaths); err != nil {
+		return nil, err
+	}
+	if cfg.DryRun && len(cfg.DryRunPaths) > 0 {
+		return nil, fmt.Errorf("invalid config: dry-run-paths cannot be used with dry-run, which applies to all paths")
+	}
+
+	if cfg.GRPCMaxConcurrentStreams < 0 {
+		return nil, fmt.Errorf("invalid config: grpc-max-concurrent-streams must be a positive integer")
+	}
+
+	if cfg.SlowDecisionThreshold != "" {
+		d, err := time.ParseDuration(cfg.SlowDecisionThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: slow-decision-threshold: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid config: slow-decision-threshold must be a positive duration")
+		}
+		cfg.slowDecisionThreshold = d
+	}
+
+	if cfg.EvalTimeout != "" {
+		d, err := time.ParseDuration(cfg.EvalTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: eval-timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid config: eval-timeout must be a positive duration")
+		}
+		cfg.evalTimeout = d
+	}
+
+	if err := cfg.validateEvalPool(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateHeaderLogTransforms(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateTLSMux(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateOversizedMessage(); err != nil {
+		return nil, err
+	}
+
+	if cfg.CircuitBreakerThreshold < 0 {
+		return nil, fmt.Errorf("invalid config: circuit-breaker-threshold must be a non-negative integer")
+	}
+
+	cfg.circuitBreakerOpenDuration = defaultCircuitBreakerOpenDuration
+	if cfg.CircuitBreakerOpenDuration != "" {
+		d, err := time.ParseDuration(cfg.CircuitBreakerOpenDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: circuit-breaker-open-duration: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid config: circuit-breaker-open-duration must be a positive duration")
+		}
+		cfg.circuitBreakerOpenDuration = d
+	}
+
+	if err := cfg.validateRateLimit(); err != nil {
+		return nil, err
+	}
+
+	if cfg.DecisionLogFileMaxAge != "" {
+		d, err := time.ParseDuration(cfg.DecisionLogFileMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: decision-log-file-max-age: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid config: decision-log-file-max-age must not be negative")
+		}
+		cfg.decisionLogFileMaxAge = d
+	}
+
+	if cfg.MaxDecisionLogBytes < 0 {
+		return nil, fmt.Errorf("invalid config: max-decision-log-bytes must not be negative")
+	}
+
+	if cfg.DecisionLogFileMaxSize < 0 || cfg.DecisionLogFileMaxBackups < 0 {
+		return nil, fmt.Errorf("invalid config: decision-log-file-max-size and decision-log-file-max-backups must not be negative")
+	}
+
+	cfg.grpcConnectionTimeout = defaultGRPCConnectionTimeout
+	if cfg.GRPCConnectionTimeout != "" {
+		d, err := time.ParseDuration(cfg.GRPCConnectionTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: grpc-connection-timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid config: grpc-connection-timeout must be a positive duration")
+		}
+		cfg.grpcConnectionTimeout = d
+	}
+
+	if cfg.ListenerKeepAlive != "" {
+		d, err := time.ParseDuration(cfg.ListenerKeepAlive)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: listener-keepalive: %w", err)
+		}
+		cfg.listenerKeepAlive = d
+	}
+
+	if cfg.XFFNumTrustedHops < 0 {
+		return nil, fmt.Errorf("invalid config: xff-num-trusted-hops must be a non-negative integer")
+	}
+
+	cfg.trustedProxies = nil
+	for _, s := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid config: trusted-proxies must be IP addresses or CIDRs: %w", err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, prefix.Masked())
+	}
+
+	for i := range cfg.InputEnrichment {
+		if err := cfg.InputEnrichment[i].parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DataOverlay != nil {
+		if err := cfg.DataOverlay.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DebugAddr != "" {
+		if err := validateDebugAddr(cfg.DebugAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ListenerReusePort && !reusePortSupported {
+		return nil, fmt.Errorf("invalid config: listener-reuse-port is not supported on this platform")
+	}
+
+	if cfg.DynamicMetadataNamespace != "" && strings.TrimSpace(cfg.DynamicMetadataNamespace) == "" {
+		return nil, fmt.Errorf("invalid config: dynamic-metadata-namespace must be a non-empty string")
+	}
+
+	if cfg.DecisionMetadataKey != "" && (strings.TrimSpace(cfg.DecisionMetadataKey) == "" || cfg.DecisionMetadataKey == "decision_id") {
+		return nil, fmt.Errorf("invalid config: decision-metadata-key must be a non-empty string other than \"decision_id\"")
+	}
+
+	if cfg.DecisionMetadataMaxSize < 0 {
+		return nil, fmt.Errorf("invalid config: decision-metadata-max-size must not be negative")
+	}
+
+	if cfg.CacheTTLMetadataKey != "" && (strings.TrimSpace(cfg.CacheTTLMetadataKey) == "" || cfg.CacheTTLMetadataKey == "decision_id" || cfg.CacheTTLMetadataKey == cfg.DecisionMetadataKey) {
+		return nil, fmt.Errorf("invalid config: cache-ttl-metadata-key must be a non-empty string other than \"decision_id\" and decision-metadata-key")
+	}
+
+	if cfg.MaxHeaders < 0 || cfg.MaxHeaderBytes < 0 {
+		return nil, fmt.Errorf("invalid config: max-headers and max-header-bytes must not be negative")
+	}
+	switch cfg.HeaderLimitAction {
+	case "":
+		cfg.HeaderLimitAction = headerLimitActionReject
+	case headerLimitActionReject, headerLimitActionTruncate:
+	default:
+		return nil, fmt.Errorf("invalid config: header-limit-action must be one of %q or %q", headerLimitActionReject, headerLimitActionTruncate)
+	}
+
+	if _, ok := decisionSummaryLevels[cfg.DecisionLogConsoleLevel]; cfg.DecisionLogConsoleLevel != "" && !ok {
+		return nil, fmt.Errorf("invalid config: decision-log-console-level must be one of \"debug\", \"info\", \"warn\" or \"error\"")
+	}
+
+	if cfg.PeerAuthToken != "" && cfg.PeerAuthMetadataKey == "" {
+		cfg.PeerAuthMetadataKey = defaultPeerAuthMetadataKey
+	}
+	// gRPC metadata keys are lowercase.
+	cfg.PeerAuthMetadataKey = strings.ToLower(cfg.PeerAuthMetadataKey)
+
+	// Rego's input document cannot be renamed, the input is nested under
+	// input.<input-root-key> instead, which must be usable as input.<key>.
+	if cfg.InputRootKey != "" && (!ast.IsVarCompatibleString(cfg.InputRootKey) || ast.IsKeyword(cfg.InputRootKey)) {
+		return nil, fmt.Errorf("invalid config: input-root-key must be a legal Rego variable name: %q", cfg.InputRootKey)
+	}
+
+	if _, ok := ext_type_v3.StatusCode_name[int32(cfg.DefaultDenyStatus)]; cfg.DefaultDenyStatus != 0 && !ok {
+		return nil, fmt.Errorf("invalid config: default-deny-status %d is not an HTTP status code supported by Envoy", cfg.DefaultDenyStatus)
+	}
+
+	if cfg.NDBuiltinCacheMaxBytes < 0 {
+		return nil, fmt.Errorf("invalid config: nd-builtin-cache-max-bytes must be a positive integer")
+	}
+
+	if cfg.MaxConcurrentChecks < 0 {
+		return nil, fmt.Errorf("invalid config: max-concurrent-checks must be a positive integer")
+	}
+
+	if cfg.InputCacheSize < 0 {
+		return nil, fmt.Errorf("invalid config: input-cache-size must be a non-negative integer")
+	}
+
+	if err := cfg.validateRegoMetrics(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateInterQueryCache(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateJWT(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateMetricsExporters(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateGRPCRequestDurationMetric(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.AdditionalPathsStrategy {
+	case "":
+		cfg.AdditionalPathsStrategy = additionalPathsStrategyMostRestrictive
+	case additionalPathsStrategyMostRestrictive, additionalPathsStrategyDenyOverrides:
+	default:
+		return nil, fmt.Errorf("invalid config: additional-paths-strategy must be one of %q or %q", additionalPathsStrategyMostRestrictive, additionalPathsStrategyDenyOverrides)
+	}
+
+	if action, ok := responseHeaderAppendActions[cfg.ResponseHeaderAppendAction]; ok {
+		cfg.responseHeaderAppendAction = action
+	} else if cfg.ResponseHeaderAppendAction != "" {
+		return nil, fmt.Errorf("invalid config: response-header-append-action must be one of %q, %q or %q", responseHeaderAppendActionAppend, responseHeaderAppendActionOverwrite, responseHeaderAppendActionAddIfAbsent)
+	}
+
+	// Envoy sends header names in lowercase.
+	for i, h := range cfg.InputProfileHeaders {
+		cfg.InputProfileHeaders[i] = strings.ToLower(h)
+	}
+	cfg.NodeHeader = strings.ToLower(cfg.NodeHeader)
+	cfg.RequestIDHeader = strings.ToLower(cfg.RequestIDHeader)
+	if cfg.RequestIDResponseHeader && cfg.RequestIDHeader == "" {
+		return nil, fmt.Errorf("invalid config: request-id-response-header requires request-id-header")
+	}
+	for k := range cfg.DecisionLogLabels {
+		if k == "" {
+			return nil, fmt.Errorf("invalid config: decision-log-labels must not contain empty keys")
+		}
+	}
+
+	if cfg.StripPathPrefix != "" {
+		cfg.StripPathPrefix = strings.TrimRight(cfg.StripPathPrefix, "/")
+		if !strings.HasPrefix(cfg.StripPathPrefix, "/") || strings.ContainsAny(cfg.StripPathPrefix, "?#") {
+			return nil, fmt.Errorf("invalid config: strip-path-prefix must be a path such as \"/api\"")
+		}
+	}
+
+	if cfg.DefaultBodyContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(cfg.DefaultBodyContentType)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("invalid config: default-body-content-type must be a media type such as \"application/json\": %q", cfg.DefaultBodyContentType)
+		}
+	}
+
+	if len(cfg.SourceWorkloadFields) > 0 && !cfg.SourceWorkload {
+		return nil, fmt.Errorf("invalid config: source-workload-fields requires source-workload")
+	}
+	for field, path := range cfg.SourceWorkloadFields {
+		if field != envoyauth.SourceWorkloadName && field != envoyauth.SourceWorkloadNamespace && field != envoyauth.SourceWorkloadVersion {
+			return nil, fmt.Errorf("invalid config: source-workload-fields keys must be %q, %q or %q: %q", envoyauth.SourceWorkloadName, envoyauth.SourceWorkloadNamespace, envoyauth.SourceWorkloadVersion, field)
+		}
+		filter, keys, ok := strings.Cut(path, "/")
+		if !ok || filter == "" || keys == "" || strings.Contains("/"+keys+"/", "//") {
+			return nil, fmt.Errorf("invalid config: source-workload-fields paths must be \"<filter>/<key>[/<key>...]\": %q", path)
+		}
+	}
+
+	cfg.ExplainHeader = strings.ToLower(cfg.ExplainHeader)
+	if cfg.ExplainHeader != "" && !httpguts.ValidHeaderFieldName(cfg.ExplainHeader) {
+		return nil, fmt.Errorf("invalid config: explain-header must be a valid header name: %q", cfg.ExplainHeader)
+	}
+	if (cfg.ExplainHeader == "") != (cfg.ExplainSecret == "") {
+		return nil, fmt.Errorf("invalid config: explain-header and explain-secret must be set together")
+	}
+
+	cfg.DeniedReasonHeader = strings.ToLower(cfg.DeniedReasonHeader)
+	if cfg.DeniedReasonHeader != "" && !httpguts.ValidHeaderFieldName(cfg.DeniedReasonHeader) {
+		return nil, fmt.Errorf("invalid config: denied-reason-header must be a valid header name: %q", cfg.DeniedReasonHeader)
+	}
+
+	if cfg.ProtoDescriptor != "" {
+		ps, err := internal_util.ReadProtoSet(cfg.ProtoDescriptor)
+		if err != nil {
+			return nil, err
+		}
+		cfg.protoSet = ps
+	}
+
+	return &cfg, nil
+}
+
+// parseQuery validates the "path" and "query" fields and sets the parsed
+// query that the plugin evaluates.
+func (cfg *Config) parseQuery() error {
 	if cfg.Path != "" && cfg.Query != "" {
-		return nil, fmt.Errorf("invalid config: specify a value for only the \"path\" field")
+		return fmt.Errorf("invalid config: specify a value for only the \"path\" field")
 	}
 
 	var parsedQuery ast.Body
@@ -124,27 +556,55 @@ func Validate(m *plugins.Manager, bs []byte) (*Config, error) {
 	}
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	cfg.parsedQuery = parsedQuery
 
-	if cfg.ProtoDescriptor != "" {
-		ps, err := internal_util.ReadProtoSet(cfg.ProtoDescriptor)
+	cfg.additionalQueries = nil
+	for _, path := range cfg.AdditionalPaths {
+		if path == "" {
+			return fmt.Errorf("invalid config: additional-paths must not contain empty paths")
+		}
+		q, err := newAdditionalQuery(path)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		cfg.protoSet = ps
+		cfg.additionalQueries = append(cfg.additionalQueries, q)
 	}
 
-	return &cfg, nil
+	cfg.responseQuery = nil
+	if cfg.ResponsePath != "" {
+		q, err := newAdditionalQuery(cfg.ResponsePath)
+		if err != nil {
+			return err
+		}
+		cfg.responseQuery = q
+	}
+
+	return cfg.parseGRPCMethodPaths()
 }
 
 // New returns a Plugin that implements the Envoy ext_authz API.
 func New(m *plugins.Manager, cfg *Config) plugins.Plugin {
+	return NewInstance(m, cfg, "")
+}
+
+// NewInstance returns the Plugin of an instance other than the default one,
+// which must be registered as InstanceName(instance). Several instances can be
+// configured in the same OPA, e.g. one for ingress and one for egress traffic.
+func NewInstance(m *plugins.Manager, cfg *Config, instance string) plugins.Plugin {
+	oversizedStats := &oversizedMessageStats{}
 	grpcOpts := []grpc.ServerOption{
-		grpc.MaxRecvMsgSize(cfg.GRPCMaxRecvMsgSize),
-		grpc.MaxSendMsgSize(cfg.GRPCMaxSendMsgSize),
+		grpc.MaxRecvMsgSize(cfg.grpcMaxRecvMsgSize()),
+		grpc.MaxSendMsgSize(int(cfg.GRPCMaxSendMsgSize)),
+		grpc.StatsHandler(oversizedStats),
+	}
+	if cfg.GRPCMaxConcurrentStreams > 0 {
+		grpcOpts = append(grpcOpts, grpc.MaxConcurrentStreams(uint32(cfg.GRPCMaxConcurrentStreams)))
+	}
+	if cfg.grpcConnectionTimeout > 0 {
+		grpcOpts = append(grpcOpts, grpc.ConnectionTimeout(cfg.grpcConnectionTimeout))
 	}
 	var distributedTracingOpts tracing.Options = nil
 	if m.TracerProvider() != nil {
@@ -157,51 +617,179 @@ func New(m *plugins.Manager, cfg *Config) plugins.Plugin {
 			otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader|b3.B3SingleHeader)))),
 		)
 		grpcOpts = append(grpcOpts,
-			grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor(grpcTracingOption...)),
-			grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor(grpcTracingOption...)),
+			grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(grpcTracingOption...)),
+			grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(grpcTracingOption...)),
 		)
 	}
+	if cfg.GRPCEnableGzip {
+		grpcOpts = append(grpcOpts,
+			grpc.ChainUnaryInterceptor(gzipUnaryInterceptor),
+			grpc.ChainStreamInterceptor(gzipStreamInterceptor),
+		)
+	}
+	if cfg.PeerAuthToken != "" {
+		auth := peerAuthenticator{key: cfg.PeerAuthMetadataKey, token: cfg.PeerAuthToken}
+		grpcOpts = append(grpcOpts,
+			grpc.ChainUnaryInterceptor(auth.unaryInterceptor),
+			grpc.ChainStreamInterceptor(auth.streamInterceptor),
+		)
+	}
+
+	// The context stops the stale entry eviction of the inter-query cache.
+	cacheCtx, cacheCancel := context.WithCancel(context.Background())
 
 	plugin := &envoyExtAuthzGrpcServer{
+		name:                   InstanceName(instance),
 		manager:                m,
-		cfg:                    *cfg,
 		server:                 grpc.NewServer(grpcOpts...),
-		preparedQueryDoOnce:    new(sync.Once),
-		interQueryBuiltinCache: iCache.NewInterQueryCache(m.InterQueryBuiltinCacheConfig()),
+		interQueryBuiltinCache: iCache.NewInterQueryCacheWithContext(cacheCtx, cfg.interQueryCacheConfig(m.InterQueryBuiltinCacheConfig())),
+		interQueryCacheCancel:  cacheCancel,
 		distributedTracingOpts: distributedTracingOpts,
 	}
 
-	// Register Authorization Server
-	ext_authz_v3.RegisterAuthorizationServer(plugin.server, plugin)
-	ext_authz_v2.RegisterAuthorizationServer(plugin.server, &envoyExtAuthzV2Wrapper{v3: plugin})
+	c := *cfg
+	c.query = newQuery(c.parsedQuery)
+	plugin.cfg.Store(&c)
 
-	m.RegisterCompilerTrigger(plugin.compilerUpdated)
+	oversizedStats.p = plugin
+	plugin.protoSet.Store(cfg.protoSet)
 
-	// Register reflection service on gRPC server
-	if cfg.EnableReflection {
-		reflection.Register(plugin.server)
+	if cfg.InputCacheSize > 0 {
+		plugin.inputCache = newInputCache(cfg.InputCacheSize)
+	}
+
+	if cfg.CircuitBreakerThreshold > 0 {
+		plugin.circuitBreaker = newCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.circuitBreakerOpenDuration)
+	}
+
+	if cfg.RateLimitKey != "" {
+		plugin.rateLimiter = newRateLimiter(cfg.RateLimitKey, cfg.RateLimitRate, cfg.RateLimitBurst, cfg.RateLimitMaxKeys)
+	}
+
+	if cfg.EvalWorkers > 0 {
+		plugin.evalPool = newEvalPool(cfg.EvalWorkers, cfg.EvalQueueSize)
+	}
+
+	if cfg.JWKSURL != "" {
+		plugin.jwtVerifier = newJWTVerifier(cfg.JWKSURL, cfg.JWTAudience)
+	}
+
+	if cfg.DecisionLogFile != "" {
+		plugin.decisionFile = newDecisionFile(cfg.DecisionLogFile, int64(cfg.DecisionLogFileMaxSize), cfg.decisionLogFileMaxAge, cfg.DecisionLogFileMaxBackups)
+	}
+
+	if cfg.GRPCWebAddr != "" {
+		plugin.grpcWebServer = &http.Server{Addr: cfg.GRPCWebAddr, Handler: grpcWebHandler{p: plugin}}
+	}
+
+	if cfg.DebugAddr != "" {
+		plugin.debugServer = &http.Server{Addr: cfg.DebugAddr, Handler: debugHandler()}
+	}
+
+	plugin.registerServices(plugin.server)
+
+	// With grpc-tls-mux, TLS connections are served by a second server, with
+	// the same services, on the same listener.
+	if cfg.GRPCTLSMux && cfg.tlsCertificate != nil {
+		plugin.tlsServer = grpc.NewServer(append(grpcOpts, grpc.Creds(credentials.NewTLS(cfg.tlsConfig())))...)
+		plugin.registerServices(plugin.tlsServer)
 	}
+
+	m.RegisterCompilerTrigger(plugin.compilerUpdated)
 	if cfg.EnablePerformanceMetrics {
+		// The Prometheus metrics are always recorded, and only registered with
+		// the registry of OPA if they are exported to Prometheus.
+		var reg prometheus.Registerer = prometheus.NewRegistry()
+		if cfg.exportsMetricsTo(metricsExporterPrometheus) {
+			reg = plugin.prometheusRegisterer()
+		}
 		histogramAuthzDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "grpc_request_duration_seconds",
 			Help:    "A histogram of duration for grpc authz requests.",
 			Buckets: cfg.GRPCRequestDurationSecondsBuckets,
 		}, []string{"handler"})
 		plugin.metricAuthzDuration = *histogramAuthzDuration
+		histogramInputBuildDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "input_build_duration_seconds",
+			Help:    "A histogram of duration for building the input of authz requests, excluding cached inputs.",
+			Buckets: cfg.GRPCRequestDurationSecondsBuckets,
+		}, []string{"body_parsed"})
+		plugin.metricInputBuildDuration = *histogramInputBuildDuration
 		errorCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "error_counter",
 			Help: "A counter for errors",
 		}, []string{"reason"})
 		plugin.metricErrorCounter = *errorCounter
-		plugin.manager.PrometheusRegister().MustRegister(histogramAuthzDuration)
-		plugin.manager.PrometheusRegister().MustRegister(errorCounter)
+		if cfg.durationHistogram() {
+			reg.MustRegister(histogramAuthzDuration)
+		}
+		if cfg.durationSummary() {
+			plugin.metricAuthzSummary = newAuthzDurationSummary(cfg.grpcRequestDurationObjectives)
+			reg.MustRegister(plugin.metricAuthzSummary)
+		}
+		reg.MustRegister(histogramInputBuildDuration)
+		reg.MustRegister(errorCounter)
+		if cfg.slowDecisionThreshold > 0 {
+			slowDecisionCounter := prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "slow_decision_counter",
+				Help: "A counter for decisions that exceeded the slow decision threshold",
+			})
+			plugin.metricSlowDecisionCounter = slowDecisionCounter
+			reg.MustRegister(slowDecisionCounter)
+		}
+		if cfg.exportsMetricsTo(metricsExporterPrometheus) {
+			plugin.regoMetrics = newRegoMetrics(cfg.GRPCRequestDurationSecondsBuckets, cfg.ExpressionsEvaluatedSampleRate)
+			plugin.regoMetrics.registerMetrics(reg)
+			if plugin.inputCache != nil {
+				plugin.inputCache.registerMetrics(reg)
+			}
+			if plugin.circuitBreaker != nil {
+				plugin.circuitBreaker.registerMetrics(reg)
+			}
+			if plugin.rateLimiter != nil {
+				plugin.rateLimiter.registerMetrics(reg)
+			}
+			if plugin.evalPool != nil {
+				plugin.evalPool.registerMetrics(reg)
+			}
+		}
+		if cfg.exportsMetricsTo(metricsExporterOpenTelemetry) {
+			otelMetrics, err := newOTelMetrics(plugin.meterProvider(), plugin.name, cfg.GRPCRequestDurationSecondsBuckets)
+			if err != nil {
+				plugin.Logger().WithFields(map[string]interface{}{"err": err}).Error("Unable to create OpenTelemetry metrics.")
+			} else {
+				plugin.otelMetrics = otelMetrics
+			}
+		}
 	}
 
-	m.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
+	m.UpdatePluginStatus(plugin.name, &plugins.Status{State: plugins.StateNotReady})
 
 	return plugin
 }
 
+// registerServices registers the services of the plugin on s.
+func (p *envoyExtAuthzGrpcServer) registerServices(s *grpc.Server) {
+	cfg := p.config()
+
+	// Register Authorization Server
+	ext_authz_v3.RegisterAuthorizationServer(s, p)
+	ext_authz_v2.RegisterAuthorizationServer(s, &envoyExtAuthzV2Wrapper{v3: p})
+
+	if cfg.EnableBatchService {
+		batchv1.RegisterBatchAuthorizationServer(s, &batchAuthorizationServer{v3: p})
+	}
+
+	if cfg.responseQuery != nil {
+		responsev1.RegisterResponseAuthorizationServer(s, &responseAuthorizationServer{v3: p})
+	}
+
+	// Register reflection service on gRPC server
+	if cfg.EnableReflection {
+		reflection.Register(s)
+	}
+}
+
 // Config represents the plugin configuration.
 type Config struct {
 	Addr                              string `json:"addr"`
@@ -210,25 +798,212 @@ type Config struct {
 	DryRun                            bool   `json:"dry-run"`
 	EnableReflection                  bool   `json:"enable-reflection"`
 	parsedQuery                       ast.Body
+	query                             *additionalQuery
 	ProtoDescriptor                   string `json:"proto-descriptor"`
 	protoSet                          *protoregistry.Files
-	GRPCMaxRecvMsgSize                int       `json:"grpc-max-recv-msg-size"`
-	GRPCMaxSendMsgSize                int       `json:"grpc-max-send-msg-size"`
+	GRPCMaxRecvMsgSize                byteSize  `json:"grpc-max-recv-msg-size"`
+	OversizedMessageDecision          string    `json:"oversized-message-decision"`
+	OversizedMessageMaxSize           byteSize  `json:"oversized-message-max-size"`
+	GRPCMaxSendMsgSize                byteSize  `json:"grpc-max-send-msg-size"`
+	GRPCMaxConcurrentStreams          int       `json:"grpc-max-concurrent-streams"`
+	GRPCConnectionTimeout             string    `json:"grpc-connection-timeout"`
+	GRPCEnableGzip                    bool      `json:"grpc-enable-gzip"`
+	GRPCTLSMux                        bool      `json:"grpc-tls-mux"`
+	GRPCTLSCertFile                   string    `json:"grpc-tls-cert-file"`
+	GRPCTLSKeyFile                    string    `json:"grpc-tls-key-file"`
 	SkipRequestBodyParse              bool      `json:"skip-request-body-parse"`
 	EnablePerformanceMetrics          bool      `json:"enable-performance-metrics"`
 	GRPCRequestDurationSecondsBuckets []float64 `json:"grpc-request-duration-seconds-buckets"`
+	GRPCRequestDurationMetric         string    `json:"grpc-request-duration-metric"`
+	MetricsExporters                  []string  `json:"metrics-exporters"`
+	ExpressionsEvaluatedSampleRate    float64   `json:"expressions-evaluated-sample-rate"`
+	InputProfile                      string    `json:"input-profile"`
+	InputProfileHeaders               []string  `json:"input-profile-headers"`
+	InputCacheSize                    int       `json:"input-cache-size"`
+	SlowDecisionThreshold             string    `json:"slow-decision-threshold"`
+	WatchProtoDescriptor              bool      `json:"watch-proto-descriptor"`
+	EvalTimeout                       string    `json:"eval-timeout"`
+	EvalWorkers                       int       `json:"eval-workers"`
+	EvalQueueSize                     int       `json:"eval-queue-size"`
+	NodeHeader                        string    `json:"node-header"`
+	RequestIDHeader                   string    `json:"request-id-header"`
+	RequestIDResponseHeader           bool      `json:"request-id-response-header"`
+	DeniedReasonHeader                string    `json:"denied-reason-header"`
+	ExplainHeader                     string    `json:"explain-header"`
+	ExplainSecret                     string    `json:"explain-secret"`
+	WaitForBundle                     bool      `json:"wait-for-bundle"`
+	PreBundleDecision                 string    `json:"pre-bundle-decision"`
+	HeaderNormalization               string    `json:"header-normalization"`
+	ResponseHeaderAppendAction        string    `json:"response-header-append-action"`
+	EnableBatchService                bool      `json:"enable-batch-service"`
+	DynamicMetadataNamespace          string    `json:"dynamic-metadata-namespace"`
+	DecisionMetadataKey               string    `json:"decision-metadata-key"`
+	DecisionMetadataMaxSize           byteSize  `json:"decision-metadata-max-size"`
+	CacheTTLMetadataKey               string    `json:"cache-ttl-metadata-key"`
+	PeerAuthToken                     string    `json:"peer-auth-token"`
+	DecisionLogConsoleLevel           string    `json:"decision-log-console-level"`
+	PeerAuthMetadataKey               string    `json:"peer-auth-metadata-key"`
+	MaxConcurrentChecks               int       `json:"max-concurrent-checks"`
+	PreserveOriginalHeaders           bool      `json:"preserve-original-headers"`
+	MaxHeaders                        int       `json:"max-headers"`
+	MaxHeaderBytes                    byteSize  `json:"max-header-bytes"`
+	HeaderLimitAction                 string    `json:"header-limit-action"`
+	UndefinedDecision                 string    `json:"undefined-decision"`
+	StrictBuiltinErrors               bool      `json:"strict-builtin-errors"`
+	BypassPaths                       []string  `json:"bypass-paths"`
+	DryRunPaths                       []string  `json:"dry-run-paths"`
+	AdditionalPaths                   []string  `json:"additional-paths"`
+	AdditionalPathsStrategy           string    `json:"additional-paths-strategy"`
+	ResponsePath                      string    `json:"response-path"`
+	IncludeRawRequest                 bool      `json:"include-raw-request"`
+	StripPathPrefix                   string    `json:"strip-path-prefix"`
+	DefaultBodyContentType            string    `json:"default-body-content-type"`
+	ParseMultipartMetadata            bool      `json:"parse-multipart-metadata"`
+	SourceWorkload                    bool      `json:"source-workload"`
+	LogInput                          bool      `json:"log-input"`
+	ParseJWT                          bool      `json:"parse-jwt"`
+	JWTHeader                         string    `json:"jwt-header"`
+	JWKSURL                           string    `json:"jwks-url"`
+	JWTAudience                       string    `json:"jwt-audience"`
+	GRPCWebAddr                       string    `json:"grpc-web-addr"`
+	DebugAddr                         string    `json:"debug-addr"`
+	LogNDBuiltinCache                 bool      `json:"log-nd-builtin-cache"`
+	InputRootKey                      string    `json:"input-root-key"`
+	DefaultDenyStatus                 int       `json:"default-deny-status"`
+	DefaultDenyBody                   string    `json:"default-deny-body"`
+	DefaultDenyContentType            string    `json:"default-deny-content-type"`
+	NDBuiltinCacheMaxBytes            int       `json:"nd-builtin-cache-max-bytes"`
+	ListenerReusePort                 bool      `json:"listener-reuse-port"`
+	ListenerKeepAlive                 string    `json:"listener-keepalive"`
+	XFFNumTrustedHops                 int       `json:"xff-num-trusted-hops"`
+	TrustedProxies                    []string  `json:"trusted-proxies"`
+	CircuitBreakerThreshold           int       `json:"circuit-breaker-threshold"`
+	CircuitBreakerOpenDuration        string    `json:"circuit-breaker-open-duration"`
+	CircuitBreakerDecision            string    `json:"circuit-breaker-decision"`
+	RateLimitKey                      string    `json:"rate-limit-key"`
+	RateLimitRate                     float64   `json:"rate-limit-rate"`
+	RateLimitBurst                    int       `json:"rate-limit-burst"`
+	RateLimitMaxKeys                  int       `json:"rate-limit-max-keys"`
+	RateLimitDecision                 string    `json:"rate-limit-decision"`
+	DecisionLogFile                   string    `json:"decision-log-file"`
+	DecisionLogFileMaxSize            byteSize  `json:"decision-log-file-max-size"`
+	DecisionLogFileMaxAge             string    `json:"decision-log-file-max-age"`
+	DecisionLogFileMaxBackups         int       `json:"decision-log-file-max-backups"`
+	MaxDecisionLogBytes               byteSize  `json:"max-decision-log-bytes"`
+	FailClosedOnLogError              *bool     `json:"fail-closed-on-log-error"`
+	InterQueryCacheMaxSize            byteSize  `json:"inter-query-cache-max-size"`
+	InterQueryCacheEvictionThreshold  int       `json:"inter-query-cache-eviction-threshold"`
+	InterQueryCacheEvictionPeriod     string    `json:"inter-query-cache-eviction-period"`
+	additionalQueries                 []*additionalQuery
+	responseQuery                     *additionalQuery
+	grpcMethodQueries                 map[string]*grpcMethodQuery
+	circuitBreakerOpenDuration        time.Duration
+	decisionLogFileMaxAge             time.Duration
+	evalTimeout                       time.Duration
+	grpcConnectionTimeout             time.Duration
+	interQueryCacheEvictionPeriod     time.Duration
+	listenerKeepAlive                 time.Duration
+	slowDecisionThreshold             time.Duration
+	grpcRequestDurationObjectives     map[float64]float64
+	responseHeaderAppendAction        ext_core_v3.HeaderValueOption_HeaderAppendAction
+	trustedProxies                    []netip.Prefix
+	tlsCertificate                    *tls.Certificate
+
+	// InputEnrichment entries are applied in order, see InputEnrichment.
+	InputEnrichment []InputEnrichment `json:"input-enrichment"`
+
+	// StartupProbeInput is evaluated before the plugin reports itself ready.
+	StartupProbeInput interface{} `json:"startup-probe-input"`
+
+	// DataOverlay selects the data merged into the data document of each
+	// request, see DataOverlay.
+	DataOverlay *DataOverlay `json:"data-overlay"`
+
+	// DecisionLogLabels are added to the labels of the decisions written to
+	// the decision-log-file and to the decision summary, without replacing
+	// the labels of OPA.
+	DecisionLogLabels map[string]string `json:"decision-log-labels"`
+
+	// GRPCRequestDurationSecondsObjectives maps the quantiles of the
+	// grpc_request_duration_summary_seconds summary, e.g. "0.99", to their
+	// allowed error, e.g. 0.001.
+	GRPCRequestDurationSecondsObjectives map[string]float64 `json:"grpc-request-duration-seconds-objectives"`
+
+	// GRPCMethodPaths maps gRPC methods, "package.Service/Method" or
+	// "package.Service/*", to the path evaluated instead of path for them.
+	GRPCMethodPaths map[string]string `json:"grpc-method-paths"`
+
+	// SourceWorkloadFields maps the fields of input.source_workload, "name",
+	// "namespace" and "version", to their path in the filter metadata,
+	// "<filter>/<key>[/<key>...]".
+	SourceWorkloadFields map[string]string `json:"source-workload-fields"`
+
+	// DecisionLogHeaderTransforms maps request headers to the strategy
+	// transforming their value in the decision log: "redact", "hash-sha256"
+	// or "first-<n>-chars".
+	DecisionLogHeaderTransforms map[string]string `json:"decision-log-header-transforms"`
+	headerLogTransforms         map[string]headerTransform
+}
+
+// dryRun reports whether the decision of req is only logged and the request
+// allowed, with dry-run or for the paths of dry-run-paths.
+func (cfg *Config) dryRun(req interface{}) bool {
+	return cfg.DryRun || matchesPaths(cfg.DryRunPaths, req)
+}
+
+func (cfg *Config) inputOptions(o *envoyauth.InputOptions) {
+	o.Profile = cfg.InputProfile
+	o.ProfileHeaders = cfg.InputProfileHeaders
+	o.NodeHeader = cfg.NodeHeader
+	o.HeaderNormalization = cfg.HeaderNormalization
+	o.PreserveOriginalHeaders = cfg.PreserveOriginalHeaders
+	o.IncludeRawRequest = cfg.IncludeRawRequest
+	o.XFFNumTrustedHops = cfg.XFFNumTrustedHops
+	o.TrustedProxies = cfg.trustedProxies
+	o.StripPathPrefix = cfg.StripPathPrefix
+	o.DefaultBodyContentType = cfg.DefaultBodyContentType
+	o.MultipartMetadata = cfg.ParseMultipartMetadata
+	o.SourceWorkload = cfg.SourceWorkload
+	o.SourceWorkloadFields = cfg.SourceWorkloadFields
+	o.MaxHeaders = cfg.MaxHeaders
+	o.MaxHeaderBytes = int(cfg.MaxHeaderBytes)
+	o.TruncateHeaders = cfg.HeaderLimitAction == headerLimitActionTruncate
+	if cfg.ParseJWT {
+		o.JWTHeader = cfg.JWTHeader
+	}
 }
 
 type envoyExtAuthzGrpcServer struct {
-	cfg                    Config
-	server                 *grpc.Server
-	manager                *plugins.Manager
-	preparedQuery          *rego.PreparedEvalQuery
-	preparedQueryDoOnce    *sync.Once
-	interQueryBuiltinCache iCache.InterQueryCache
-	distributedTracingOpts tracing.Options
-	metricAuthzDuration    prometheus.HistogramVec
-	metricErrorCounter     prometheus.CounterVec
+	name                      string
+	cfg                       atomic.Pointer[Config]
+	cfgMtx                    sync.Mutex // Serializes the updates of cfg.
+	server                    *grpc.Server
+	tlsServer                 *grpc.Server
+	manager                   *plugins.Manager
+	interQueryBuiltinCache    iCache.InterQueryCache
+	interQueryCacheCancel     context.CancelFunc
+	distributedTracingOpts    tracing.Options
+	metricAuthzDuration       prometheus.HistogramVec
+	metricAuthzSummary        *prometheus.SummaryVec
+	metricInputBuildDuration  prometheus.HistogramVec
+	metricErrorCounter        prometheus.CounterVec
+	metricSlowDecisionCounter prometheus.Counter
+	regoMetrics               *regoMetrics
+	otelMetrics               *otelMetrics
+	inputCache                *inputCache
+	circuitBreaker            *circuitBreaker
+	rateLimiter               *rateLimiter
+	evalPool                  *evalPool
+	jwtVerifier               *jwtVerifier
+	decisionFile              *decisionFile
+	protoSet                  atomic.Pointer[protoregistry.Files]
+	protoWatcher              *fsnotify.Watcher
+	grpcWebServer             *http.Server
+	debugServer               *http.Server
+	listenerAddr              atomic.Pointer[net.Addr]
+	serving                   atomic.Bool
+	bundlesActivated          atomic.Bool
+	startupProbePassed        atomic.Bool
 }
 
 type envoyExtAuthzV2Wrapper struct {
@@ -236,10 +1011,21 @@ type envoyExtAuthzV2Wrapper struct {
 }
 
 func (p *envoyExtAuthzGrpcServer) ParsedQuery() ast.Body {
-	return p.cfg.parsedQuery
+	return p.config().parsedQuery
+}
+
+// config returns the plugin configuration. It is never modified, Reconfigure
+// replaces it, so it is safe to use while the plugin is being reconfigured.
+func (p *envoyExtAuthzGrpcServer) config() *Config {
+	return p.cfg.Load()
 }
 
 func (p *envoyExtAuthzGrpcServer) Store() storage.Store {
+	// data-overlay requires a restart to change, cfg.DataOverlay is not
+	// updated by Reconfigure.
+	if p.config().DataOverlay != nil {
+		return overlayStore{p.manager.Store}
+	}
 	return p.manager.Store
 }
 
@@ -255,52 +1041,124 @@ func (p *envoyExtAuthzGrpcServer) Runtime() *ast.Term {
 	return p.manager.Info
 }
 
-func (p *envoyExtAuthzGrpcServer) PreparedQueryDoOnce() *sync.Once {
-	return p.preparedQueryDoOnce
-}
-
 func (p *envoyExtAuthzGrpcServer) InterQueryBuiltinCache() iCache.InterQueryCache {
 	return p.interQueryBuiltinCache
 }
 
-func (p *envoyExtAuthzGrpcServer) PreparedQuery() *rego.PreparedEvalQuery {
-	return p.preparedQuery
-}
-
-func (p *envoyExtAuthzGrpcServer) SetPreparedQuery(pq *rego.PreparedEvalQuery) {
-	p.preparedQuery = pq
-}
-
-func (p *envoyExtAuthzGrpcServer) Logger() logging.Logger {
-	return p.manager.Logger()
-}
-
 func (p *envoyExtAuthzGrpcServer) DistributedTracing() tracing.Options {
 	return p.distributedTracingOpts
 }
 
 func (p *envoyExtAuthzGrpcServer) Start(ctx context.Context) error {
-	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
+	p.manager.UpdatePluginStatus(p.name, &plugins.Status{State: plugins.StateNotReady})
+	if cfg := p.config(); cfg.WaitForBundle {
+		p.waitForBundles()
+	}
+	if cfg := p.config(); cfg.WatchProtoDescriptor && cfg.ProtoDescriptor != "" {
+		if err := p.watchProtoDescriptor(cfg.ProtoDescriptor); err != nil {
+			p.Logger().WithFields(map[string]interface{}{"err": err}).Error("Unable to watch proto descriptor.")
+		}
+	}
+	if p.grpcWebServer != nil {
+		go p.listenGRPCWeb()
+	}
+	if p.debugServer != nil {
+		go p.listenDebug()
+	}
 	go p.listen()
 	return nil
 }
 
 func (p *envoyExtAuthzGrpcServer) Stop(ctx context.Context) {
+	if p.protoWatcher != nil {
+		p.protoWatcher.Close()
+	}
+	p.manager.UnregisterPluginStatusListener(p.name)
+	p.serving.Store(false)
+	p.stopGRPCWeb(ctx)
+	p.stopDebug(ctx)
 	p.server.Stop()
-	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
+	if p.tlsServer != nil {
+		p.tlsServer.Stop()
+	}
+	if p.evalPool != nil {
+		p.evalPool.Close()
+	}
+	p.interQueryCacheCancel()
+	if p.decisionFile != nil {
+		p.decisionFile.Close()
+	}
+	p.manager.UpdatePluginStatus(p.name, &plugins.Status{State: plugins.StateNotReady})
 }
 
-func (p *envoyExtAuthzGrpcServer) Reconfigure(ctx context.Context, config interface{}) {
-	return
+// Reconfigure updates the queries evaluated by the plugin. Changes to the
+// server settings (address, message sizes, etc.) only take effect after a
+// restart, as does setting response-path when it was unset, which registers
+// the ResponseAuthorization service.
+func (p *envoyExtAuthzGrpcServer) Reconfigure(ctx context.Context, config interface{}) {
+	newCfg := *config.(*Config)
+	if err := newCfg.parseQuery(); err != nil {
+		p.Logger().WithFields(map[string]interface{}{"err": err}).Error("Unable to reconfigure plugin.")
+		return
+	}
+
+	p.cfgMtx.Lock()
+	defer p.cfgMtx.Unlock()
+
+	// Checks in flight keep the previous configuration and its queries.
+	cfg := *p.config()
+	defer p.cfg.Store(&cfg)
+
+	if !sameAdditionalQueries(cfg.additionalQueries, newCfg.additionalQueries) {
+		cfg.AdditionalPaths = newCfg.AdditionalPaths
+		cfg.additionalQueries = newCfg.additionalQueries
+	}
+
+	cfg.AdditionalPathsStrategy = newCfg.AdditionalPathsStrategy
+
+	if !sameQuery(cfg.responseQuery, newCfg.responseQuery) {
+		cfg.ResponsePath = newCfg.ResponsePath
+		cfg.responseQuery = newCfg.responseQuery
+	}
+
+	if !sameGRPCMethodQueries(cfg.grpcMethodQueries, newCfg.grpcMethodQueries) {
+		cfg.GRPCMethodPaths = newCfg.GRPCMethodPaths
+		cfg.grpcMethodQueries = newCfg.grpcMethodQueries
+	}
+
+	if cfg.parsedQuery.Equal(newCfg.parsedQuery) {
+		return
+	}
+
+	cfg.Path = newCfg.Path
+	cfg.Query = newCfg.Query
+	cfg.parsedQuery = newCfg.parsedQuery
+	cfg.query = newQuery(newCfg.parsedQuery)
 }
 
 func (p *envoyExtAuthzGrpcServer) compilerUpdated(txn storage.Transaction) {
-	p.preparedQueryDoOnce = new(sync.Once)
+	cfg := p.config()
+	cfg.query.reset()
+	for _, q := range cfg.additionalQueries {
+		q.reset()
+	}
+	if q := cfg.responseQuery; q != nil {
+		q.reset()
+	}
+	for _, q := range cfg.grpcMethodQueries {
+		q.query.reset()
+	}
+
+	// Probe the new policies once they have been committed.
+	if cfg.StartupProbeInput != nil && p.serving.Load() && !p.startupProbePassed.Load() {
+		go p.reportReady()
+	}
 }
 
 func (p *envoyExtAuthzGrpcServer) listen() {
-	logger := p.manager.Logger()
-	addr := p.cfg.Addr
+	logger := p.Logger()
+	cfg := p.config()
+	addr := cfg.Addr
 	if !strings.Contains(addr, "://") {
 		addr = "grpc://" + addr
 	}
@@ -326,24 +1184,43 @@ func (p *envoyExtAuthzGrpcServer) listen() {
 		}
 		l, err = net.Listen("unix", socketPath)
 	case "grpc":
-		l, err = net.Listen("tcp", parsedURL.Host)
+		l, err = cfg.listenConfig().Listen(context.Background(), "tcp", parsedURL.Host)
 	default:
 		err = fmt.Errorf("invalid url scheme %q", parsedURL.Scheme)
 	}
 
 	if err != nil {
 		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to create listener.")
+		return
+	}
+
+	// With port 0 the address the listener is bound to is only known now.
+	boundAddr := l.Addr()
+	p.listenerAddr.Store(&boundAddr)
+
+	if p.tlsServer != nil {
+		mux := newTLSMuxListener(l, cfg.grpcConnectionTimeout)
+		l = mux.plain
+		go func() {
+			if err := p.tlsServer.Serve(mux.tls); err != nil {
+				logger.WithFields(map[string]interface{}{"err": err}).Error("TLS listener failed.")
+			}
+		}()
 	}
 
 	logger.WithFields(map[string]interface{}{
-		"addr":              p.cfg.Addr,
-		"query":             p.cfg.Query,
-		"path":              p.cfg.Path,
-		"dry-run":           p.cfg.DryRun,
-		"enable-reflection": p.cfg.EnableReflection,
+		"addr":              cfg.Addr,
+		"bound-addr":        boundAddr.String(),
+		"query":             cfg.Query,
+		"path":              cfg.Path,
+		"dry-run":           cfg.DryRun,
+		"dry-run-paths":     cfg.DryRunPaths,
+		"enable-reflection": cfg.EnableReflection,
+		"tls-mux":           p.tlsServer != nil,
 	}).Info("Starting gRPC server.")
 
-	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateOK})
+	p.serving.Store(true)
+	p.reportReady()
 
 	if err := p.server.Serve(l); err != nil {
 		logger.WithFields(map[string]interface{}{"err": err}).Error("Listener failed.")
@@ -351,7 +1228,18 @@ func (p *envoyExtAuthzGrpcServer) listen() {
 	}
 
 	logger.Info("Listener exited.")
-	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
+	p.serving.Store(false)
+	p.listenerAddr.Store(nil)
+	p.manager.UpdatePluginStatus(p.name, &plugins.Status{State: plugins.StateNotReady})
+}
+
+// Addr returns the address the gRPC server is listening on, e.g. the port
+// chosen for an addr with port 0, or nil if it is not listening.
+func (p *envoyExtAuthzGrpcServer) Addr() net.Addr {
+	if addr := p.listenerAddr.Load(); addr != nil {
+		return *addr
+	}
+	return nil
 }
 
 // Check is envoy.service.auth.v3.Authorization/Check
@@ -362,7 +1250,7 @@ func (p *envoyExtAuthzGrpcServer) Check(ctx context.Context, req *ext_authz_v3.C
 	}
 
 	if err != nil {
-		return resp, err.Unwrap()
+		return resp, err.grpcError()
 	}
 	return resp, nil
 }
@@ -372,16 +1260,73 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 	var evalErr error
 	var internalErr Error
 	start := time.Now()
-	logger := p.manager.Logger()
+	logger := p.Logger()
+	cfg := p.config()
+
+	// Check requests up to oversized-message-max-size are received to be
+	// denied here rather than rejected by the gRPC server.
+	if cfg.OversizedMessageDecision == oversizedMessageDecisionDeny {
+		if msg, ok := req.(proto.Message); ok {
+			if size := proto.Size(msg); size > int(cfg.GRPCMaxRecvMsgSize) {
+				method, _ := grpc.Method(ctx)
+				p.logOversizedMessage(ctx, method, size, int(cfg.GRPCMaxRecvMsgSize), "grpc-max-recv-msg-size", true)
+				return oversizedCheck(cfg), func() *rpc_status.Status { return nil }, nil
+			}
+		}
+	}
+
+	if cfg.WaitForBundle && !p.bundlesActivated.Load() {
+		resp, internalErr := preBundleCheck(cfg)
+		return resp, func() *rpc_status.Status { return nil }, internalErr
+	}
+
+	// Bypassed paths, e.g. health checks, are neither rate limited nor
+	// answered by the circuit breaker, and do not take its half-open slot.
+	bypassed := matchesPaths(cfg.BypassPaths, req)
+
+	// Rate limited checks must not take the half-open slot of the circuit
+	// breaker.
+	if p.rateLimiter != nil && !bypassed {
+		if id, ok := p.rateLimiter.identity(req); ok && !p.rateLimiter.Allow(id) {
+			logger.WithFields(map[string]interface{}{"rate-limit-key": id}).Debug("Check request rate limited.")
+			return rateLimitedCheck(cfg), func() *rpc_status.Status { return nil }, nil
+		}
+	}
+
+	if p.circuitBreaker != nil && !bypassed {
+		allowed, probe := p.circuitBreaker.Allow()
+		if !allowed {
+			resp, internalErr := circuitOpenCheck(cfg)
+			return resp, func() *rpc_status.Status { return nil }, internalErr
+		}
+		// Frees the half-open slot if the check ends without recording the
+		// outcome of an evaluation, e.g. with an invalid request.
+		defer p.circuitBreaker.Release(probe)
+	}
+
+	var requestID string
+	var isHTTP bool
+	if cfg.RequestIDHeader != "" {
+		requestID, isHTTP = requestHeader(req, cfg.RequestIDHeader)
+	}
 
-	result, stopeval, err := envoyauth.NewEvalResult()
+	// The request ID, if any, is used as the decision ID to correlate the
+	// decision log with the request logs.
+	result, stopeval, err := envoyauth.NewEvalResult(func(r *envoyauth.EvalResult) {
+		r.DecisionID = requestID
+	})
 	if err != nil {
 		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to start new evaluation.")
 		internalErr = internalError(StartCheckErr, err)
 		return nil, func() *rpc_status.Status { return nil }, &internalErr
 	}
+	result.CountExpressions = p.regoMetrics != nil && p.regoMetrics.countExpressions()
+	result.ResponseHeaderAppendAction = cfg.responseHeaderAppendAction
+	if explainRequested(cfg, req) {
+		result.Tracer = topdown.NewBufferTracer()
+	}
 
-	txn, txnClose, err := result.GetTxn(ctx, p.Store())
+	txn, txnClose, err := p.getTxn(ctx, result)
 	if err != nil {
 		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to start new storage transaction.")
 		internalErr = internalError(StartTxnErr, err)
@@ -394,36 +1339,95 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 
 	var input map[string]interface{}
 
+	// The query and path of the decision log, those of grpc-method-paths for
+	// gRPC methods mapped to a path.
+	logQuery, logPath := cfg.Query, cfg.Path
+	evalContext := cfg.query.evalContext(p)
+	if q, ok := cfg.grpcMethodQuery(req); ok {
+		logQuery, logPath = "", q.path
+		evalContext = q.query.evalContext(p)
+	}
+
 	stop := func() *rpc_status.Status {
 		stopeval()
-		if p.cfg.EnablePerformanceMetrics {
+		if internalErr.Code != "" {
+			logger.WithFields(map[string]interface{}{
+				"err":            internalErr.Unwrap(),
+				"error_code":     internalErr.Code,
+				"error_category": internalErr.Category().Error(),
+			}).Error("Unable to process check request.")
+		}
+		p.logDecisionSummary(cfg, req, result, internalErr, float64(time.Since(start))/float64(time.Millisecond))
+		if cfg.EnablePerformanceMetrics {
 			var topdownError *topdown.Error
 			if internalErr.Unwrap() != nil && errors.As(internalErr.Unwrap(), &topdownError) {
-				p.metricErrorCounter.With(prometheus.Labels{"reason": topdownError.Code}).Inc()
+				p.countError(ctx, topdownError.Code)
 			} else if internalErr.Code != "" {
-				p.metricErrorCounter.With(prometheus.Labels{"reason": internalErr.Code}).Inc()
+				p.countError(ctx, internalErr.Code)
 			}
 		}
-		logErr := p.log(ctx, input, result, err)
+		if result.Tracer != nil {
+			logger.WithFields(map[string]interface{}{
+				"explanation": explanation(*result.Tracer, maxExplanationBytes),
+			}).Info("Policy evaluation explanation.")
+		}
+		logErr := p.log(ctx, logQuery, logPath, input, result, err)
 		if logErr != nil {
 			_ = txnClose(ctx, logErr) // Ignore error
-			p.Logger().WithFields(map[string]interface{}{"err": logErr}).Debug("Error when logging event")
-			if p.cfg.EnablePerformanceMetrics {
-				p.metricErrorCounter.With(prometheus.Labels{"reason": "unknown_log_error"}).Inc()
-			}
-			return &rpc_status.Status{
-				Code:    int32(code.Code_UNKNOWN),
-				Message: logErr.Error(),
+			if cfg.EnablePerformanceMetrics {
+				p.countError(ctx, "unknown_log_error")
 			}
+			return logErrorStatus(cfg, logger, logErr)
 		}
 		_ = txnClose(ctx, evalErr) // Ignore error
 		return nil
 	}
 
-	input, err = envoyauth.RequestToInput(req, logger, p.cfg.protoSet, p.cfg.SkipRequestBodyParse)
-	if err != nil {
-		internalErr = internalError(RequestParseErr, err)
-		return nil, stop, &internalErr
+	result.Metrics.Counter(requestBodyBytesCounter).Add(uint64(requestBodySize(req)))
+
+	if bypassed {
+		// Skip the input and the policy, the decision log only records the
+		// bypass.
+		result.Decision = bypassDecision()
+		return bypassResponse(), stop, nil
+	}
+
+	var inputValue ast.Value
+	var cacheKey inputKey
+	cached := false
+	useCache := p.inputCache != nil
+	if useCache {
+		defer withoutVolatileAttributes(req)()
+		if cacheKey, err = inputCacheKey(req); err != nil {
+			logger.WithFields(map[string]interface{}{"err": err}).Debug("Unable to compute input cache key.")
+			useCache = false
+		} else {
+			input, inputValue, cached = p.inputCache.Get(cacheKey)
+		}
+	}
+
+	// Time spent building the input, without verifying the JWT.
+	var inputBuildDuration time.Duration
+
+	if !cached {
+		inputBuildStart := time.Now()
+		input, err = envoyauth.RequestToInput(req, logger, p.protoSet.Load(), cfg.SkipRequestBodyParse, cfg.inputOptions)
+		inputBuildDuration = time.Since(inputBuildStart)
+		if err != nil {
+			if errors.Is(err, envoyauth.ErrHeaderLimitExceeded) {
+				err = status.Error(codes.InvalidArgument, err.Error())
+			}
+			internalErr = internalError(RequestParseErr, err)
+			return nil, stop, &internalErr
+		}
+
+		if cfg.ExplainHeader != "" {
+			removeRequestHeader(input, cfg.ExplainHeader)
+		}
+
+		if _, ok := input["parsed_jwt"]; ok && p.jwtVerifier != nil {
+			p.verifyJWT(ctx, req, cfg.JWTHeader, input, logger)
+		}
 	}
 
 	if ctx.Err() != nil {
@@ -432,19 +1436,112 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 		return nil, stop, &internalErr
 	}
 
-	var inputValue ast.Value
-	inputValue, err = ast.InterfaceToValue(input)
-	if err != nil {
-		internalErr = internalError(InputParseErr, err)
-		return nil, stop, &internalErr
+	if !cached {
+		inputBuildStart := time.Now()
+		inputValue, err = ast.InterfaceToValue(input)
+		if err != nil {
+			internalErr = internalError(InputParseErr, err)
+			return nil, stop, &internalErr
+		}
+		inputBuildDuration += time.Since(inputBuildStart)
+
+		if cfg.EnablePerformanceMetrics {
+			p.metricInputBuildDuration.
+				With(prometheus.Labels{"body_parsed": strconv.FormatBool(bodyParsed(input))}).
+				Observe(inputBuildDuration.Seconds())
+			if p.otelMetrics != nil {
+				p.otelMetrics.observeInputBuildDuration(ctx, inputBuildDuration.Seconds(), bodyParsed(input))
+			}
+		}
+
+		if useCache {
+			p.inputCache.Add(cacheKey, input, inputValue)
+		}
+	}
+
+	if len(cfg.InputEnrichment) > 0 {
+		var fields map[string]interface{}
+		fields, err = inputEnrichmentFields(ctx, p.Store(), result.Txn, cfg.InputEnrichment, input, logger)
+		if err != nil {
+			internalErr = internalError(InputEnrichmentErr, err)
+			return nil, stop, &internalErr
+		}
+		if len(fields) > 0 {
+			input, inputValue, err = enrichInput(input, inputValue, fields)
+			if err != nil {
+				internalErr = internalError(InputParseErr, err)
+				return nil, stop, &internalErr
+			}
+		}
+	}
+
+	if b := callBaggage(ctx); b.Len() > 0 {
+		input, inputValue, err = addCallBaggage(input, inputValue, b)
+		if err != nil {
+			internalErr = internalError(InputParseErr, err)
+			return nil, stop, &internalErr
+		}
+	}
+
+	if cfg.InputRootKey != "" {
+		inputValue = ast.NewObject(ast.Item(ast.StringTerm(cfg.InputRootKey), ast.NewTerm(inputValue)))
+	}
+
+	if cfg.LogInput {
+		p.logInput(ctx, result.Txn, cfg, input, result.DecisionID, logger)
+	}
+
+	evalCtx := ctx
+	if cfg.DataOverlay != nil {
+		var overlay map[string]interface{}
+		var found bool
+		overlay, found, err = cfg.DataOverlay.lookup(ctx, p.Store(), result.Txn, input, logger)
+		if err != nil {
+			internalErr = internalError(DataOverlayErr, err)
+			return nil, stop, &internalErr
+		}
+		if found {
+			evalCtx = withDataOverlay(evalCtx, overlay)
+		}
+	}
+	if cfg.evalTimeout > 0 {
+		var cancel context.CancelFunc
+		evalCtx, cancel = context.WithTimeout(evalCtx, cfg.evalTimeout)
+		defer cancel()
 	}
 
-	if err = envoyauth.Eval(ctx, p, inputValue, result); err != nil {
-		evalErr = err
-		internalErr = internalError(EnvoyAuthEvalErr, err)
+	if evalInternalErr := p.eval(ctx, evalCtx, cfg, evalContext, inputValue, result, logger); evalInternalErr != nil {
+		err, evalErr = evalInternalErr.Unwrap(), evalInternalErr.Unwrap()
+		internalErr = *evalInternalErr
 		return nil, stop, &internalErr
 	}
 
+	if len(cfg.additionalQueries) > 0 {
+		decisions := []interface{}{result.Decision}
+		for _, q := range cfg.additionalQueries {
+			additionalResult := &envoyauth.EvalResult{
+				DecisionID: result.DecisionID,
+				Txn:        result.Txn,
+				Metrics:    result.Metrics,
+				Tracer:     result.Tracer,
+			}
+			if evalInternalErr := p.eval(ctx, evalCtx, cfg, q.evalContext(p), inputValue, additionalResult, logger); evalInternalErr != nil {
+				err, evalErr = evalInternalErr.Unwrap(), evalInternalErr.Unwrap()
+				internalErr = *evalInternalErr
+				return nil, stop, &internalErr
+			}
+			decisions = append(decisions, additionalResult.Decision)
+			result.NDBuiltinCache = mergeNDBCache(result.NDBuiltinCache, additionalResult.NDBuiltinCache)
+		}
+
+		result.Decision, err = mergeDecisions(decisions, cfg.AdditionalPathsStrategy)
+		if err != nil {
+			err = errors.Wrap(err, "failed to merge decisions of additional-paths")
+			internalErr = internalError(EnvoyAuthResultErr, err)
+			return nil, stop, &internalErr
+		}
+	}
+
 	resp := &ext_authz_v3.CheckResponse{}
 
 	var allowed bool
@@ -462,23 +1559,39 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 	resp.Status = &rpc_status.Status{Code: status}
 
 	switch result.Decision.(type) {
+	case bool:
+		// Boolean decisions carry no headers, body or metadata, so the status
+		// set above is the whole response, unless a default denial is set.
+		if !allowed {
+			if deniedResponse := cfg.defaultDeniedResponse(); deniedResponse != nil {
+				resp.HttpResponse = &ext_authz_v3.CheckResponse_DeniedResponse{DeniedResponse: deniedResponse}
+			}
+		}
 	case map[string]interface{}:
-		var responseHeaders []*ext_core_v3.HeaderValueOption
-		responseHeaders, err = result.GetResponseEnvoyHeaderValueOptions()
+		var dynamicMetadata *_structpb.Struct
+		dynamicMetadata, err = result.GetDynamicMetadata()
 		if err != nil {
-			err = errors.Wrap(err, "failed to get response headers")
+			err = errors.Wrap(err, "failed to get dynamic metadata")
 			internalErr = internalError(EnvoyAuthResultErr, err)
 			return nil, stop, &internalErr
 		}
+		resp.DynamicMetadata = dynamicMetadata
 
-		var dynamicMetadata *_structpb.Struct
-		dynamicMetadata, err = result.GetDynamicMetadata()
+		var location string
+		location, err = result.GetResponseRedirect()
 		if err != nil {
-			err = errors.Wrap(err, "failed to get dynamic metadata")
+			err = errors.Wrap(err, "failed to get response redirect")
 			internalErr = internalError(EnvoyAuthResultErr, err)
 			return nil, stop, &internalErr
 		}
-		resp.DynamicMetadata = dynamicMetadata
+
+		// An OkResponse has no status, so Envoy can only redirect a request
+		// through a denied response: an allowed request with a redirect is
+		// answered like a denied one, and still logged as allowed.
+		if allowed && location != "" {
+			status = int32(code.Code_PERMISSION_DENIED)
+			resp.Status = &rpc_status.Status{Code: status}
+		}
 
 		if status == int32(code.Code_OK) {
 
@@ -490,30 +1603,73 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 				return nil, stop, &internalErr
 			}
 
-			var responseHeadersToAdd []*ext_core_v3.HeaderValueOption
-			responseHeadersToAdd, err = result.GetResponseHTTPHeadersToAdd()
+			var upstreamHeaders []*ext_core_v3.HeaderValueOption
+			upstreamHeaders, err = result.GetUpstreamHeaders()
+			if err != nil {
+				err = errors.Wrap(err, "failed to get headers to send to upstream")
+				internalErr = internalError(EnvoyAuthResultErr, err)
+				return nil, stop, &internalErr
+			}
+
+			var clientHeaders []*ext_core_v3.HeaderValueOption
+			clientHeaders, err = result.GetClientResponseHeaders()
 			if err != nil {
 				err = errors.Wrap(err, "failed to get response headers to send to client")
 				internalErr = internalError(EnvoyAuthResultErr, err)
 				return nil, stop, &internalErr
 			}
 
+			var queryParametersToSet []*ext_core_v3.QueryParameter
+			queryParametersToSet, err = result.GetQueryParametersToSet()
+			if err != nil {
+				err = errors.Wrap(err, "failed to get query parameters to set")
+				internalErr = internalError(EnvoyAuthResultErr, err)
+				return nil, stop, &internalErr
+			}
+
+			var queryParametersToRemove []string
+			queryParametersToRemove, err = result.GetQueryParametersToRemove()
+			if err != nil {
+				err = errors.Wrap(err, "failed to get query parameters to remove")
+				internalErr = internalError(EnvoyAuthResultErr, err)
+				return nil, stop, &internalErr
+			}
+
 			resp.HttpResponse = &ext_authz_v3.CheckResponse_OkResponse{
 				OkResponse: &ext_authz_v3.OkHttpResponse{
-					Headers:              responseHeaders,
-					HeadersToRemove:      headersToRemove,
-					ResponseHeadersToAdd: responseHeadersToAdd,
+					Headers:                 upstreamHeaders,
+					HeadersToRemove:         headersToRemove,
+					ResponseHeadersToAdd:    clientHeaders,
+					QueryParametersToSet:    queryParametersToSet,
+					QueryParametersToRemove: queryParametersToRemove,
 				},
 			}
 		} else {
-			var body string
-			body, err = result.GetResponseBody()
+			// The headers of a denied request are sent to the client, with
+			// the response of the plugin.
+			var responseHeaders []*ext_core_v3.HeaderValueOption
+			responseHeaders, err = result.GetResponseEnvoyHeaderValueOptions()
+			if err != nil {
+				err = errors.Wrap(err, "failed to get response headers")
+				internalErr = internalError(EnvoyAuthResultErr, err)
+				return nil, stop, &internalErr
+			}
+
+			var body []byte
+			var isJSONBody bool
+			body, isJSONBody, err = result.GetResponseBodyBytes()
 			if err != nil {
 				err = errors.Wrap(err, "failed to get response body")
 				internalErr = internalError(EnvoyAuthResultErr, err)
 				return nil, stop, &internalErr
 			}
 
+			if isJSONBody && !hasHeader(responseHeaders, "content-type") {
+				responseHeaders = append(responseHeaders, &ext_core_v3.HeaderValueOption{
+					Header: &ext_core_v3.HeaderValue{Key: "Content-Type", Value: "application/json"},
+				})
+			}
+
 			var httpStatus *ext_type_v3.HttpStatus
 			httpStatus, err = result.GetResponseEnvoyHTTPStatus()
 			if err != nil {
@@ -522,9 +1678,53 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 				return nil, stop, &internalErr
 			}
 
+			if allowed && (httpStatus.GetCode() < 300 || httpStatus.GetCode() >= 400) {
+				err = fmt.Errorf("invalid http_status %d for the redirect of an allowed request, expected a 3xx status", httpStatus.GetCode())
+				internalErr = internalError(EnvoyAuthResultErr, err)
+				return nil, stop, &internalErr
+			}
+
+			if location != "" {
+				responseHeaders = append(responseHeaders, &ext_core_v3.HeaderValueOption{
+					Header: &ext_core_v3.HeaderValue{Key: "Location", Value: location},
+				})
+			}
+
+			var challenges []string
+			challenges, err = result.GetResponseChallenges()
+			if err != nil {
+				err = errors.Wrap(err, "failed to get response challenge")
+				internalErr = internalError(EnvoyAuthResultErr, err)
+				return nil, stop, &internalErr
+			}
+
+			if len(challenges) > 0 && !hasHeader(responseHeaders, "www-authenticate") {
+				for _, challenge := range challenges {
+					responseHeaders = append(responseHeaders, &ext_core_v3.HeaderValueOption{
+						Header: &ext_core_v3.HeaderValue{Key: "WWW-Authenticate", Value: challenge},
+					})
+				}
+			}
+
+			if cfg.DeniedReasonHeader != "" && !hasHeader(responseHeaders, cfg.DeniedReasonHeader) {
+				var reason string
+				reason, err = result.GetReason()
+				if err != nil {
+					err = errors.Wrap(err, "failed to get denial reason")
+					internalErr = internalError(EnvoyAuthResultErr, err)
+					return nil, stop, &internalErr
+				}
+
+				if reason != "" {
+					responseHeaders = append(responseHeaders, &ext_core_v3.HeaderValueOption{
+						Header: &ext_core_v3.HeaderValue{Key: cfg.DeniedReasonHeader, Value: deniedReasonHeaderValue(reason)},
+					})
+				}
+			}
+
 			deniedResponse := &ext_authz_v3.DeniedHttpResponse{
 				Headers: responseHeaders,
-				Body:    body,
+				Body:    string(body),
 				Status:  httpStatus,
 			}
 
@@ -536,25 +1736,69 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 
 	totalDecisionTime := time.Since(start)
 
-	if p.cfg.EnablePerformanceMetrics {
+	if cfg.EnablePerformanceMetrics {
 		p.metricAuthzDuration.
 			With(prometheus.Labels{"handler": "check"}).
 			Observe(float64(totalDecisionTime.Seconds()))
+		if p.metricAuthzSummary != nil {
+			p.metricAuthzSummary.
+				With(prometheus.Labels{"handler": "check"}).
+				Observe(totalDecisionTime.Seconds())
+		}
+		if p.regoMetrics != nil {
+			p.regoMetrics.observe(result.Metrics)
+		}
+		if p.otelMetrics != nil {
+			p.otelMetrics.observeAuthzDuration(ctx, totalDecisionTime.Seconds())
+		}
+	}
+
+	if cfg.slowDecisionThreshold > 0 && totalDecisionTime > cfg.slowDecisionThreshold {
+		if p.metricSlowDecisionCounter != nil {
+			p.metricSlowDecisionCounter.Inc()
+		}
+		if p.otelMetrics != nil {
+			p.otelMetrics.countSlowDecision(ctx)
+		}
+		logger.WithFields(map[string]interface{}{
+			"query":               evalContext.ParsedQuery().String(),
+			"threshold":           cfg.slowDecisionThreshold,
+			"metrics":             result.Metrics.All(),
+			"total_decision_time": totalDecisionTime,
+		}).Warn("Policy decision exceeded the slow decision threshold.")
+	}
+
+	if p.manager.TracerProvider() != nil {
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("opa.decision_id", result.DecisionID),
+			attribute.Bool("opa.decision.allowed", allowed),
+			attribute.String("opa.query", evalContext.ParsedQuery().String()),
+			attribute.Int64("opa.decision.eval_duration_ns", result.Metrics.Timer(metrics.RegoQueryEval).Int64()),
+			attribute.Int64("opa.decision.total_duration_ns", totalDecisionTime.Nanoseconds()),
+		)
 	}
 
-	p.manager.Logger().WithFields(map[string]interface{}{
-		"query":               p.cfg.parsedQuery.String(),
-		"dry-run":             p.cfg.DryRun,
-		"decision":            result.Decision,
-		"err":                 err,
-		"txn":                 result.TxnID,
-		"metrics":             result.Metrics.All(),
-		"total_decision_time": totalDecisionTime,
-	}).Debug("Returning policy decision.")
+	dryRun := cfg.dryRun(req)
+
+	if logger.GetLevel() >= logging.Debug {
+		p.Logger().WithFields(map[string]interface{}{
+			"query":               evalContext.ParsedQuery().String(),
+			"dry-run":             dryRun,
+			"decision":            result.Decision,
+			"err":                 err,
+			"txn":                 result.TxnID,
+			"metrics":             result.Metrics.All(),
+			"total_decision_time": totalDecisionTime,
+		}).Debug("Returning policy decision.")
+	}
+
+	bodyBytes, headersBytes := responseSize(resp)
+	result.Metrics.Counter(responseBodyBytesCounter).Add(uint64(bodyBytes))
+	result.Metrics.Counter(responseHeadersBytesCounter).Add(uint64(headersBytes))
 
 	// If dry-run mode, override the Status code to unconditionally Allow the request
 	// DecisionLogging should reflect what "would" have happened
-	if p.cfg.DryRun {
+	if dryRun {
 		if resp.Status.Code != int32(code.Code_OK) {
 			resp.Status = &rpc_status.Status{Code: int32(code.Code_OK)}
 			resp.HttpResponse = &ext_authz_v3.CheckResponse_OkResponse{
@@ -563,6 +1807,10 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 		}
 	}
 
+	if cfg.RequestIDResponseHeader && isHTTP {
+		addResponseHeader(resp, cfg.RequestIDHeader, result.DecisionID)
+	}
+
 	// Add decision_id to dynamic metadata
 	if resp.DynamicMetadata == nil {
 		resp.DynamicMetadata = &_structpb.Struct{
@@ -576,40 +1824,292 @@ func (p *envoyExtAuthzGrpcServer) check(ctx context.Context, req interface{}) (*
 		},
 	}
 
+	// The decision is informational, a decision that cannot be added does not
+	// fail the check.
+	if cfg.DecisionMetadataKey != "" {
+		if v, err := decisionMetadata(result.Decision, int(cfg.DecisionMetadataMaxSize)); err != nil {
+			logger.WithFields(map[string]interface{}{"err": err, "decision-id": result.DecisionID}).Warn("Unable to add the decision to the dynamic metadata.")
+		} else {
+			resp.DynamicMetadata.Fields[cfg.DecisionMetadataKey] = v
+		}
+	}
+
+	// A decision with an invalid cache_ttl is not reused, the check is not
+	// failed.
+	if cfg.CacheTTLMetadataKey != "" {
+		if ttl, ok, err := result.GetCacheTTL(); err != nil {
+			logger.WithFields(map[string]interface{}{"err": err, "decision-id": result.DecisionID}).Warn("Unable to add the cache TTL to the dynamic metadata.")
+		} else if ok {
+			resp.DynamicMetadata.Fields[cfg.CacheTTLMetadataKey] = &_structpb.Value{
+				Kind: &_structpb.Value_NumberValue{
+					NumberValue: ttl.Seconds(),
+				},
+			}
+		}
+	}
+
+	if cfg.DynamicMetadataNamespace != "" {
+		resp.DynamicMetadata = &_structpb.Struct{
+			Fields: map[string]*_structpb.Value{
+				cfg.DynamicMetadataNamespace: {
+					Kind: &_structpb.Value_StructValue{
+						StructValue: resp.DynamicMetadata,
+					},
+				},
+			},
+		}
+	}
+
 	return resp, stop, nil
 }
 
-func (p *envoyExtAuthzGrpcServer) log(ctx context.Context, input interface{}, result *envoyauth.EvalResult, err error) error {
+// getTxn opens the read transaction of a check. Opening it is retried up to
+// maxTxnAttempts times with exponential backoff from txnRetryDelay if it fails
+// with a transient error, e.g. a write conflict while a bundle is being
+// activated. The last error is returned once the attempts or ctx run out.
+func (p *envoyExtAuthzGrpcServer) getTxn(ctx context.Context, result *envoyauth.EvalResult) (storage.Transaction, envoyauth.TransactionCloser, error) {
+	delay := txnRetryDelay
+	for attempt := 1; ; attempt++ {
+		txn, txnClose, err := result.GetTxn(ctx, p.Store())
+		if err == nil || !transientStorageError(err) || attempt == maxTxnAttempts {
+			return txn, txnClose, err
+		}
+
+		p.Logger().WithFields(map[string]interface{}{
+			"err":     err,
+			"attempt": attempt,
+			"delay":   delay,
+		}).Debug("Retrying storage transaction after transient error.")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return txn, txnClose, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// transientStorageError reports whether opening a transaction failed with an
+// error that may go away on its own, i.e. a write conflict or an internal
+// error of the store.
+func transientStorageError(err error) bool {
+	var serr *storage.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	return serr.Code == storage.WriteConflictErr || serr.Code == storage.InternalErr
+}
+
+// eval evaluates the query of evalContext and sets the decision of result,
+// applying undefined-decision to undefined queries. The returned error wraps
+// the error to record in the decision log.
+func (p *envoyExtAuthzGrpcServer) eval(ctx, evalCtx context.Context, cfg *Config, evalContext envoyauth.EvalContext, input ast.Value, result *envoyauth.EvalResult, logger logging.Logger) *Error {
+	var opts []func(*rego.Rego)
+	if cfg.StrictBuiltinErrors {
+		opts = append(opts, rego.StrictBuiltinErrors(true))
+	}
+
+	evalFn := func() error {
+		return envoyauth.Eval(evalCtx, evalContext, input, result, opts...)
+	}
+
+	var err error
+	if p.evalPool != nil {
+		err = p.evalPool.Run(evalCtx, evalFn)
+		if evalRejected(err) {
+			internalErr := internalError(EvalQueueFullErr, err)
+			return &internalErr
+		}
+	} else {
+		err = evalFn()
+	}
+
+	if p.circuitBreaker != nil && ctx.Err() == nil {
+		p.circuitBreaker.Record(err != nil && !errors.Is(err, envoyauth.ErrUndefinedDecision))
+	}
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == nil && errors.Is(evalCtx.Err(), context.DeadlineExceeded) {
+		logger.WithFields(map[string]interface{}{
+			"query":        evalContext.ParsedQuery().String(),
+			"eval-timeout": cfg.evalTimeout,
+		}).Error("Policy evaluation exceeded the eval timeout.")
+		err = errors.Wrapf(err, "policy evaluation exceeded eval-timeout of %v", cfg.evalTimeout)
+		internalErr := internalError(EvalTimeoutErr, err)
+		return &internalErr
+	}
+
+	undefinedAllowed := cfg.UndefinedDecision == undefinedDecisionAllow
+	if !errors.Is(err, envoyauth.ErrUndefinedDecision) || (!undefinedAllowed && cfg.UndefinedDecision != undefinedDecisionDeny) {
+		internalErr := internalError(EnvoyAuthEvalErr, err)
+		return &internalErr
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"query":              evalContext.ParsedQuery().String(),
+		"undefined-decision": cfg.UndefinedDecision,
+	}).Debug("Policy decision is undefined.")
+	result.Decision = undefinedAllowed
+	return nil
+}
+
+// log logs the decision of the query (deprecated "query" field) or path.
+func (p *envoyExtAuthzGrpcServer) log(ctx context.Context, query, path string, input interface{}, result *envoyauth.EvalResult, err error) error {
+	cfg := p.config()
+
+	// Log the input as seen by the policy.
+	loggedInput := input
+	if in, ok := input.(map[string]interface{}); ok && in != nil {
+		if len(cfg.headerLogTransforms) > 0 {
+			in = transformLoggedHeaders(in, cfg.headerLogTransforms)
+			loggedInput = in
+		}
+		if cfg.InputRootKey != "" {
+			loggedInput = map[string]interface{}{cfg.InputRootKey: in}
+		}
+	}
+
 	info := &server.Info{
 		Timestamp: time.Now(),
-		Input:     &input,
+		Input:     &loggedInput,
 	}
 
-	if p.cfg.Query != "" {
-		info.Query = p.cfg.Query
+	if query != "" {
+		info.Query = query
 	}
 
-	if p.cfg.Path != "" {
-		info.Path = p.cfg.Path
+	if path != "" {
+		info.Path = path
 	}
 
 	sctx := trace.SpanFromContext(ctx).SpanContext()
 	if sctx.IsValid() {
 		info.TraceID = sctx.TraceID().String()
 		info.SpanID = sctx.SpanID().String()
+	} else if traceID, spanID, ok := envoyTraceContext(input); ok {
+		// Without a tracer provider there is no server span; correlate the
+		// decision with the trace context Envoy forwarded instead.
+		info.TraceID = traceID
+		info.SpanID = spanID
+	}
+
+	if result.Tracer != nil {
+		info.Trace = *result.Tracer
 	}
 
-	if result.NDBuiltinCache != nil {
-		x, err := ast.JSON(result.NDBuiltinCache.AsValue())
+	if result.NDBuiltinCache != nil && cfg.LogNDBuiltinCache {
+		x, err := ndBuiltinCacheJSON(result.NDBuiltinCache, cfg.NDBuiltinCacheMaxBytes, p.Logger())
 		if err != nil {
 			return err
 		}
 		info.NDBuiltinCache = &x
 	}
 
+	if cfg.MaxDecisionLogBytes > 0 {
+		decisionlog.SetDecision(info, result, err)
+		if err := truncateDecisionLog(info, cfg.InputRootKey, int(cfg.MaxDecisionLogBytes), p.Logger()); err != nil {
+			return err
+		}
+	}
+
+	// A failure to write the local file must not keep the decision from the
+	// decision logs plugin, and is not reported to Envoy.
+	if p.decisionFile != nil {
+		decisionlog.SetDecision(info, result, err)
+		if err := p.decisionFile.Log(info, mergeLabels(p.manager.Labels(), cfg.DecisionLogLabels), p.filterDecisionFileEvent(ctx)); err != nil {
+			p.Logger().WithFields(map[string]interface{}{"err": err, "decision-id": result.DecisionID}).Error("Unable to write decision to decision-log-file.")
+			if cfg.EnablePerformanceMetrics {
+				p.countError(ctx, "decision_log_file_error")
+			}
+		}
+	}
+
 	return decisionlog.LogDecision(ctx, p.manager, info, result, err)
 }
 
+// requestBodySize returns the size of the HTTP request body sent by Envoy, which
+// may have been truncated by Envoy.
+func requestBodySize(req interface{}) int {
+	switch req := req.(type) {
+	case *ext_authz_v3.CheckRequest:
+		http := req.GetAttributes().GetRequest().GetHttp()
+		return len(http.GetBody()) + len(http.GetRawBody())
+	case *ext_authz_v2.CheckRequest:
+		return len(req.GetAttributes().GetRequest().GetHttp().GetBody())
+	}
+	return 0
+}
+
+// responseSize returns the size of the body and of the headers (keys and
+// values) of the HTTP response returned to Envoy.
+func responseSize(resp *ext_authz_v3.CheckResponse) (int, int) {
+	headersSize := func(headers []*ext_core_v3.HeaderValueOption) int {
+		var size int
+		for _, h := range headers {
+			size += len(h.GetHeader().GetKey()) + len(h.GetHeader().GetValue())
+		}
+		return size
+	}
+
+	switch r := resp.GetHttpResponse().(type) {
+	case *ext_authz_v3.CheckResponse_OkResponse:
+		return 0, headersSize(r.OkResponse.GetHeaders()) + headersSize(r.OkResponse.GetResponseHeadersToAdd())
+	case *ext_authz_v3.CheckResponse_DeniedResponse:
+		return len(r.DeniedResponse.GetBody()), headersSize(r.DeniedResponse.GetHeaders())
+	}
+	return 0, 0
+}
+
+func hasHeader(headers []*ext_core_v3.HeaderValueOption, key string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h.GetHeader().GetKey(), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyParsed reports whether the request body was parsed into the input,
+// successfully or not. Empty and skipped bodies are not parsed.
+func bodyParsed(input map[string]interface{}) bool {
+	if parseErr, _ := input["body_parse_error"].(bool); parseErr {
+		return true
+	}
+	return input["parsed_body"] != nil
+}
+
+// deniedReasonHeaderValue makes the reason of a decision usable as a header
+// value, which cannot span lines.
+func deniedReasonHeaderValue(reason string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(reason)
+}
+
+// envoyTraceContext returns the trace and span IDs exposed at input.trace.
+func envoyTraceContext(input interface{}) (string, string, bool) {
+	in, ok := input.(map[string]interface{})
+	if !ok {
+		return "", "", false
+	}
+
+	traceContext, ok := in["trace"].(map[string]interface{})
+	if !ok {
+		return "", "", false
+	}
+
+	traceID, ok := traceContext["trace_id"].(string)
+	if !ok {
+		return "", "", false
+	}
+
+	spanID, _ := traceContext["span_id"].(string)
+	return traceID, spanID, true
+}
+
 func stringPathToDataRef(s string) (r ast.Ref) {
 	result := ast.Ref{ast.DefaultRootDocument}
 	result = append(result, stringPathToRef(s)...)
@@ -649,7 +2149,7 @@ func (p *envoyExtAuthzV2Wrapper) Check(ctx context.Context, req *ext_authz_v2.Ch
 	}()
 
 	if err != nil {
-		return nil, err.Unwrap()
+		return nil, err.grpcError()
 	}
 	respV2 = v2Response(respV3)
 	return respV2, nil
@@ -6,10 +6,17 @@ package internal
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
 	"testing"
 
 	ext_authz "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
 
 	"github.com/open-policy-agent/opa/util"
 )
@@ -34,3 +41,145 @@ func BenchmarkCheck(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkCheckGzip measures the cost of gzip compression on a loopback
+// connection, with a 64KB request body.
+func BenchmarkCheckGzip(b *testing.B) {
+	var req ext_authz.CheckRequest
+	if err := util.Unmarshal([]byte(exampleAllowedRequest), &req); err != nil {
+		panic(err)
+	}
+	req.Attributes.Request.Http.Body = strings.Repeat(`{"user":"alice","roles":["admin","dev"]}`, 64*1024/40)
+
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("gzip=%v", compress), func(b *testing.B) {
+			server := testAuthzServer(&Config{GRPCEnableGzip: compress}, withCustomLogger(&testPlugin{}))
+
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			go server.server.Serve(lis)
+			defer server.server.Stop()
+
+			conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			var opts []grpc.CallOption
+			if compress {
+				opts = append(opts, grpc.UseCompressor(gzip.Name))
+			}
+			client := ext_authz.NewAuthorizationClient(conn)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				output, err := client.Check(ctx, &req, opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if output.Status.Code != int32(code.Code_OK) {
+					b.Fatal("Expected request to be allowed but got:", output)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCheckEvalWorkers compares evaluating the policy on the goroutines of
+// the requests with evaluating it on a pool of GOMAXPROCS eval-workers, with
+// concurrent checks.
+func BenchmarkCheckEvalWorkers(b *testing.B) {
+	var req ext_authz.CheckRequest
+	if err := util.Unmarshal([]byte(exampleAllowedRequest), &req); err != nil {
+		panic(err)
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	for _, cfg := range []*Config{
+		{},
+		{EvalWorkers: workers, EvalQueueSize: 1024},
+	} {
+		b.Run(fmt.Sprintf("eval-workers=%d", cfg.EvalWorkers), func(b *testing.B) {
+			server := testAuthzServer(cfg, withCustomLogger(&testPlugin{}))
+			if server.evalPool != nil {
+				defer server.evalPool.Close()
+			}
+			ctx := context.Background()
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					output, err := server.Check(ctx, &req)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if output.Status.Code != int32(code.Code_OK) {
+						b.Error("Expected request to be allowed but got:", output)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCheckTLSMux measures the cost of grpc-tls-mux for plaintext clients
+// on a loopback connection: on a connection reused for all the checks, and on
+// a new connection per check, which pays for the peek of the first byte.
+func BenchmarkCheckTLSMux(b *testing.B) {
+	var req ext_authz.CheckRequest
+	if err := util.Unmarshal([]byte(exampleAllowedRequest), &req); err != nil {
+		panic(err)
+	}
+
+	for _, mux := range []bool{false, true} {
+		for _, newConn := range []bool{false, true} {
+			b.Run(fmt.Sprintf("mux=%v/new-conn=%v", mux, newConn), func(b *testing.B) {
+				server := testAuthzServer(nil, withCustomLogger(&testPlugin{}))
+
+				var lis net.Listener
+				lis, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if mux {
+					lis = newTLSMuxListener(lis, defaultGRPCConnectionTimeout).plain
+				}
+				go server.server.Serve(lis)
+				defer server.server.Stop()
+
+				dial := func() *grpc.ClientConn {
+					conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+					if err != nil {
+						b.Fatal(err)
+					}
+					return conn
+				}
+				conn := dial()
+				defer func() { conn.Close() }()
+				ctx := context.Background()
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if newConn {
+						conn.Close()
+						conn = dial()
+					}
+					output, err := ext_authz.NewAuthorizationClient(conn).Check(ctx, &req)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if output.Status.Code != int32(code.Code_OK) {
+						b.Fatal("Expected request to be allowed but got:", output)
+					}
+				}
+			})
+		}
+	}
+}
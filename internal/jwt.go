@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+)
+
+const (
+	defaultJWTHeader = "authorization"
+
+	// The JWKS is fetched again after jwksRefreshInterval, e.g. for keys to
+	// be rotated.
+	jwksRefreshInterval = 5 * time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+)
+
+// validateJWT checks the parse-jwt, jwt-header, jwks-url and jwt-audience
+// fields.
+func (cfg *Config) validateJWT() error {
+	if !cfg.ParseJWT {
+		if cfg.JWTHeader != "" || cfg.JWKSURL != "" || cfg.JWTAudience != "" {
+			return fmt.Errorf("invalid config: jwt-header, jwks-url and jwt-audience require parse-jwt")
+		}
+		return nil
+	}
+
+	// Envoy sends header names in lowercase.
+	cfg.JWTHeader = strings.ToLower(cfg.JWTHeader)
+	if cfg.JWTHeader == "" {
+		cfg.JWTHeader = defaultJWTHeader
+	}
+
+	if cfg.JWKSURL == "" {
+		if cfg.JWTAudience != "" {
+			return fmt.Errorf("invalid config: jwt-audience requires jwks-url")
+		}
+		return nil
+	}
+	if u, err := url.Parse(cfg.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid config: jwks-url must be an http or https URL: %q", cfg.JWKSURL)
+	}
+	// A cached input would keep the claims of a token after it has expired.
+	if cfg.InputCacheSize > 0 {
+		return fmt.Errorf("invalid config: jwks-url cannot be combined with input-cache-size")
+	}
+	return nil
+}
+
+// jwtVerifier verifies the JWTs decoded at input.parsed_jwt with the keys of
+// jwks-url, using the io.jwt.decode_verify builtin, which also checks the
+// "exp" and "nbf" claims and, with jwt-audience, the "aud" claim. Without an
+// audience, decode_verify rejects the tokens with an "aud" claim.
+type jwtVerifier struct {
+	url      string
+	audience string
+	client   *http.Client
+
+	queryOnce sync.Once
+	query     rego.PreparedEvalQuery
+	queryErr  error
+
+	mtx       sync.Mutex
+	jwks      string
+	fetchedAt time.Time
+	fetchErr  error
+	fetching  chan struct{} // Closed when the fetch in progress is done.
+}
+
+func newJWTVerifier(jwksURL, audience string) *jwtVerifier {
+	return &jwtVerifier{
+		url:      jwksURL,
+		audience: audience,
+		client:   &http.Client{},
+	}
+}
+
+// verifyJWT removes the claims of a JWT that cannot be verified from the
+// input, so that policies only see verified claims.
+func (p *envoyExtAuthzGrpcServer) verifyJWT(ctx context.Context, req interface{}, jwtHeader string, input map[string]interface{}, logger logging.Logger) {
+	header, _ := requestHeader(req, jwtHeader)
+	valid, err := p.jwtVerifier.verify(ctx, envoyauth.JWTFromHeader(header))
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to verify JWT.")
+	} else if !valid {
+		logger.Debug("JWT is invalid or expired, removing input.parsed_jwt.")
+	}
+	if !valid {
+		delete(input, "parsed_jwt")
+	}
+}
+
+// verify returns whether the signature and the time claims of token are
+// valid.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (bool, error) {
+	v.queryOnce.Do(func() {
+		v.query, v.queryErr = rego.New(rego.Query(`io.jwt.decode_verify(input.token, input.constraints)`)).PrepareForEval(ctx)
+	})
+	if v.queryErr != nil {
+		return false, v.queryErr
+	}
+
+	jwks, err := v.keys(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	constraints := map[string]interface{}{"cert": jwks}
+	if v.audience != "" {
+		constraints["aud"] = v.audience
+	}
+
+	rs, err := v.query.Eval(ctx, rego.EvalInput(map[string]interface{}{"token": token, "constraints": constraints}))
+	if err != nil {
+		return false, err
+	}
+	if len(rs) != 1 || len(rs[0].Expressions) != 1 {
+		return false, fmt.Errorf("unexpected io.jwt.decode_verify result: %v", rs)
+	}
+	result, ok := rs[0].Expressions[0].Value.([]interface{})
+	if !ok || len(result) == 0 {
+		return false, fmt.Errorf("unexpected io.jwt.decode_verify result: %v", rs[0].Expressions[0].Value)
+	}
+	valid, _ := result[0].(bool)
+	return valid, nil
+}
+
+// keys returns the JWKS, fetching it if it is missing or stale. A single fetch
+// runs at a time, independently of the checks: a stale JWKS is used while it
+// is refreshed, and a failure to refresh it keeps the previous one. Without a
+// JWKS, the checks wait for the fetch in progress and share its result, until
+// ctx is done.
+func (v *jwtVerifier) keys(ctx context.Context) (string, error) {
+	v.mtx.Lock()
+	jwks := v.jwks
+	if jwks != "" && time.Since(v.fetchedAt) < jwksRefreshInterval {
+		v.mtx.Unlock()
+		return jwks, nil
+	}
+	done := v.fetching
+	if done == nil {
+		done = make(chan struct{})
+		v.fetching = done
+		go v.refresh(done)
+	}
+	v.mtx.Unlock()
+
+	if jwks != "" {
+		return jwks, nil
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if v.jwks == "" {
+		return "", v.fetchErr
+	}
+	return v.jwks, nil
+}
+
+// refresh fetches the JWKS, with a context of its own so that the fetch
+// outlives the check that started it, and then closes done.
+func (v *jwtVerifier) refresh(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	fetched, err := v.fetch(ctx)
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if err == nil {
+		v.jwks = fetched
+		v.fetchedAt = time.Now()
+	}
+	v.fetchErr = err
+	v.fetching = nil
+	close(done)
+}
+
+func (v *jwtVerifier) fetch(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to fetch jwks-url: %s", resp.Status)
+	}
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
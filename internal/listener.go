@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenConfig returns the net.ListenConfig used to create the TCP listener of
+// the gRPC server. Go already sets SO_REUSEADDR on TCP listeners on Unix.
+func (cfg *Config) listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{KeepAlive: cfg.listenerKeepAlive}
+
+	if cfg.ListenerReusePort {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	return lc
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package internal
+
+import "errors"
+
+const reusePortSupported = false
+
+func setReusePort(uintptr) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
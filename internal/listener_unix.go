@@ -0,0 +1,11 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package internal
+
+import "golang.org/x/sys/unix"
+
+const reusePortSupported = true
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"github.com/open-policy-agent/opa/logging"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	rpc_status "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// logErrorStatus returns the status that replaces the status of the decision
+// when the decision could not be logged, or nil to keep the decision:
+//
+//   - without fail-closed-on-log-error, an UNKNOWN status, which Envoy denies;
+//   - with fail-closed-on-log-error: true, a PERMISSION_DENIED status, so that
+//     no request is allowed without a decision log;
+//   - with fail-closed-on-log-error: false, nil: the request gets the decision
+//     of the policy, and the error is logged.
+func logErrorStatus(cfg *Config, logger logging.Logger, logErr error) *rpc_status.Status {
+	if cfg.FailClosedOnLogError == nil {
+		logger.WithFields(map[string]interface{}{"err": logErr}).Debug("Error when logging event")
+		return &rpc_status.Status{
+			Code:    int32(code.Code_UNKNOWN),
+			Message: logErr.Error(),
+		}
+	}
+
+	if *cfg.FailClosedOnLogError {
+		logger.WithFields(map[string]interface{}{"err": logErr}).Error("Unable to log decision, denying the request.")
+		return &rpc_status.Status{
+			Code:    int32(code.Code_PERMISSION_DENIED),
+			Message: logErr.Error(),
+		}
+	}
+
+	logger.WithFields(map[string]interface{}{"err": logErr}).Error("Unable to log decision, returning the decision without a decision log.")
+	return nil
+}
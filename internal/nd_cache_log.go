@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+)
+
+// ndBuiltinCacheJSON converts the non-deterministic builtin cache of a decision
+// for the decision log. With a positive maxBytes, the calls of whole builtins
+// are left out, in name order, once the serialized cache would exceed maxBytes,
+// so that the cache logged for the remaining builtins stays complete.
+func ndBuiltinCacheJSON(cache builtins.NDBCache, maxBytes int, logger logging.Logger) (interface{}, error) {
+	x, err := ast.JSON(cache.AsValue())
+	if err != nil || maxBytes <= 0 {
+		return x, err
+	}
+
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) <= maxBytes {
+		return x, nil
+	}
+
+	names := make([]string, 0, len(cache))
+	for name := range cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	truncated := map[string]interface{}{}
+	var dropped []string
+	size := len("{}")
+	for _, name := range names {
+		calls, err := ast.JSON(cache[name])
+		if err != nil {
+			return nil, err
+		}
+		bs, err := json.Marshal(map[string]interface{}{name: calls})
+		if err != nil {
+			return nil, err
+		}
+		// Each entry adds its own size without the braces, plus a comma.
+		if entrySize := len(bs) - 1; size+entrySize <= maxBytes {
+			truncated[name] = calls
+			size += entrySize
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"size":     len(bs),
+		"max-size": maxBytes,
+		"dropped":  dropped,
+	}).Debug("Truncated the ND builtin cache of the decision log.")
+
+	return truncated, nil
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// Values of metrics-exporters.
+	metricsExporterPrometheus    = "prometheus"
+	metricsExporterOpenTelemetry = "opentelemetry"
+
+	// instrumentationName is the name of the OpenTelemetry meter of the plugin.
+	instrumentationName = "github.com/open-policy-agent/opa-envoy-plugin"
+)
+
+// validateMetricsExporters checks the exporters of the performance metrics.
+func (cfg *Config) validateMetricsExporters() error {
+	if cfg.MetricsExporters != nil && len(cfg.MetricsExporters) == 0 {
+		return fmt.Errorf("invalid config: metrics-exporters must not be empty")
+	}
+	for _, e := range cfg.MetricsExporters {
+		if e != metricsExporterPrometheus && e != metricsExporterOpenTelemetry {
+			return fmt.Errorf("invalid config: metrics-exporters must contain only %q or %q", metricsExporterPrometheus, metricsExporterOpenTelemetry)
+		}
+	}
+	return nil
+}
+
+// exportsMetricsTo reports whether the performance metrics are exported to
+// exporter, Prometheus only unless metrics-exporters is set.
+func (cfg *Config) exportsMetricsTo(exporter string) bool {
+	if cfg.MetricsExporters == nil {
+		return exporter == metricsExporterPrometheus
+	}
+	for _, e := range cfg.MetricsExporters {
+		if e == exporter {
+			return true
+		}
+	}
+	return false
+}
+
+// meterProvider returns the OpenTelemetry meter provider the metrics of the
+// instance are recorded with. The plugin manager has no meter provider, so
+// this is the global one, set by the binary embedding OPA.
+func (p *envoyExtAuthzGrpcServer) meterProvider() metric.MeterProvider {
+	return otel.GetMeterProvider()
+}
+
+// otelMetrics records the performance metrics through the OpenTelemetry
+// metrics API, with the same names and attributes as the Prometheus metrics.
+type otelMetrics struct {
+	plugin              attribute.KeyValue
+	authzDuration       metric.Float64Histogram
+	inputBuildDuration  metric.Float64Histogram
+	errorCounter        metric.Int64Counter
+	slowDecisionCounter metric.Int64Counter
+}
+
+func newOTelMetrics(mp metric.MeterProvider, name string, buckets []float64) (*otelMetrics, error) {
+	meter := mp.Meter(instrumentationName)
+	m := &otelMetrics{plugin: attribute.String("plugin", name)}
+
+	var err error
+	m.authzDuration, err = meter.Float64Histogram("grpc_request_duration_seconds",
+		metric.WithDescription("A histogram of duration for grpc authz requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(buckets...))
+	if err != nil {
+		return nil, err
+	}
+	m.inputBuildDuration, err = meter.Float64Histogram("input_build_duration_seconds",
+		metric.WithDescription("A histogram of duration for building the input of authz requests, excluding cached inputs."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(buckets...))
+	if err != nil {
+		return nil, err
+	}
+	m.errorCounter, err = meter.Int64Counter("error_counter",
+		metric.WithDescription("A counter for errors"))
+	if err != nil {
+		return nil, err
+	}
+	m.slowDecisionCounter, err = meter.Int64Counter("slow_decision_counter",
+		metric.WithDescription("A counter for decisions that exceeded the slow decision threshold"))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *otelMetrics) observeAuthzDuration(ctx context.Context, seconds float64) {
+	m.authzDuration.Record(ctx, seconds, metric.WithAttributes(m.plugin, attribute.String("handler", "check")))
+}
+
+func (m *otelMetrics) observeInputBuildDuration(ctx context.Context, seconds float64, bodyParsed bool) {
+	m.inputBuildDuration.Record(ctx, seconds, metric.WithAttributes(m.plugin, attribute.Bool("body_parsed", bodyParsed)))
+}
+
+func (m *otelMetrics) countError(ctx context.Context, reason string) {
+	m.errorCounter.Add(ctx, 1, metric.WithAttributes(m.plugin, attribute.String("reason", reason)))
+}
+
+func (m *otelMetrics) countSlowDecision(ctx context.Context) {
+	m.slowDecisionCounter.Add(ctx, 1, metric.WithAttributes(m.plugin))
+}
+
+// countError counts an error of a check by reason, with the Prometheus and, if
+// enabled, the OpenTelemetry error counter.
+func (p *envoyExtAuthzGrpcServer) countError(ctx context.Context, reason string) {
+	p.metricErrorCounter.With(prometheus.Labels{"reason": reason}).Inc()
+	if p.otelMetrics != nil {
+		p.otelMetrics.countError(ctx, reason)
+	}
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	ext_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	rpc_status "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// Values of oversized-message-decision.
+const (
+	oversizedMessageDecisionReject = "reject"
+	oversizedMessageDecisionDeny   = "deny"
+)
+
+// oversizedMessageReason is the reason of the denial of oversized check
+// requests, with oversized-message-decision set to deny.
+const oversizedMessageReason = "body too large"
+
+// oversizedMessageError matches the errors of grpc-go, and of the gRPC-Web
+// handler, for received messages over the size limit.
+var oversizedMessageError = regexp.MustCompile(`message larger than max \((\d+) vs\. (\d+)\)`)
+
+// validateOversizedMessage checks the oversized-message-* options and sets
+// their defaults.
+func (cfg *Config) validateOversizedMessage() error {
+	switch cfg.OversizedMessageDecision {
+	case "":
+		cfg.OversizedMessageDecision = oversizedMessageDecisionReject
+	case oversizedMessageDecisionReject, oversizedMessageDecisionDeny:
+	default:
+		return fmt.Errorf("invalid config: oversized-message-decision must be one of %q or %q", oversizedMessageDecisionReject, oversizedMessageDecisionDeny)
+	}
+
+	if cfg.OversizedMessageDecision != oversizedMessageDecisionDeny {
+		if cfg.OversizedMessageMaxSize != 0 {
+			return fmt.Errorf("invalid config: oversized-message-max-size requires oversized-message-decision %q", oversizedMessageDecisionDeny)
+		}
+		return nil
+	}
+
+	if cfg.OversizedMessageMaxSize == 0 {
+		cfg.OversizedMessageMaxSize = byteSize(min(4*int64(cfg.GRPCMaxRecvMsgSize), math.MaxInt32))
+	}
+	if cfg.OversizedMessageMaxSize <= cfg.GRPCMaxRecvMsgSize {
+		return fmt.Errorf("invalid config: oversized-message-max-size must be larger than grpc-max-recv-msg-size")
+	}
+	return nil
+}
+
+// grpcMaxRecvMsgSize returns the size of the largest message received by the
+// gRPC server: with oversized-message-decision set to deny, check requests up
+// to oversized-message-max-size are received to be denied.
+func (cfg *Config) grpcMaxRecvMsgSize() int {
+	if cfg.OversizedMessageDecision == oversizedMessageDecisionDeny {
+		return int(cfg.OversizedMessageMaxSize)
+	}
+	return int(cfg.GRPCMaxRecvMsgSize)
+}
+
+// grpcMaxRecvMsgSizeOption returns the option setting grpcMaxRecvMsgSize.
+func (cfg *Config) grpcMaxRecvMsgSizeOption() string {
+	if cfg.OversizedMessageDecision == oversizedMessageDecisionDeny {
+		return "oversized-message-max-size"
+	}
+	return "grpc-max-recv-msg-size"
+}
+
+// oversizedCheck returns the denial of a check request over
+// grpc-max-recv-msg-size: a 413 with the reason in the body and, if set, the
+// denied-reason-header.
+func oversizedCheck(cfg *Config) *ext_authz_v3.CheckResponse {
+	resp := &ext_authz_v3.CheckResponse{
+		Status: &rpc_status.Status{Code: int32(code.Code_PERMISSION_DENIED), Message: oversizedMessageReason},
+		HttpResponse: &ext_authz_v3.CheckResponse_DeniedResponse{
+			DeniedResponse: &ext_authz_v3.DeniedHttpResponse{
+				Status: &ext_type_v3.HttpStatus{Code: ext_type_v3.StatusCode_PayloadTooLarge},
+				Body:   oversizedMessageReason,
+			},
+		},
+	}
+	if cfg.DeniedReasonHeader != "" {
+		addResponseHeader(resp, cfg.DeniedReasonHeader, oversizedMessageReason)
+	}
+	return resp
+}
+
+// logOversizedMessage logs a message over the limit of the option, rejected or
+// denied, with what to change to accept it.
+func (p *envoyExtAuthzGrpcServer) logOversizedMessage(ctx context.Context, method string, size, limit int, option string, denied bool) {
+	p.Logger().WithFields(map[string]interface{}{
+		"method": method,
+		"size":   size,
+		"limit":  limit,
+		"option": option,
+		"denied": denied,
+		"remedy": fmt.Sprintf("raise %s to at least %d bytes, or lower the max_request_bytes of the with_request_body of Envoy's ext_authz filter", option, size),
+	}).Error("Received a gRPC message larger than %s.", option)
+
+	if p.config().EnablePerformanceMetrics {
+		p.countError(ctx, "oversized_message")
+	}
+}
+
+// oversizedMessageStats is the gRPC stats handler logging the messages that
+// grpc-go rejects for exceeding the receive size limit, before any
+// interceptor or handler could see them, with a generic RESOURCE_EXHAUSTED.
+type oversizedMessageStats struct {
+	p *envoyExtAuthzGrpcServer
+}
+
+type rpcMethodKey struct{}
+
+func (h *oversizedMessageStats) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, rpcMethodKey{}, info.FullMethodName)
+}
+
+func (h *oversizedMessageStats) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	end, ok := s.(*stats.End)
+	if !ok || end.Error == nil {
+		return
+	}
+	size, limit, ok := oversizedMessage(end.Error)
+	if !ok {
+		return
+	}
+
+	cfg := h.p.config()
+	method, _ := ctx.Value(rpcMethodKey{}).(string)
+	h.p.logOversizedMessage(ctx, method, size, limit, cfg.grpcMaxRecvMsgSizeOption(), false)
+}
+
+func (h *oversizedMessageStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *oversizedMessageStats) HandleConn(context.Context, stats.ConnStats) {}
+
+// oversizedMessage returns the size and the limit of a message rejected with
+// err for exceeding the receive size limit.
+func oversizedMessage(err error) (int, int, bool) {
+	m := oversizedMessageError.FindStringSubmatch(status.Convert(err).Message())
+	if m == nil {
+		return 0, 0, false
+	}
+	size, err1 := strconv.Atoi(m[1])
+	limit, err2 := strconv.Atoi(m[2])
+	return size, limit, err1 == nil && err2 == nil
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+
+	internal_util "github.com/open-policy-agent/opa-envoy-plugin/internal/util"
+)
+
+// watchProtoDescriptor starts watching the configured proto descriptor and
+// reloads it whenever it changes on disk. The parent directory of a single
+// descriptor file is watched so that files replaced by a rename, as done by
+// most deployment tools, are picked up as well.
+func (p *envoyExtAuthzGrpcServer) watchProtoDescriptor(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	isDir := info.IsDir()
+	watchPath := path
+	if !isDir {
+		watchPath = filepath.Dir(path)
+	}
+
+	if err := watcher.Add(watchPath); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	p.protoWatcher = watcher
+	go p.reloadProtoDescriptorOnChange(watcher, path, isDir)
+	return nil
+}
+
+func (p *envoyExtAuthzGrpcServer) reloadProtoDescriptorOnChange(watcher *fsnotify.Watcher, path string, isDir bool) {
+	logger := p.Logger().WithFields(map[string]interface{}{"proto-descriptor": path})
+	target := filepath.Clean(path)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !isDir && filepath.Clean(event.Name) != target {
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+				continue
+			}
+			p.reloadProtoDescriptor(path)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.WithFields(map[string]interface{}{"err": err}).Error("Proto descriptor watcher failed.")
+		}
+	}
+}
+
+// reloadProtoDescriptor parses the descriptor at path and swaps it in for
+// subsequent checks. The previous descriptor is kept if parsing fails.
+func (p *envoyExtAuthzGrpcServer) reloadProtoDescriptor(path string) {
+	logger := p.Logger().WithFields(map[string]interface{}{"proto-descriptor": path})
+
+	ps, err := internal_util.ReadProtoSet(path)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to reload proto descriptor, keeping the previous one.")
+		return
+	}
+
+	p.protoSet.Store(ps)
+	if p.inputCache != nil {
+		p.inputCache.Purge()
+	}
+	logger.Info("Reloaded proto descriptor.")
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	ext_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	rpc_status "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+const (
+	// Values of rate-limit-key, besides "header:<name>".
+	rateLimitKeySourceAddress   = "source-address"
+	rateLimitKeySourcePrincipal = "source-principal"
+	rateLimitKeyHeaderPrefix    = "header:"
+
+	// Responses to a rate limited check.
+	rateLimitDecisionResourceExhausted = "resource-exhausted"
+	rateLimitDecisionDeny              = "deny"
+
+	defaultRateLimitMaxKeys = 10000
+)
+
+// validateRateLimit checks the rate-limit-* options and sets their defaults.
+func (cfg *Config) validateRateLimit() error {
+	if cfg.RateLimitKey == "" {
+		return nil
+	}
+
+	switch {
+	case cfg.RateLimitKey == rateLimitKeySourceAddress, cfg.RateLimitKey == rateLimitKeySourcePrincipal:
+	case strings.HasPrefix(cfg.RateLimitKey, rateLimitKeyHeaderPrefix) && len(cfg.RateLimitKey) > len(rateLimitKeyHeaderPrefix):
+		// Envoy sends header names in lowercase.
+		cfg.RateLimitKey = strings.ToLower(cfg.RateLimitKey)
+	default:
+		return fmt.Errorf("invalid config: rate-limit-key must be %q, %q or \"header:<name>\"", rateLimitKeySourceAddress, rateLimitKeySourcePrincipal)
+	}
+
+	if cfg.RateLimitRate <= 0 || math.IsInf(cfg.RateLimitRate, 0) || math.IsNaN(cfg.RateLimitRate) {
+		return fmt.Errorf("invalid config: rate-limit-rate must be a positive number of requests per second")
+	}
+
+	if cfg.RateLimitBurst < 0 {
+		return fmt.Errorf("invalid config: rate-limit-burst must be a non-negative integer")
+	}
+	if cfg.RateLimitBurst == 0 {
+		cfg.RateLimitBurst = int(math.Max(1, math.Ceil(cfg.RateLimitRate)))
+	}
+
+	if cfg.RateLimitMaxKeys < 0 {
+		return fmt.Errorf("invalid config: rate-limit-max-keys must be a non-negative integer")
+	}
+	if cfg.RateLimitMaxKeys == 0 {
+		cfg.RateLimitMaxKeys = defaultRateLimitMaxKeys
+	}
+
+	switch cfg.RateLimitDecision {
+	case "":
+		cfg.RateLimitDecision = rateLimitDecisionResourceExhausted
+	case rateLimitDecisionResourceExhausted, rateLimitDecisionDeny:
+	default:
+		return fmt.Errorf("invalid config: rate-limit-decision must be one of %q or %q", rateLimitDecisionResourceExhausted, rateLimitDecisionDeny)
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket per identity of the clients, e.g. per source
+// address, that rejects the checks of a client once its bucket is empty. The
+// buckets of the maxKeys most recently seen identities are kept: a client
+// whose bucket was evicted starts again with a full bucket.
+type rateLimiter struct {
+	key     string
+	limit   rate.Limit
+	burst   int
+	maxKeys int
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// Set by registerMetrics when performance metrics are enabled.
+	allowed       prometheus.Counter
+	rejected      prometheus.Counter
+	rejectedByKey *prometheus.CounterVec
+}
+
+type rateLimiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newRateLimiter(key string, limit float64, burst, maxKeys int) *rateLimiter {
+	return &rateLimiter{
+		key:     key,
+		limit:   rate.Limit(limit),
+		burst:   burst,
+		maxKeys: maxKeys,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Allow reports whether a check of the client identified by key may go
+// through, taking a token from its bucket.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var limiter *rate.Limiter
+	if e, ok := l.entries[key]; ok {
+		l.lru.MoveToFront(e)
+		limiter = e.Value.(*rateLimiterEntry).limiter
+	} else {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.entries[key] = l.lru.PushFront(&rateLimiterEntry{key: key, limiter: limiter})
+		if l.lru.Len() > l.maxKeys {
+			l.evict()
+		}
+	}
+
+	if limiter.Allow() {
+		if l.allowed != nil {
+			l.allowed.Inc()
+		}
+		return true
+	}
+
+	if l.rejected != nil {
+		l.rejected.Inc()
+		l.rejectedByKey.WithLabelValues(key).Inc()
+	}
+	return false
+}
+
+// evict removes the least recently seen identity, with its metrics.
+func (l *rateLimiter) evict() {
+	oldest := l.lru.Back()
+	l.lru.Remove(oldest)
+	key := oldest.Value.(*rateLimiterEntry).key
+	delete(l.entries, key)
+	if l.rejectedByKey != nil {
+		l.rejectedByKey.DeleteLabelValues(key)
+	}
+}
+
+// Len returns the number of identities with a bucket.
+func (l *rateLimiter) Len() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.lru.Len()
+}
+
+// registerMetrics creates the rate limiter metrics and registers them with
+// reg. The per key counter only has series for the identities with a bucket.
+func (l *rateLimiter) registerMetrics(reg prometheus.Registerer) {
+	l.allowed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limit_allowed_checks",
+		Help: "A counter for check requests that were not rate limited",
+	})
+	l.rejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limit_rejected_checks",
+		Help: "A counter for check requests answered with rate-limit-decision",
+	})
+	l.rejectedByKey = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_rejected_checks_by_key",
+		Help: "A counter for check requests answered with rate-limit-decision, by rate-limit-key",
+	}, []string{"key"})
+	keys := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "rate_limit_keys",
+		Help: "The number of identities tracked by the rate limiter",
+	}, func() float64 { return float64(l.Len()) })
+
+	reg.MustRegister(l.allowed, l.rejected, l.rejectedByKey, keys)
+}
+
+// identity returns the identity of the client of req according to the
+// rate-limit-key, and false if the request has none, e.g. no principal
+// without mTLS.
+func (l *rateLimiter) identity(req interface{}) (string, bool) {
+	var id string
+	switch l.key {
+	case rateLimitKeySourceAddress:
+		_, _, id = requestSummary(req)
+	case rateLimitKeySourcePrincipal:
+		switch req := req.(type) {
+		case *ext_authz_v3.CheckRequest:
+			id = req.GetAttributes().GetSource().GetPrincipal()
+		case *ext_authz_v2.CheckRequest:
+			id = req.GetAttributes().GetSource().GetPrincipal()
+		}
+	default:
+		id, _ = requestHeader(req, strings.TrimPrefix(l.key, rateLimitKeyHeaderPrefix))
+	}
+	return id, id != ""
+}
+
+// rateLimitedCheck returns the configured rate-limit-decision for requests of
+// clients over their rate limit: a RESOURCE_EXHAUSTED status, which Envoy
+// answers with a 429, or a PERMISSION_DENIED one.
+func rateLimitedCheck(cfg *Config) *ext_authz_v3.CheckResponse {
+	if cfg.RateLimitDecision == rateLimitDecisionDeny {
+		return &ext_authz_v3.CheckResponse{Status: &rpc_status.Status{Code: int32(code.Code_PERMISSION_DENIED)}}
+	}
+
+	return &ext_authz_v3.CheckResponse{
+		Status: &rpc_status.Status{Code: int32(code.Code_RESOURCE_EXHAUSTED), Message: "rate limit exceeded"},
+		HttpResponse: &ext_authz_v3.CheckResponse_DeniedResponse{
+			DeniedResponse: &ext_authz_v3.DeniedHttpResponse{
+				Status: &ext_type_v3.HttpStatus{Code: ext_type_v3.StatusCode_TooManyRequests},
+			},
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+	"github.com/open-policy-agent/opa/metrics"
+)
+
+const defaultExpressionsEvaluatedSampleRate = 0.01
+
+// validateRegoMetrics checks expressions-evaluated-sample-rate.
+func (cfg *Config) validateRegoMetrics() error {
+	if cfg.ExpressionsEvaluatedSampleRate < 0 || cfg.ExpressionsEvaluatedSampleRate > 1 {
+		return fmt.Errorf("invalid config: expressions-evaluated-sample-rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// regoMetrics exports the evaluation metrics of each decision, separating the
+// time spent in the policy from the grpc_request_duration_seconds of the whole
+// request.
+type regoMetrics struct {
+	evalDuration    prometheus.Histogram
+	compileDuration prometheus.Histogram
+	expressions     prometheus.Histogram
+
+	// expressionsSampleRate is the fraction of the evaluations whose
+	// expressions are counted, as counting them traces the evaluation.
+	expressionsSampleRate float64
+}
+
+func newRegoMetrics(buckets []float64, expressionsSampleRate float64) *regoMetrics {
+	return &regoMetrics{
+		expressionsSampleRate: expressionsSampleRate,
+		evalDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rego_query_eval_duration_seconds",
+			Help:    "A histogram of duration for policy evaluations.",
+			Buckets: buckets,
+		}),
+		compileDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rego_query_compile_duration_seconds",
+			Help:    "A histogram of duration for query compilations, done on the first request after a policy update.",
+			Buckets: buckets,
+		}),
+		expressions: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rego_expressions_evaluated",
+			Help:    "A histogram of the number of expressions evaluated per policy evaluation.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		}),
+	}
+}
+
+// countExpressions reports whether the expressions of an evaluation are to be
+// counted.
+func (m *regoMetrics) countExpressions() bool {
+	return m.expressionsSampleRate >= 1 || rand.Float64() < m.expressionsSampleRate
+}
+
+func (m *regoMetrics) registerMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(m.evalDuration, m.compileDuration, m.expressions)
+}
+
+// observe records the metrics of a decision. Decisions that were not
+// evaluated, e.g. bypassed requests, have no evaluation timer and are skipped.
+func (m *regoMetrics) observe(mt metrics.Metrics) {
+	all := mt.All()
+
+	eval, ok := all["timer_"+metrics.RegoQueryEval+"_ns"].(int64)
+	if !ok {
+		return
+	}
+	m.evalDuration.Observe(float64(eval) / 1e9)
+
+	if compile, ok := all["timer_"+metrics.RegoQueryCompile+"_ns"].(int64); ok {
+		m.compileDuration.Observe(float64(compile) / 1e9)
+	}
+	if expressions, ok := all["counter_"+envoyauth.ExpressionsEvaluatedCounter].(uint64); ok {
+		m.expressions.Observe(float64(expressions))
+	}
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	ext_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ext_authz_v2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	ext_authz_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// requestHeader returns the value of the (lowercase) header name of the HTTP
+// request of req, and false for checks of network connections.
+func requestHeader(req interface{}, name string) (string, bool) {
+	switch req := req.(type) {
+	case *ext_authz_v3.CheckRequest:
+		http := req.GetAttributes().GetRequest().GetHttp()
+		return http.GetHeaders()[name], http != nil
+	case *ext_authz_v2.CheckRequest:
+		http := req.GetAttributes().GetRequest().GetHttp()
+		return http.GetHeaders()[name], http != nil
+	}
+	return "", false
+}
+
+// addResponseHeader adds a header to the response Envoy sends to the client,
+// whether the request is allowed or denied.
+func addResponseHeader(resp *ext_authz_v3.CheckResponse, name, value string) {
+	header := &ext_core_v3.HeaderValueOption{
+		Header: &ext_core_v3.HeaderValue{Key: name, Value: value},
+	}
+
+	switch r := resp.HttpResponse.(type) {
+	case *ext_authz_v3.CheckResponse_OkResponse:
+		r.OkResponse.ResponseHeadersToAdd = append(r.OkResponse.ResponseHeadersToAdd, header)
+	case *ext_authz_v3.CheckResponse_DeniedResponse:
+		r.DeniedResponse.Headers = append(r.DeniedResponse.Headers, header)
+	case nil:
+		if resp.GetStatus().GetCode() == int32(code.Code_OK) {
+			resp.HttpResponse = &ext_authz_v3.CheckResponse_OkResponse{
+				OkResponse: &ext_authz_v3.OkHttpResponse{ResponseHeadersToAdd: []*ext_core_v3.HeaderValueOption{header}},
+			}
+		} else {
+			resp.HttpResponse = &ext_authz_v3.CheckResponse_DeniedResponse{
+				DeniedResponse: &ext_authz_v3.DeniedHttpResponse{Headers: []*ext_core_v3.HeaderValueOption{header}},
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/ast"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+	responsev1 "github.com/open-policy-agent/opa-envoy-plugin/proto/response/v1"
+)
+
+// responseAuthorizationServer implements the ResponseAuthorization service,
+// which evaluates the response-path query against the attributes of an
+// upstream response. The evaluation is separate from the check of the request:
+// it has its own transaction, decision ID and decision log entry.
+type responseAuthorizationServer struct {
+	responsev1.UnimplementedResponseAuthorizationServer
+	v3 *envoyExtAuthzGrpcServer
+}
+
+// CheckResponse is opa.envoy.response.v1.ResponseAuthorization/CheckResponse.
+// Boolean decisions are returned as {"allowed": <decision>}.
+func (s *responseAuthorizationServer) CheckResponse(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	p := s.v3
+	cfg := p.config()
+	logger := p.Logger()
+
+	// response-path may have been unset by Reconfigure.
+	if cfg.responseQuery == nil {
+		return nil, status.Error(codes.FailedPrecondition, "response-path is not set")
+	}
+
+	input, err := envoyauth.ResponseToInput(req.AsMap())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	result, stopeval, err := envoyauth.NewEvalResult()
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to start new evaluation.")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	txn, txnClose, err := p.getTxn(ctx, result)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"err": err}).Error("Unable to start new storage transaction.")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	result.Txn = txn
+
+	logger = logger.WithFields(map[string]interface{}{"decision-id": result.DecisionID})
+
+	var evalErr error
+	defer func() {
+		stopeval()
+		if logErr := p.log(ctx, "", cfg.ResponsePath, input, result, evalErr); logErr != nil {
+			logger.WithFields(map[string]interface{}{"err": logErr}).Debug("Error when logging event")
+		}
+		_ = txnClose(ctx, evalErr) // Ignore error
+	}()
+
+	inputValue, err := ast.InterfaceToValue(input)
+	if err != nil {
+		evalErr = err
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if cfg.InputRootKey != "" {
+		inputValue = ast.NewObject(ast.Item(ast.StringTerm(cfg.InputRootKey), ast.NewTerm(inputValue)))
+	}
+
+	evalCtx := ctx
+	if cfg.evalTimeout > 0 {
+		var cancel context.CancelFunc
+		evalCtx, cancel = context.WithTimeout(ctx, cfg.evalTimeout)
+		defer cancel()
+	}
+
+	if internalErr := p.eval(ctx, evalCtx, cfg, cfg.responseQuery.evalContext(p), inputValue, result, logger); internalErr != nil {
+		evalErr = internalErr.Unwrap()
+		logger.WithFields(map[string]interface{}{
+			"err":            evalErr,
+			"error_code":     internalErr.Code,
+			"error_category": internalErr.Category().Error(),
+		}).Error("Unable to process check response request.")
+		return nil, status.Error(codes.Internal, evalErr.Error())
+	}
+
+	decision := result.Decision
+	switch d := decision.(type) {
+	case bool:
+		decision = map[string]interface{}{"allowed": d}
+	case map[string]interface{}:
+	default:
+		evalErr = fmt.Errorf("illegal value for policy evaluation result: %T", d)
+		return nil, status.Error(codes.Internal, evalErr.Error())
+	}
+
+	v, err := decisionMetadata(decision, 0)
+	if err != nil {
+		evalErr = err
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return v.GetStructValue(), nil
+}
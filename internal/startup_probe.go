@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/plugins"
+
+	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
+)
+
+// reportReady reports the plugin ready once it is serving, the bundles have
+// been activated if wait-for-bundle is set, and the startup probe has passed.
+func (p *envoyExtAuthzGrpcServer) reportReady() {
+	cfg := p.config()
+	if !p.serving.Load() || (cfg.WaitForBundle && !p.bundlesActivated.Load()) {
+		return
+	}
+
+	if !p.startupProbePassed.Load() {
+		if err := p.startupProbe(context.Background(), cfg); err != nil {
+			p.Logger().WithFields(map[string]interface{}{"err": err}).Error("Startup probe failed, the plugin is not ready.")
+			return
+		}
+		p.startupProbePassed.Store(true)
+	}
+
+	status := &plugins.Status{State: plugins.StateOK}
+	if addr := p.Addr(); addr != nil {
+		status.Message = "listening on " + addr.String()
+	}
+	p.manager.UpdatePluginStatus(p.name, status)
+}
+
+// startupProbe evaluates the query against the startup-probe-input. It fails if
+// the evaluation fails or if the decision is not a valid decision.
+func (p *envoyExtAuthzGrpcServer) startupProbe(ctx context.Context, cfg *Config) error {
+	if cfg.StartupProbeInput == nil {
+		return nil
+	}
+
+	input, err := ast.InterfaceToValue(cfg.StartupProbeInput)
+	if err != nil {
+		return err
+	}
+
+	result, stop, err := envoyauth.NewEvalResult()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	evalCtx := ctx
+	if cfg.evalTimeout > 0 {
+		var cancel context.CancelFunc
+		evalCtx, cancel = context.WithTimeout(ctx, cfg.evalTimeout)
+		defer cancel()
+	}
+
+	if err := p.eval(ctx, evalCtx, cfg, cfg.query.evalContext(p), input, result, p.Logger()); err != nil {
+		return err
+	}
+
+	if _, err := result.IsAllowed(); err != nil {
+		return fmt.Errorf("invalid decision: %w", err)
+	}
+	return nil
+}
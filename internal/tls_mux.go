@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// tlsRecordTypeHandshake is the first byte of a TLS ClientHello. The first
+// byte of a plaintext gRPC connection is the "P" of the HTTP/2 preface.
+const tlsRecordTypeHandshake = 0x16
+
+// validateTLSMux checks the grpc-tls-* options and loads the key pair.
+func (cfg *Config) validateTLSMux() error {
+	if !cfg.GRPCTLSMux {
+		if cfg.GRPCTLSCertFile != "" || cfg.GRPCTLSKeyFile != "" {
+			return fmt.Errorf("invalid config: grpc-tls-cert-file and grpc-tls-key-file require grpc-tls-mux")
+		}
+		return nil
+	}
+
+	if cfg.GRPCTLSCertFile == "" || cfg.GRPCTLSKeyFile == "" {
+		return fmt.Errorf("invalid config: grpc-tls-mux requires grpc-tls-cert-file and grpc-tls-key-file")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("invalid config: grpc-tls-cert-file and grpc-tls-key-file: %w", err)
+	}
+	cfg.tlsCertificate = &cert
+	return nil
+}
+
+// tlsConfig returns the TLS configuration of the TLS gRPC server.
+func (cfg *Config) tlsConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cfg.tlsCertificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// tlsMuxListener splits the connections of a listener between a plaintext and
+// a TLS gRPC server, according to the first byte sent by the client. The byte
+// is read on a goroutine per connection, so that a client that sends nothing
+// does not hold up the others, and replayed to the server of the connection.
+type tlsMuxListener struct {
+	net.Listener
+	timeout time.Duration
+
+	plain *muxChildListener
+	tls   *muxChildListener
+}
+
+func newTLSMuxListener(l net.Listener, timeout time.Duration) *tlsMuxListener {
+	closed := make(chan struct{})
+	var once sync.Once
+	closeFunc := func() error {
+		var err error
+		once.Do(func() {
+			close(closed)
+			err = l.Close()
+		})
+		return err
+	}
+
+	m := &tlsMuxListener{
+		Listener: l,
+		timeout:  timeout,
+		plain:    &muxChildListener{addr: l.Addr(), conns: make(chan net.Conn), closed: closed, close: closeFunc},
+		tls:      &muxChildListener{addr: l.Addr(), conns: make(chan net.Conn), closed: closed, close: closeFunc},
+	}
+	go m.serve()
+	return m
+}
+
+func (m *tlsMuxListener) serve() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			_ = m.plain.close()
+			return
+		}
+		go m.route(conn)
+	}
+}
+
+// route peeks the first byte of conn and hands it to the child listener of
+// its protocol. Connections that send nothing within the timeout are closed.
+func (m *tlsMuxListener) route(conn net.Conn) {
+	if m.timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(m.timeout))
+	}
+	r := bufio.NewReaderSize(conn, 16)
+	b, err := r.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	child := m.plain
+	if b[0] == tlsRecordTypeHandshake {
+		child = m.tls
+	}
+	select {
+	case child.conns <- &peekedConn{Conn: conn, r: r}:
+	case <-child.closed:
+		_ = conn.Close()
+	}
+}
+
+// muxChildListener is the listener of the connections of one protocol of a
+// tlsMuxListener. Closing it closes the parent listener.
+type muxChildListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	close  func() error
+}
+
+func (l *muxChildListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxChildListener) Close() error {
+	return l.close()
+}
+
+func (l *muxChildListener) Addr() net.Addr {
+	return l.addr
+}
+
+// peekedConn is a connection whose first bytes were read into r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
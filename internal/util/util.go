@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
@@ -12,17 +14,89 @@ import (
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
-// ReadProtoSet - Reads protobuf files from disk
+// ReadProtoSet - Reads protobuf files from disk. The path may either point at a
+// single FileDescriptorSet or at a directory; in the latter case every
+// descriptor set found in the directory is merged into a single registry.
 func ReadProtoSet(path string) (*protoregistry.Files, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		fileSet, err := readFileDescriptorSet(path)
+		if err != nil {
+			return nil, err
+		}
+		return protodesc.NewFiles(fileSet)
+	}
+	return readProtoSetDir(path)
+}
+
+func readFileDescriptorSet(path string) (*descriptorpb.FileDescriptorSet, error) {
 	protoSet, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 	var fileSet descriptorpb.FileDescriptorSet
 	if err := proto.Unmarshal(protoSet, &fileSet); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &fileSet, nil
+}
+
+// readProtoSetDir merges the descriptor sets (*.pb, *.desc, *.protoset) found
+// directly inside dir. Files shared between sets, such as well-known types,
+// are only registered once as long as their definitions are identical.
+func readProtoSetDir(dir string) (*protoregistry.Files, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
 		return nil, err
 	}
-	return protodesc.NewFiles(&fileSet)
+
+	var merged descriptorpb.FileDescriptorSet
+	seen := map[string]string{}
+	byName := map[string]*descriptorpb.FileDescriptorProto{}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isProtoSetFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		fileSet, err := readFileDescriptorSet(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, fd := range fileSet.GetFile() {
+			name := fd.GetName()
+			if prev, ok := byName[name]; ok {
+				if !proto.Equal(prev, fd) {
+					return nil, fmt.Errorf("proto file %q is defined differently in %s and %s", name, seen[name], path)
+				}
+				continue
+			}
+			byName[name] = fd
+			seen[name] = path
+			merged.File = append(merged.File, fd)
+		}
+	}
+
+	if len(merged.File) == 0 {
+		return nil, fmt.Errorf("no proto descriptor sets found in %s", dir)
+	}
+
+	files, err := protodesc.NewFiles(&merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge proto descriptor sets in %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+func isProtoSetFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".pb", ".desc", ".protoset":
+		return true
+	}
+	return false
 }
 
 // UUID4 Generates a new universally unique identifier
@@ -2,6 +2,7 @@ package decisionlog
 
 import (
 	"context"
+	"errors"
 
 	"github.com/open-policy-agent/opa-envoy-plugin/envoyauth"
 	"github.com/open-policy-agent/opa/ast"
@@ -20,6 +21,10 @@ func (e *internalError) Error() string {
 	return e.Message
 }
 
+// undefinedDecision is the mapped_result of the decision log events of
+// undefined queries, whose result is left out.
+var undefinedDecision interface{} = map[string]interface{}{"decision": "undefined"}
+
 // LogDecision - Logs a decision log event
 func LogDecision(ctx context.Context, manager *plugins.Manager, info *server.Info, result *envoyauth.EvalResult, err error) error {
 	plugin := logs.Lookup(manager)
@@ -27,6 +32,14 @@ func LogDecision(ctx context.Context, manager *plugins.Manager, info *server.Inf
 		return nil
 	}
 
+	SetDecision(info, result, err)
+
+	return plugin.Log(ctx, info)
+}
+
+// SetDecision - Sets the decision, or the error of the evaluation, and the bundle
+// revisions, decision ID and metrics of the evaluation on a decision log event
+func SetDecision(info *server.Info, result *envoyauth.EvalResult, err error) {
 	info.Revision = result.Revision
 
 	bundles := map[string]server.BundleInfo{}
@@ -39,6 +52,11 @@ func LogDecision(ctx context.Context, manager *plugins.Manager, info *server.Inf
 	info.Metrics = result.Metrics
 	info.Txn = result.Txn
 
+	if result.Undefined || errors.Is(err, envoyauth.ErrUndefinedDecision) {
+		x := undefinedDecision
+		info.MappedResults = &x
+	}
+
 	if err != nil {
 		switch err.(type) {
 		case *storage.Error, *ast.Error, ast.Errors:
@@ -55,13 +73,13 @@ func LogDecision(ctx context.Context, manager *plugins.Manager, info *server.Inf
 			err = &internalError{Message: err.Error()}
 		}
 		info.Error = err
-	} else {
+	} else if !result.Undefined {
+		// Like OPA, leave the result out of the decision log when the query
+		// was undefined.
 		var x interface{}
 		if result != nil {
 			x = result.Decision
 		}
 		info.Results = &x
 	}
-
-	return plugin.Log(ctx, info)
 }
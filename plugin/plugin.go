@@ -5,20 +5,42 @@
 package plugin
 
 import (
+	"net"
+
 	"github.com/open-policy-agent/opa/plugins"
 
 	"github.com/open-policy-agent/opa-envoy-plugin/internal"
 )
 
 // Factory defines the interface OPA uses to instantiate a plugin.
-type Factory struct{}
+type Factory struct {
+	// Instance names the instance created by the factory, which must be
+	// registered as InstanceName(Instance). The default instance has no name.
+	Instance string
+}
 
 // PluginName is the name to register with the OPA plugin manager
 const PluginName = internal.PluginName
 
+// InstanceName returns the name to register the named instance with, e.g.
+// envoy_ext_authz_grpc_egress for "egress".
+func InstanceName(instance string) string {
+	return internal.InstanceName(instance)
+}
+
+// Addr returns the address the named instance is listening on, e.g. to find the
+// port chosen for an addr with port 0, or nil if it is not listening.
+func Addr(m *plugins.Manager, instance string) net.Addr {
+	p, ok := m.Plugin(InstanceName(instance)).(interface{ Addr() net.Addr })
+	if !ok {
+		return nil
+	}
+	return p.Addr()
+}
+
 // New returns the object initialized with a valid plugin configuration.
-func (Factory) New(m *plugins.Manager, config interface{}) plugins.Plugin {
-	return internal.New(m, config.(*internal.Config))
+func (f Factory) New(m *plugins.Manager, config interface{}) plugins.Plugin {
+	return internal.NewInstance(m, config.(*internal.Config), f.Instance)
 }
 
 // Validate returns a valid configuration to instantiate the plugin.
@@ -0,0 +1,89 @@
+package batchv1
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const batchCheckFullMethodName = "/opa.envoy.batch.v1.BatchAuthorization/BatchCheck"
+
+// BatchAuthorizationClient is the client API for the BatchAuthorization service.
+type BatchAuthorizationClient interface {
+	// BatchCheck evaluates every request in the batch and returns the results in
+	// the same order.
+	BatchCheck(ctx context.Context, in *BatchCheckRequest, opts ...grpc.CallOption) (*BatchCheckResponse, error)
+}
+
+type batchAuthorizationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewBatchAuthorizationClient returns a client for the BatchAuthorization service.
+func NewBatchAuthorizationClient(cc grpc.ClientConnInterface) BatchAuthorizationClient {
+	return &batchAuthorizationClient{cc}
+}
+
+func (c *batchAuthorizationClient) BatchCheck(ctx context.Context, in *BatchCheckRequest, opts ...grpc.CallOption) (*BatchCheckResponse, error) {
+	out := new(BatchCheckResponse)
+	if err := c.cc.Invoke(ctx, batchCheckFullMethodName, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BatchAuthorizationServer is the server API for the BatchAuthorization service.
+type BatchAuthorizationServer interface {
+	// BatchCheck evaluates every request in the batch and returns the results in
+	// the same order.
+	BatchCheck(context.Context, *BatchCheckRequest) (*BatchCheckResponse, error)
+}
+
+// UnimplementedBatchAuthorizationServer can be embedded to have forward
+// compatible implementations.
+type UnimplementedBatchAuthorizationServer struct{}
+
+// BatchCheck returns an Unimplemented error.
+func (UnimplementedBatchAuthorizationServer) BatchCheck(context.Context, *BatchCheckRequest) (*BatchCheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchCheck not implemented")
+}
+
+// RegisterBatchAuthorizationServer registers srv with s.
+func RegisterBatchAuthorizationServer(s grpc.ServiceRegistrar, srv BatchAuthorizationServer) {
+	s.RegisterService(&BatchAuthorizationServiceDesc, srv)
+}
+
+func batchCheckHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BatchAuthorizationServer).BatchCheck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: batchCheckFullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BatchAuthorizationServer).BatchCheck(ctx, req.(*BatchCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// BatchAuthorizationServiceDesc is the grpc.ServiceDesc for the
+// BatchAuthorization service.
+var BatchAuthorizationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opa.envoy.batch.v1.BatchAuthorization",
+	HandlerType: (*BatchAuthorizationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BatchCheck",
+			Handler:    batchCheckHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/batch/v1/batch.proto",
+}
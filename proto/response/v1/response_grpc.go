@@ -0,0 +1,90 @@
+package responsev1
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const checkResponseFullMethodName = "/opa.envoy.response.v1.ResponseAuthorization/CheckResponse"
+
+// ResponseAuthorizationClient is the client API for the ResponseAuthorization service.
+type ResponseAuthorizationClient interface {
+	// CheckResponse evaluates the response attributes and returns the decision
+	// as an object.
+	CheckResponse(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*structpb.Struct, error)
+}
+
+type responseAuthorizationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewResponseAuthorizationClient returns a client for the ResponseAuthorization service.
+func NewResponseAuthorizationClient(cc grpc.ClientConnInterface) ResponseAuthorizationClient {
+	return &responseAuthorizationClient{cc}
+}
+
+func (c *responseAuthorizationClient) CheckResponse(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*structpb.Struct, error) {
+	out := new(structpb.Struct)
+	if err := c.cc.Invoke(ctx, checkResponseFullMethodName, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ResponseAuthorizationServer is the server API for the ResponseAuthorization service.
+type ResponseAuthorizationServer interface {
+	// CheckResponse evaluates the response attributes and returns the decision
+	// as an object.
+	CheckResponse(context.Context, *structpb.Struct) (*structpb.Struct, error)
+}
+
+// UnimplementedResponseAuthorizationServer can be embedded to have forward
+// compatible implementations.
+type UnimplementedResponseAuthorizationServer struct{}
+
+// CheckResponse returns an Unimplemented error.
+func (UnimplementedResponseAuthorizationServer) CheckResponse(context.Context, *structpb.Struct) (*structpb.Struct, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckResponse not implemented")
+}
+
+// RegisterResponseAuthorizationServer registers srv with s.
+func RegisterResponseAuthorizationServer(s grpc.ServiceRegistrar, srv ResponseAuthorizationServer) {
+	s.RegisterService(&ResponseAuthorizationServiceDesc, srv)
+}
+
+func checkResponseHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(structpb.Struct)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ResponseAuthorizationServer).CheckResponse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: checkResponseFullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ResponseAuthorizationServer).CheckResponse(ctx, req.(*structpb.Struct))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ResponseAuthorizationServiceDesc is the grpc.ServiceDesc for the
+// ResponseAuthorization service.
+var ResponseAuthorizationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opa.envoy.response.v1.ResponseAuthorization",
+	HandlerType: (*ResponseAuthorizationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CheckResponse",
+			Handler:    checkResponseHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/response/v1/response.proto",
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/open-policy-agent/opa/tracing"
 	"github.com/open-policy-agent/opa/util"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"google.golang.org/genproto/googleapis/rpc/code"
@@ -159,6 +160,23 @@ func TestServerSpanAndTraceIdInDecisionLogAndB3TraceHeadersPropagation(t *testin
 		if got, expected := spans[0].Name, "HTTP GET"; got != expected {
 			t.Fatalf("Expected span name to be %q but got %q", expected, got)
 		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range spans[1].Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+		if got, ok := attrs["opa.decision.allowed"]; !ok || !got.AsBool() {
+			t.Fatalf("Expected span attribute opa.decision.allowed to be true but got %v", got.Emit())
+		}
+		if got, expected := attrs["opa.query"].AsString(), "data.envoy.authz.allow"; got != expected {
+			t.Fatalf("Expected span attribute opa.query to be %q but got %q", expected, got)
+		}
+		if got := attrs["opa.decision_id"].AsString(); got == "" {
+			t.Fatal("Expected span attribute opa.decision_id to be set")
+		}
+		if got := attrs["opa.decision.eval_duration_ns"].AsInt64(); got <= 0 {
+			t.Fatalf("Expected span attribute opa.decision.eval_duration_ns to be positive but got %d", got)
+		}
+
 		parentSpanID := spans[1].SpanContext.SpanID()
 		if got, expected := spans[0].Parent.SpanID(), parentSpanID; got != expected {
 			t.Errorf("expected span to be child of %v, got parent %v", expected, got)